@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	cli "github.com/urfave/cli/v2"
+)
+
+// encryptFlags encrypt generated configs with age
+func encryptFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "encrypt-to",
+			Usage: "Encrypt the config with age to this recipient (age1... or an ssh-ed25519/ssh-rsa public key), can be repeated",
+		},
+		&cli.BoolFlag{
+			Name:  "armor",
+			Usage: "Write age encrypted configs as PEM-like text instead of binary",
+		},
+	}
+}
+
+// identityFlag selects the age identities encrypted files are decrypted with
+func identityFlag() cli.Flag {
+	return &cli.StringSliceFlag{
+		Name:  "identity",
+		Usage: "age identity file (as written by age-keygen, or an ssh private key) to decrypt with, can be repeated",
+	}
+}
+
+// decryptFlags configure the decrypt command
+func decryptFlags() []cli.Flag {
+	identity := identityFlag().(*cli.StringSliceFlag)
+	identity.Required = true
+	return []cli.Flag{
+		identity,
+		&cli.StringFlag{
+			Name:    "outfile",
+			Aliases: []string{"o"},
+			Usage:   "File to write the decrypted config to instead of stdout",
+		},
+	}
+}
+
+// newEncrypter returns a function encrypting to the --encrypt-to recipients,
+// or nil without any
+func newEncrypter(c *cli.Context) (func([]byte) ([]byte, error), error) {
+	if len(c.StringSlice("encrypt-to")) == 0 {
+		return nil, nil
+	}
+	recipients, err := parseRecipients(c.StringSlice("encrypt-to"))
+	if err != nil {
+		return nil, err
+	}
+	armored := c.Bool("armor")
+	return func(plaintext []byte) ([]byte, error) {
+		return encrypt(plaintext, recipients, armored)
+	}, nil
+}
+
+// parseRecipients parses age and ssh public keys
+func parseRecipients(keys []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		var recipient age.Recipient
+		var err error
+		if strings.HasPrefix(key, "ssh-") {
+			recipient, err = agessh.ParseRecipient(key)
+		} else {
+			recipient, err = age.ParseX25519Recipient(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid --encrypt-to recipient %q: %v", key, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// encrypt encrypts plaintext to the recipients
+func encrypt(plaintext []byte, recipients []age.Recipient, armored bool) ([]byte, error) {
+	var out bytes.Buffer
+	var dst io.Writer = &out
+	var armorWriter io.WriteCloser
+	if armored {
+		armorWriter = armor.NewWriter(&out)
+		dst = armorWriter
+	}
+
+	w, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if armorWriter != nil {
+		if err := armorWriter.Close(); err != nil {
+			return nil, err
+		}
+		out.WriteString("\n")
+	}
+	return out.Bytes(), nil
+}
+
+// isAgeEncrypted reports whether b is an age file, binary or armored
+func isAgeEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("age-encryption.org/")) ||
+		bytes.HasPrefix(bytes.TrimSpace(b), []byte(armor.Header))
+}
+
+// decrypt decrypts an age file, binary or armored, with the identities in
+// the given files
+func decrypt(b []byte, identityFiles []string) ([]byte, error) {
+	if len(identityFiles) == 0 {
+		return nil, errors.New("file is age encrypted, --identity is required")
+	}
+	var identities []age.Identity
+	for _, file := range identityFiles {
+		ids, err := readIdentities(expandHome(file))
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, ids...)
+	}
+
+	var src io.Reader = bytes.NewReader(b)
+	if trimmed := bytes.TrimSpace(b); bytes.HasPrefix(trimmed, []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(trimmed))
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return io.ReadAll(r)
+}
+
+// readIdentities reads an age identity file or an ssh private key
+func readIdentities(file string) ([]age.Identity, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(b, []byte("-----BEGIN")) {
+		identity, err := agessh.ParseIdentity(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity %s: %v", file, err)
+		}
+		return []age.Identity{identity}, nil
+	}
+	identities, err := age.ParseIdentities(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity %s: %v", file, err)
+	}
+	return identities, nil
+}
+
+// readCredentialsFile reads a username and password from key=value lines or
+// JSON, like credential helper output, decrypting age encrypted files
+func readCredentialsFile(file string, identityFiles []string) (string, string, error) {
+	b, err := os.ReadFile(expandHome(file))
+	if err != nil {
+		return "", "", err
+	}
+	if isAgeEncrypted(b) {
+		if b, err = decrypt(b, identityFiles); err != nil {
+			return "", "", fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	username, password, err := parseHelperOutput(b)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %v", file, err)
+	}
+	return username, password, nil
+}
+
+// decryptAction prints an age encrypted config, or writes it to --outfile
+func decryptAction(c *cli.Context) error {
+	var b []byte
+	var err error
+	if c.NArg() > 0 && c.Args().First() != "-" {
+		b, err = os.ReadFile(c.Args().First())
+	} else {
+		b, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	plaintext, err := decrypt(b, c.StringSlice("identity"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	if outfile := c.String("outfile"); outfile != "" {
+		if err := writeFileAtomic(outfile, plaintext, defaultWriteOptions()); err != nil {
+			return cli.Exit(fmt.Sprintf("Error: Failed to write '%s': %v", outfile, err), 1)
+		}
+		return nil
+	}
+	_, err = os.Stdout.Write(plaintext)
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// writeIdentity writes a new age identity file and returns it and its recipient
+func writeIdentity(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(file, []byte("# created: test\n"+identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, identity.Recipient().String()
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	identityFile, recipient := writeIdentity(t, dir)
+	_, otherRecipient := writeIdentity(t, t.TempDir())
+	plaintext := []byte("[Interface]\nPrivateKey = cHJpdmF0ZQ==\n")
+
+	tests := []struct {
+		name       string
+		recipients []string
+		armored    bool
+		err        string
+	}{
+		{name: "binary", recipients: []string{recipient}},
+		{name: "armored", recipients: []string{recipient}, armored: true},
+		{name: "several recipients", recipients: []string{otherRecipient, recipient}},
+		{name: "not a recipient", recipients: []string{otherRecipient}, err: "failed to decrypt: no identity matched any of the recipients"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recipients, err := parseRecipients(tt.recipients)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciphertext, err := encrypt(plaintext, recipients, tt.armored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isAgeEncrypted(ciphertext) {
+				t.Errorf("isAgeEncrypted() = false for %q", ciphertext[:20])
+			}
+			if strings.Contains(string(ciphertext), "PrivateKey") {
+				t.Error("ciphertext contains the plaintext")
+			}
+			if tt.armored && !strings.HasPrefix(string(ciphertext), "-----BEGIN AGE ENCRYPTED FILE-----\n") {
+				t.Errorf("not armored: %q", ciphertext)
+			}
+
+			got, err := decrypt(ciphertext, []string{identityFile})
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(plaintext) {
+				t.Errorf("decrypted %q, want %q", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	tests := []struct {
+		key string
+		err bool
+	}{
+		{key: "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"},
+		{key: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN"},
+		{key: "age1notakey", err: true},
+		{key: "ssh-ed25519 AAAA", err: true},
+	}
+	for _, tt := range tests {
+		if _, err := parseRecipients([]string{tt.key}); (err != nil) != tt.err {
+			t.Errorf("parseRecipients(%q) err = %v, want error %v", tt.key, err, tt.err)
+		}
+	}
+}
+
+func TestReadCredentialsFile(t *testing.T) {
+	dir := t.TempDir()
+	identityFile, recipient := writeIdentity(t, dir)
+	recipients, err := parseRecipients([]string{recipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := encrypt([]byte("username=p1234567\npassword=secret\n"), recipients, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"plain":     []byte("username=p1234567\npassword=secret\n"),
+		"json":      []byte(`{"username": "p1234567", "password": "secret"}`),
+		"encrypted": encrypted,
+	}
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		identities []string
+		err        string
+	}{
+		{name: "plain"},
+		{name: "json"},
+		{name: "encrypted", identities: []string{identityFile}},
+		{name: "encrypted", err: "file is age encrypted, --identity is required"},
+		{name: "missing", err: "no such file or directory"},
+	}
+	for _, tt := range tests {
+		username, password, err := readCredentialsFile(filepath.Join(dir, tt.name), tt.identities)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if username != "p1234567" || password != "secret" {
+			t.Errorf("%s: got %q %q", tt.name, username, password)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// batchFlags select the regions and output of the batch command
+func batchFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     "region",
+			Aliases:  []string{"r"},
+			Required: true,
+			Usage:    "Regions to generate configs for, repeatable or comma separated, 'all' for every region",
+		},
+		&cli.StringFlag{
+			Name:    "outdir",
+			Aliases: []string{"d"},
+			Value:   ".",
+			Usage:   "Directory to write <region>.conf (or .json, plus .age when encrypted) files to",
+		},
+		&cli.IntFlag{
+			Name:  "workers",
+			Value: 4,
+			Usage: "Number of regions to register keys with at the same time",
+		},
+		templateFlag(),
+		verboseFlag(),
+	}
+}
+
+// batchResult is the outcome of generating the config for one region
+type batchResult struct {
+	Region string
+	File   string
+	Err    error
+}
+
+func batchAction(c *cli.Context) error {
+	username, password, err := account(c, "pia-wg-config batch -r REGION[,REGION...] [OPTIONS] USERNAME PASSWORD")
+	if err != nil {
+		return err
+	}
+	verbose := c.Bool("verbose")
+	outdir := c.String("outdir")
+
+	generatorConfig, err := newGeneratorConfig(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	writeOpts, err := newWriteOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	encrypter, err := newEncrypter(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	if err := os.MkdirAll(outdir, 0700); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to create '%s': %v", outdir, err), 1)
+	}
+
+	// one server list download and token for all regions, the client isn't
+	// tied to a region so an unknown region only fails its own config
+	opts, err := clientOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	piaClient, err := pia.NewPIAClient(username, password, "", verbose, opts...)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to connect to PIA servers: %v", err), 1)
+	}
+	regions := c.StringSlice("region")
+	if slices.Contains(regions, "all") {
+		regions = piaClient.Regions()
+	}
+
+	// the token comes from the metadata server of the first known region
+	for _, region := range regions {
+		tokenClient, err := piaClient.ForRegion(region)
+		if err != nil {
+			continue
+		}
+		generatorConfig.Token, err = tokenClient.GetToken()
+		if err != nil {
+			forgetRejectedCredentials(c, username, err)
+			return cli.Exit(fmt.Sprintf("Error: Failed to get PIA token: %v", err), 1)
+		}
+		break
+	}
+
+	results := generateBatch(regions, c.Int("workers"), func(region string) (string, error) {
+		regionClient, err := piaClient.ForRegion(region)
+		if err != nil {
+			return "", err
+		}
+		config, err := pia.NewPIAWgGenerator(regionClient, generatorConfig).Generate()
+		if err != nil {
+			return "", err
+		}
+
+		file := filepath.Join(outdir, region+".conf")
+		if generatorConfig.Format == pia.FormatJSON {
+			file = filepath.Join(outdir, region+".json")
+		}
+		output := []byte(config)
+		if encrypter != nil {
+			if output, err = encrypter(output); err != nil {
+				return "", err
+			}
+			file += ".age"
+		}
+		if err := writeFileAtomic(file, output, writeOpts); err != nil {
+			return "", err
+		}
+		return file, nil
+	})
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("✗ %s: %s\n", result.Region, pia.Redact(result.Err.Error()))
+		} else {
+			fmt.Printf("✓ %s: %s\n", result.Region, result.File)
+		}
+	}
+	fmt.Printf("\n%d of %d configs generated\n", len(results)-failed, len(results))
+
+	if failed > 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+// generateBatch runs generate for every region on a pool of workers. A
+// failing region doesn't stop the others, results are in the order of regions.
+func generateBatch(regions []string, workers int, generate func(region string) (string, error)) []batchResult {
+	results := make([]batchResult, len(regions))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				file, err := generate(regions[i])
+				results[i] = batchResult{Region: regions[i], File: file, Err: err}
+			}
+		}()
+	}
+
+	for i := range regions {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
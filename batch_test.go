@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGenerateBatch(t *testing.T) {
+	var mu sync.Mutex
+	active, peak := 0, 0
+	generate := func(region string) (string, error) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+
+		time.Sleep(5 * time.Millisecond)
+		if region == "de_berlin" {
+			return "", errors.New("status code 500")
+		}
+		return region + ".conf", nil
+	}
+
+	regions := []string{"uk_london", "de_berlin", "us_east", "ca_toronto", "jp_tokyo"}
+	results := generateBatch(regions, 2, generate)
+
+	if len(results) != len(regions) {
+		t.Fatalf("generateBatch() returned %d results, want %d", len(results), len(regions))
+	}
+	for i, result := range results {
+		if result.Region != regions[i] {
+			t.Errorf("result %d region = %v, want %v", i, result.Region, regions[i])
+		}
+		wantErr := regions[i] == "de_berlin"
+		if (result.Err != nil) != wantErr {
+			t.Errorf("result %s error = %v, wantErr %v", result.Region, result.Err, wantErr)
+		}
+		if !wantErr && result.File != regions[i]+".conf" {
+			t.Errorf("result %s file = %v", result.Region, result.File)
+		}
+	}
+	if peak > 2 {
+		t.Errorf("generateBatch() ran %d workers at once, want at most 2", peak)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// checkFlags configure the thresholds and output of the check command
+func checkFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "warning",
+			Value: pia.DefaultCheckThresholds.HandshakeWarning,
+			Usage: "Latest handshake age that is reported as WARNING",
+		},
+		&cli.DurationFlag{
+			Name:  "critical",
+			Value: pia.DefaultCheckThresholds.HandshakeCritical,
+			Usage: "Latest handshake age that is reported as CRITICAL",
+		},
+		&cli.StringFlag{
+			Name:  "exit-ip-url",
+			Usage: "URL returning the public IP as plain text, e.g. https://api.ipify.org, to report the exit IP",
+		},
+		&cli.StringFlag{
+			Name:  "expect-exit-ip",
+			Usage: "The exit IP expected from --exit-ip-url, reported as CRITICAL when it differs",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the result as JSON",
+		},
+	}
+}
+
+// checkAction reports the health of an interface brought up with up or
+// daemon, exiting with the Nagios plugin status codes
+func checkAction(c *cli.Context) error {
+	name := c.String("interface")
+	thresholds := pia.CheckThresholds{
+		HandshakeWarning:  c.Duration("warning"),
+		HandshakeCritical: c.Duration("critical"),
+	}
+
+	var result pia.CheckResult
+	state, err := pia.LoadDeviceState(c.String("state-dir"), name)
+	if err != nil {
+		result = pia.CheckResult{Status: pia.CheckUnknown, Interface: name}
+		result.Messages = []string{fmt.Sprintf("error reading state of %s: %v", name, err)}
+	} else {
+		device, err := pia.NewDevice(name, c.Bool("verbose"))
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("PIA UNKNOWN - %v", err), int(pia.CheckUnknown))
+		}
+		defer device.Close()
+		result = device.Check(state, thresholds)
+
+		if url := c.String("exit-ip-url"); url != "" {
+			// PIA servers often exit through another address than the
+			// endpoint, so the exit IP is only compared when one is given
+			client := &http.Client{Timeout: 10 * time.Second}
+			result.CheckExitIP(c.Context, client, url, c.String("expect-exit-ip"))
+		}
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return cli.Exit(fmt.Sprintf("PIA UNKNOWN - %v", err), int(pia.CheckUnknown))
+		}
+	} else {
+		fmt.Println(checkSummary(result))
+	}
+
+	if result.Status != pia.CheckOK {
+		return cli.Exit("", int(result.Status))
+	}
+	return nil
+}
+
+// checkSummary formats a result as a Nagios plugin status line with perfdata
+func checkSummary(result pia.CheckResult) string {
+	var details []string
+	details = append(details, result.Messages...)
+	if result.LastHandshake != nil {
+		details = append(details, fmt.Sprintf("handshake %v ago", time.Duration(result.HandshakeAge*float64(time.Second)).Round(time.Second)))
+	}
+	if result.Endpoint != "" {
+		details = append(details, "endpoint "+result.Endpoint)
+	}
+	if result.ExitIP != "" {
+		details = append(details, "exit ip "+result.ExitIP)
+	}
+
+	return fmt.Sprintf("PIA %v - %s: %s | handshake_age=%.0fs rx_bytes=%dB tx_bytes=%dB",
+		result.Status, result.Interface, strings.Join(details, ", "),
+		result.HandshakeAge, result.ReceiveBytes, result.TransmitBytes)
+}
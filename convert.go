@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// convertFlags select the formats and output of convert
+func convertFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "from",
+			Value: string(pia.FormatWGQuick),
+			Usage: "Format of the input config, only 'wg-quick' is supported",
+		},
+		&cli.StringFlag{
+			Name:     "to",
+			Required: true,
+			Usage:    "Output format: 'networkd', 'nmconnection', 'uci', 'json' or 'wg-quick'",
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "Interface name for networkd, nmconnection and uci (default: the input file name, or wg0 on stdin)",
+		},
+		&cli.StringFlag{
+			Name:    "outfile",
+			Aliases: []string{"o"},
+			Usage:   "The file to write the converted config to, networkd writes <outfile>.netdev and <outfile>.network",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "Convert even if the PostUp hook disabling IPv6 on the host has to be dropped",
+		},
+	}, fileFlags()...)
+}
+
+// convertAction renders an existing config in another format without
+// registering a new key with PIA
+func convertAction(c *cli.Context) error {
+	if from := c.String("from"); from != string(pia.FormatWGQuick) {
+		return cli.Exit(fmt.Sprintf("Error: Unsupported --from %q, only wg-quick configs can be converted", from), 1)
+	}
+	to, err := pia.ParseConvertFormat(c.String("to"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	// read the config from a file or stdin
+	file := c.Args().First()
+	var in io.Reader = os.Stdin
+	if file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+		defer f.Close()
+		in = f
+	} else {
+		file = "<stdin>"
+	}
+
+	config, err := pia.ParseWGQuick(in)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to parse %s: %v", file, err), 1)
+	}
+	data, err := config.ConfigData()
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to convert %s: %v", file, err), 1)
+	}
+	if config.DropsIPv6Sysctl(to) && !c.Bool("force") {
+		return cli.Exit(fmt.Sprintf("Error: %s can't run the PostUp hook disabling IPv6 on the host, IPv6 is still blocked by the ::/0 route into the tunnel. Use --force to convert without it", to), 1)
+	}
+	if keys := config.UnsupportedKeys(to); len(keys) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %s can't express %s, dropped from %s\n", to, strings.Join(keys, ", "), file)
+	}
+
+	name := c.String("name")
+	if name == "" && file != "<stdin>" {
+		name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	if name == "" {
+		name = pia.DefaultInterfaceName
+	}
+
+	outfile := c.String("outfile")
+	writeOpts, err := newWriteOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	if outfile == "" {
+		text, err := pia.RenderConfig(data, to, name)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: Failed to render %s: %v", to, err), 1)
+		}
+		fmt.Print(withNewline(text))
+		return nil
+	}
+
+	files, err := convertedFiles(data, to, name, outfile)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to render %s: %v", to, err), 1)
+	}
+	for _, f := range files {
+		if err := writeFileAtomic(f.path, []byte(f.text), writeOpts); err != nil {
+			return cli.Exit(fmt.Sprintf("Error: Failed to write '%s': %v", f.path, err), 1)
+		}
+		fmt.Printf("✓ Converted %s to %s: %s\n", file, to, f.path)
+	}
+
+	return nil
+}
+
+type convertedFile struct {
+	path string
+	text string
+}
+
+// convertedFiles renders the files written for outfile, the networkd units
+// are written next to each other
+func convertedFiles(data pia.ConfigData, to pia.Format, name, outfile string) ([]convertedFile, error) {
+	if to != pia.FormatNetworkd {
+		text, err := pia.RenderConfig(data, to, name)
+		if err != nil {
+			return nil, err
+		}
+		return []convertedFile{{path: outfile, text: withNewline(text)}}, nil
+	}
+
+	netdev, network, err := pia.RenderNetworkd(data, name)
+	if err != nil {
+		return nil, err
+	}
+	base := outfile
+	if ext := filepath.Ext(outfile); ext == ".netdev" || ext == ".network" {
+		base = strings.TrimSuffix(outfile, ext)
+	}
+
+	return []convertedFile{
+		{path: base + ".netdev", text: netdev},
+		{path: base + ".network", text: network},
+	}, nil
+}
+
+func withNewline(text string) string {
+	if strings.HasSuffix(text, "\n") {
+		return text
+	}
+	return text + "\n"
+}
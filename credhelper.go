@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// credentialHelperHost identifies the PIA account to credential helpers
+const credentialHelperHost = "www.privateinternetaccess.com"
+
+// credentialFlags select where commands taking USERNAME PASSWORD get them
+// from when they aren't given
+func credentialFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "credential-helper",
+			Usage: "Shell command printing username=/password= lines or JSON, run as '<command> get' and '<command> erase' like git credential helpers",
+		},
+		&cli.DurationFlag{
+			Name:  "credential-helper-timeout",
+			Value: 30 * time.Second,
+			Usage: "How long the credential helper may take, e.g. to prompt for a passphrase",
+		},
+		&cli.StringFlag{
+			Name:  "credentials-file",
+			Usage: "File with username= and password= lines or JSON, may be age encrypted",
+		},
+		identityFlag(),
+	}
+}
+
+// credentialHelper runs an external command for credentials, modeled on git
+// credential helpers: the command is run by the shell with the action, get
+// or erase, appended and is handed the request as key=value lines on stdin.
+// get answers with username= and password= lines, or a JSON object with
+// username and password, on stdout.
+type credentialHelper struct {
+	command string
+	timeout time.Duration
+}
+
+// newCredentialHelper returns the configured helper, or nil
+func newCredentialHelper(c *cli.Context) *credentialHelper {
+	command := c.String("credential-helper")
+	if command == "" {
+		return nil
+	}
+	return &credentialHelper{command: command, timeout: c.Duration("credential-helper-timeout")}
+}
+
+// get asks the helper for the account
+func (h *credentialHelper) get(ctx context.Context) (string, string, error) {
+	out, err := h.run(ctx, "get", "")
+	if err != nil {
+		return "", "", err
+	}
+
+	username, password, err := parseHelperOutput(out)
+	if err != nil {
+		return "", "", fmt.Errorf("credential helper: %v", err)
+	}
+	return username, password, nil
+}
+
+// erase tells the helper the account was rejected
+func (h *credentialHelper) erase(ctx context.Context, username string) error {
+	_, err := h.run(ctx, "erase", username)
+	return err
+}
+
+func (h *credentialHelper) run(ctx context.Context, action, username string) ([]byte, error) {
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	var stdin strings.Builder
+	fmt.Fprintf(&stdin, "protocol=https\nhost=%s\n", credentialHelperHost)
+	if username != "" {
+		fmt.Fprintf(&stdin, "username=%s\n", username)
+	}
+	stdin.WriteString("\n")
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.command+" "+action)
+	cmd.Stdin = strings.NewReader(stdin.String())
+	cmd.Stdout = &stdout
+	// helpers like pass may prompt on the terminal
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("credential helper %s timed out after %v", action, h.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s failed: %v", action, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// parseHelperOutput reads username and password from key=value lines, up to
+// the first blank line, or a JSON object
+func parseHelperOutput(out []byte) (string, string, error) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if trimmed := bytes.TrimSpace(out); bytes.HasPrefix(trimmed, []byte("{")) {
+		if err := json.Unmarshal(trimmed, &creds); err != nil {
+			return "", "", fmt.Errorf("invalid json: %v", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line == "" {
+				break
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "username":
+				creds.Username = value
+			case "password":
+				creds.Password = value
+			}
+		}
+	}
+
+	if creds.Username == "" || creds.Password == "" {
+		return "", "", errors.New("no username and password returned")
+	}
+	return creds.Username, creds.Password, nil
+}
+
+// isAuthFailure reports whether err is PIA rejecting the credentials
+func isAuthFailure(err error) bool {
+	var statusErr *pia.StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized
+}
+
+// helperCredentialsKey marks the context of a command whose account came
+// from the credential helper
+type helperCredentialsKey struct{}
+
+// markHelperCredentials records that the account of c came from the
+// credential helper
+func markHelperCredentials(c *cli.Context) {
+	ctx := c.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	c.Context = context.WithValue(ctx, helperCredentialsKey{}, true)
+}
+
+// forgetRejectedCredentials has the credential helper erase an account PIA
+// rejected, so the next run asks for it again. Accounts from anywhere else,
+// like the arguments, a credentials file, Vault or a profile, didn't come
+// from the helper and are left alone.
+func forgetRejectedCredentials(c *cli.Context, username string, err error) {
+	helper := newCredentialHelper(c)
+	if helper == nil || c.Context == nil || c.Context.Value(helperCredentialsKey{}) == nil || !isAuthFailure(err) {
+		return
+	}
+
+	if eraseErr := helper.erase(c.Context, username); eraseErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", eraseErr)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+)
+
+func TestParseHelperOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		out      string
+		username string
+		password string
+		err      bool
+	}{
+		{name: "key value", out: "username=p1234567\npassword=secret\n", username: "p1234567", password: "secret"},
+		{name: "password with equals", out: "username=p1234567\npassword=a=b\n", username: "p1234567", password: "a=b"},
+		{name: "crlf", out: "username=p1234567\r\npassword=secret\r\n", username: "p1234567", password: "secret"},
+		{name: "stops at blank line", out: "username=p1234567\n\npassword=secret\n", err: true},
+		{name: "json", out: `{"username": "p1234567", "password": "secret"}`, username: "p1234567", password: "secret"},
+		{name: "invalid json", out: `{"username": `, err: true},
+		{name: "no password", out: "username=p1234567\n", err: true},
+		{name: "empty", out: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password, err := parseHelperOutput([]byte(tt.out))
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if username != tt.username || password != tt.password {
+				t.Errorf("got %q %q, want %q %q", username, password, tt.username, tt.password)
+			}
+		})
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "helper")
+	erased := filepath.Join(dir, "erased")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+get) cat >/dev/null; printf 'username=p1234567\npassword=secret\n' ;;
+erase) cat >`+erased+` ;;
+esac
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helper := &credentialHelper{command: script, timeout: 10 * time.Second}
+	username, password, err := helper.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "p1234567" || password != "secret" {
+		t.Errorf("get() = %q %q", username, password)
+	}
+
+	if err := helper.erase(context.Background(), "p1234567"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(erased)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "protocol=https\nhost=" + credentialHelperHost + "\nusername=p1234567\n\n"
+	if string(b) != want {
+		t.Errorf("erase stdin = %q, want %q", b, want)
+	}
+}
+
+func TestForgetRejectedCredentials(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "helper")
+	erased := filepath.Join(dir, "erased")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+get) cat >/dev/null; printf 'username=p1234567\npassword=secret\n' ;;
+erase) cat >`+erased+` ;;
+esac
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(file, []byte("username=p7654321\npassword=other\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rejected := fmt.Errorf("error getting PIA token: %w", &pia.StatusError{StatusCode: http.StatusUnauthorized})
+
+	tests := []struct {
+		name       string
+		args       []string
+		err        error
+		wantErased bool
+	}{
+		{name: "helper", args: []string{"--credential-helper", script}, err: rejected, wantErased: true},
+		{name: "helper with another error", args: []string{"--credential-helper", script}, err: errors.New("timeout")},
+		{name: "credentials file", args: []string{"--credential-helper", script, "--credentials-file", file}, err: rejected},
+		{name: "arguments", args: []string{"--credential-helper", script, "user", "pass"}, err: rejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(erased)
+			app := &cli.App{
+				Name:  "pia-wg-config",
+				Flags: credentialFlags(),
+				Action: func(c *cli.Context) error {
+					username, _, err := credentials(c, nil)
+					if err != nil {
+						return err
+					}
+					forgetRejectedCredentials(c, username, tt.err)
+					return nil
+				},
+			}
+			if err := app.Run(append([]string{"pia-wg-config"}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := os.Stat(erased)
+			if gotErased := err == nil; gotErased != tt.wantErased {
+				t.Errorf("erased = %v, want %v", gotErased, tt.wantErased)
+			}
+		})
+	}
+}
+
+func TestCredentialHelperErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{name: "timeout", command: "exec sleep 5 #", want: "credential helper get timed out after 100ms"},
+		{name: "exit status", command: "exit 3; true", want: "credential helper get failed: exit status 3"},
+		{name: "no credentials", command: "echo username=p1234567; true", want: "credential helper: no username and password returned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helper := &credentialHelper{command: tt.command, timeout: 100 * time.Millisecond}
+			_, _, err := helper.get(context.Background())
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAuthFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unauthorized", err: errors.Wrap(&pia.StatusError{StatusCode: 401}, "getting token"), want: true},
+		{name: "server error", err: &pia.StatusError{StatusCode: 500}},
+		{name: "other error", err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAuthFailure(tt.err); got != tt.want {
+				t.Errorf("isAuthFailure(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
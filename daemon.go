@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/metrics"
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// daemonFlags tune the health checks of the daemon command
+func daemonFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "check-interval",
+			Value: pia.DefaultCheckInterval,
+			Usage: "How often to check the latest handshake",
+		},
+		&cli.DurationFlag{
+			Name:  "handshake-timeout",
+			Value: pia.DefaultHandshakeTimeout,
+			Usage: "Re-key when the latest handshake is older than this",
+		},
+		&cli.DurationFlag{
+			Name:  "rekey-interval",
+			Value: 12 * time.Hour,
+			Usage: "Re-key proactively after this long, before the PIA token expires (0 disables)",
+		},
+		&cli.DurationFlag{
+			Name:  "max-backoff",
+			Value: pia.DefaultMaxBackoff,
+			Usage: "Maximum delay between failed re-key attempts",
+		},
+		&cli.StringFlag{
+			Name:  "health-url",
+			Usage: "URL fetched through the tunnel on every check, a failure triggers a re-key",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "Serve Prometheus metrics on /metrics at this address, e.g. 127.0.0.1:9586",
+		},
+		&cli.BoolFlag{
+			Name:  "port-forward",
+			Usage: "Request a forwarded port from the server and keep it bound",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-up",
+			Usage: "Leave the interface up when the daemon exits",
+		},
+	}
+}
+
+func daemonAction(c *cli.Context) error {
+	username, password, err := account(c, "pia-wg-config daemon [OPTIONS] USERNAME PASSWORD")
+	if err != nil {
+		return err
+	}
+	verbose := c.Bool("verbose")
+	region := c.String("region")
+	name := c.String("interface")
+	stateDir := c.String("state-dir")
+
+	generatorConfig, err := newGeneratorConfig(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	opts, err := clientOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	var collector *metrics.Metrics
+	if addr := c.String("metrics-listen"); addr != "" {
+		collector = metrics.New()
+		opts = append(opts, pia.WithObserver(collector))
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", collector)
+		server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Warning: metrics server failed: %v", err)
+			}
+		}()
+		defer server.Close()
+	}
+
+	piaClient, err := pia.NewPIAClient(username, password, region, verbose, opts...)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to connect to PIA servers: %v", err), 1)
+	}
+	generator := pia.NewPIAWgGenerator(piaClient, generatorConfig)
+	data, err := generator.GenerateData()
+	if err != nil {
+		forgetRejectedCredentials(c, username, err)
+		return cli.Exit(fmt.Sprintf("Error: Failed to generate Wireguard configuration: %v", err), 1)
+	}
+
+	device, err := pia.NewDevice(name, verbose)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	defer device.Close()
+
+	// clean up after a previous run that didn't exit cleanly
+	if state, err := pia.LoadDeviceState(stateDir, name); err == nil {
+		log.Printf("Removing %s left over from a previous run", name)
+		device.Down(state)
+	}
+
+	state, err := device.Up(data)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to bring up %s: %v", name, err), 1)
+	}
+	if err := pia.SaveDeviceState(stateDir, state); err != nil {
+		log.Printf("Warning: failed to record interface state: %v", err)
+	}
+	log.Printf("Interface %s is up (region %s, endpoint %s)", name, region, state.Endpoint)
+
+	daemon := &pia.Daemon{
+		Device:           device,
+		Generator:        generator,
+		State:            state,
+		StateDir:         stateDir,
+		CheckInterval:    c.Duration("check-interval"),
+		HandshakeTimeout: c.Duration("handshake-timeout"),
+		RekeyInterval:    c.Duration("rekey-interval"),
+		MaxBackoff:       c.Duration("max-backoff"),
+		PortForward:      c.Bool("port-forward"),
+		Key:              data.AddKeyResult,
+		Verbose:          verbose,
+	}
+	if collector != nil {
+		daemon.OnCheck = func(stats pia.PeerStats) {
+			collector.ObservePeer(name, stats)
+		}
+		daemon.OnPortForward = func(pf pia.PortForward) {
+			collector.ObservePortForward(name, pf)
+		}
+	}
+	if url := c.String("health-url"); url != "" {
+		daemon.HealthCheck = httpHealthCheck(url)
+	}
+
+	ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	daemon.Run(ctx)
+
+	if c.Bool("keep-up") {
+		log.Printf("Shutting down, leaving %s up", name)
+		return nil
+	}
+
+	log.Printf("Shutting down, removing %s", name)
+	if err := device.Down(daemon.State); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to tear down %s: %v", name, err), 1)
+	}
+	if err := pia.RemoveDeviceState(stateDir, name); err != nil {
+		log.Printf("Warning: failed to remove interface state: %v", err)
+	}
+
+	return nil
+}
+
+// httpHealthCheck probes a URL, expecting a 2xx response
+func httpHealthCheck(url string) func(ctx context.Context) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("status code %v", resp.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// deviceFlags select the interface managed by up and down
+func deviceFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "interface",
+			Aliases: []string{"i"},
+			Value:   "pia0",
+			Usage:   "The wireguard interface to manage",
+		},
+		&cli.StringFlag{
+			Name:  "state-dir",
+			Value: "/run/pia-wg-config",
+			Usage: "Directory recording the state of managed interfaces",
+		},
+	}
+}
+
+func upAction(c *cli.Context) error {
+	username, password, err := account(c, "pia-wg-config up [OPTIONS] USERNAME PASSWORD")
+	if err != nil {
+		return err
+	}
+	verbose := c.Bool("verbose")
+	region := c.String("region")
+	name := c.String("interface")
+
+	generatorConfig, err := newGeneratorConfig(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	// register a key with PIA
+	opts, err := clientOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	piaClient, err := pia.NewPIAClient(username, password, region, verbose, opts...)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to connect to PIA servers: %v", err), 1)
+	}
+	data, err := pia.NewPIAWgGenerator(piaClient, generatorConfig).GenerateData()
+	if err != nil {
+		forgetRejectedCredentials(c, username, err)
+		return cli.Exit(fmt.Sprintf("Error: Failed to generate Wireguard configuration: %v", err), 1)
+	}
+
+	// apply it to the interface
+	device, err := pia.NewDevice(name, verbose)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	defer device.Close()
+
+	state, err := device.Up(data)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to bring up %s: %v", name, err), 1)
+	}
+	if err := pia.SaveDeviceState(c.String("state-dir"), state); err != nil {
+		log.Printf("Warning: failed to record interface state, 'down' won't remove the endpoint route: %v", err)
+	}
+
+	fmt.Printf("✓ Interface %s is up (region %s, endpoint %s)\n", name, region, state.Endpoint)
+	if len(data.Interface.DNS) > 0 {
+		fmt.Printf("DNS servers are not applied automatically, point your resolver at: %s\n", strings.Join(data.Interface.DNS, ", "))
+	}
+	fmt.Printf("You can tear it down using: sudo pia-wg-config down -i %s\n", name)
+
+	return nil
+}
+
+func downAction(c *cli.Context) error {
+	name := c.String("interface")
+	stateDir := c.String("state-dir")
+
+	state, err := pia.LoadDeviceState(stateDir, name)
+	if err != nil && !os.IsNotExist(err) {
+		return cli.Exit(fmt.Sprintf("Error: Failed to read state of %s: %v", name, err), 1)
+	}
+
+	device, err := pia.NewDevice(name, c.Bool("verbose"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	defer device.Close()
+
+	if err := device.Down(state); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to tear down %s: %v", name, err), 1)
+	}
+	if err := pia.RemoveDeviceState(stateDir, name); err != nil {
+		log.Printf("Warning: failed to remove interface state: %v", err)
+	}
+
+	fmt.Printf("✓ Interface %s is down\n", name)
+	return nil
+}
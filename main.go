@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
 
 	"github.com/kylegrantlucas/pia-wg-config/pia"
 	cli "github.com/urfave/cli/v2"
@@ -15,6 +18,7 @@ func main() {
 		Name:   "pia-wg-config",
 		Usage:  "generate a wireguard config for private internet access",
 		Action: defaultAction,
+		Before: configureLogging,
 
 		Commands: []*cli.Command{
 			{
@@ -22,28 +26,98 @@ func main() {
 				Aliases: []string{"r"},
 				Usage:   "List all available PIA regions",
 				Action:  listRegions,
+				Flags:   clientFlags(),
+			},
+			{
+				Name:      "batch",
+				Usage:     "Generate configs for many regions at once, reusing one server list and token",
+				ArgsUsage: "USERNAME PASSWORD",
+				Action:    batchAction,
+				Flags:     flags(batchFlags(), credentialFlags(), clientFlags(), outputFlags(), fileFlags(), generatorFlags()),
+			},
+			{
+				Name:      "validate",
+				Usage:     "Check wg-quick config files for invalid keys, addresses, endpoints and conflicting peers",
+				ArgsUsage: "FILE...",
+				Action:    validateAction,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "strict",
+						Usage: "Fail on warnings, like unknown keys, too",
+					},
+				},
+			},
+			{
+				Name:      "convert",
+				Usage:     "Convert an existing wg-quick config to networkd, NetworkManager, OpenWrt uci or json without registering a new key",
+				ArgsUsage: "[FILE]",
+				Action:    convertAction,
+				Flags:     convertFlags(),
+			},
+			{
+				Name:      "decrypt",
+				Aliases:   []string{"show"},
+				Usage:     "Print a config encrypted with --encrypt-to",
+				ArgsUsage: "[FILE]",
+				Action:    decryptAction,
+				Flags:     decryptFlags(),
+			},
+			{
+				Name:      "refresh",
+				Usage:     "Re-register the key of an existing config and update its PIA fields, keeping your edits",
+				ArgsUsage: "USERNAME PASSWORD",
+				Action:    refreshAction,
+				Flags:     flags(refreshFlags(), credentialFlags(), clientFlags(), ownerFlags()),
+			},
+			{
+				Name:      "up",
+				Usage:     "Generate a config and apply it directly to a wireguard interface (linux, requires root)",
+				ArgsUsage: "USERNAME PASSWORD",
+				Action:    upAction,
+				Flags:     flags(deviceFlags(), []cli.Flag{regionFlag()}, credentialFlags(), clientFlags(), generatorFlags()),
+			},
+			{
+				Name:      "daemon",
+				Usage:     "Bring up an interface and keep it connected, re-keying with PIA when the handshake goes stale",
+				ArgsUsage: "USERNAME PASSWORD",
+				Action:    daemonAction,
+				Flags:     flags(deviceFlags(), []cli.Flag{regionFlag()}, daemonFlags(), credentialFlags(), clientFlags(), generatorFlags()),
+			},
+			{
+				Name:      "serve",
+				Usage:     "Serve an HTTP API that generates configs on demand, keeping the PIA credentials on this host",
+				ArgsUsage: "USERNAME PASSWORD",
+				Action:    serveAction,
+				Flags:     flags(serveFlags(), credentialFlags(), clientFlags()),
+			},
+			{
+				Name:   "check",
+				Usage:  "Check the handshake and connectivity of an interface brought up with up or daemon (not configs written by the default action), exiting with Nagios status codes",
+				Action: checkAction,
+				Flags:  flags(deviceFlags(), checkFlags()),
+			},
+			{
+				Name:   "down",
+				Usage:  "Remove an interface brought up with 'up'",
+				Action: downAction,
+				Flags:  deviceFlags(),
 			},
 		},
 
-		Flags: []cli.Flag{
+		Flags: flags([]cli.Flag{
 			&cli.StringFlag{
 				Name:    "outfile",
 				Aliases: []string{"o"},
 				Usage:   "The file to write the wireguard config to",
 			},
-			&cli.StringFlag{
-				Name:    "region",
-				Aliases: []string{"r"},
-				Value:   "us_california",
-				Usage:   "The private internet access region to connect to (use 'regions' command to list all available regions)",
-			},
+			regionFlag(),
+			templateFlag(),
+			verboseFlag(),
 			&cli.BoolFlag{
-				Name:    "verbose",
-				Aliases: []string{"v"},
-				Value:   false,
-				Usage:   "Print verbose output",
+				Name:  "unsafe-log-secrets",
+				Usage: "Log tokens, passwords and private keys instead of masking them, for debugging only",
 			},
-		},
+		}, configFlags(), credentialFlags(), vaultFlags(), []cli.Flag{vaultWriteFlag()}, clientFlags(), outputFlags(), fileFlags(), generatorFlags()),
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -51,9 +125,180 @@ func main() {
 	}
 }
 
+// configureLogging masks tokens, passwords and private keys in everything
+// logged, unless --unsafe-log-secrets is given
+func configureLogging(c *cli.Context) error {
+	unsafe := c.Bool("unsafe-log-secrets")
+	pia.SetLogSecrets(unsafe)
+	if !unsafe {
+		log.SetOutput(pia.NewRedactingWriter(os.Stderr))
+	}
+	return nil
+}
+
+// flags joins the flag groups of a command
+func flags(groups ...[]cli.Flag) []cli.Flag {
+	var all []cli.Flag
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
+// verboseFlag enables verbose output
+func verboseFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:    "verbose",
+		Aliases: []string{"v"},
+		Usage:   "Print verbose output",
+	}
+}
+
+// templateFlag renders configs with a user supplied template
+func templateFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "template",
+		Aliases: []string{"t"},
+		Usage:   "Render configs with a Go text/template file instead of the built-in wg-quick format",
+	}
+}
+
+// regionFlag selects the PIA region
+func regionFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "region",
+		Aliases: []string{"r"},
+		Value:   "us_california",
+		Usage:   "The private internet access region to connect to (use 'regions' command to list all available regions)",
+	}
+}
+
+// clientFlags configure how requests are sent to PIA
+func clientFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "retries",
+			Value: pia.DefaultRetryPolicy.MaxAttempts - 1,
+			Usage: "How often to retry requests to PIA failing with a network error, 429 or 5xx, 0 disables retries",
+		},
+		&cli.DurationFlag{
+			Name:  "retry-deadline",
+			Value: pia.DefaultRetryPolicy.Deadline,
+			Usage: "Stop retrying a request to PIA once it has taken this long",
+		},
+		&cli.StringFlag{
+			Name:  "proxy",
+			Usage: "Send requests to PIA through this http://, https:// or socks5:// proxy (default: $HTTPS_PROXY)",
+		},
+	}
+}
+
+// clientOptions are the PIAClient options set on the command line
+func clientOptions(c *cli.Context) ([]pia.PIAClientOption, error) {
+	policy := pia.DefaultRetryPolicy
+	policy.MaxAttempts = max(c.Int("retries"), 0) + 1
+	policy.Deadline = c.Duration("retry-deadline")
+	opts := []pia.PIAClientOption{pia.WithRetryPolicy(policy)}
+
+	if proxy := c.String("proxy"); proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --proxy: %v", err)
+		}
+		opts = append(opts, pia.WithProxy(u))
+	}
+	return opts, nil
+}
+
+// outputFlags select what is written out for commands producing config files
+func outputFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Value: string(pia.FormatWGQuick),
+			Usage: "Output format: 'wg-quick' or 'json'",
+		},
+		&cli.IntFlag{
+			Name:  "peers",
+			Value: 1,
+			Usage: "Register the key with this many servers of the region and include the others as failover alternates",
+		},
+	}, encryptFlags()...)
+}
+
+// generatorFlags configure the generated wireguard config
+func generatorFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "allowed-ips",
+			Usage: "Comma separated CIDRs to route through the tunnel (default: 0.0.0.0/0)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-ips",
+			Usage: "Comma separated CIDRs to keep off the tunnel, e.g. 10.0.0.0/8,192.168.0.0/16",
+		},
+		&cli.BoolFlag{
+			Name:  "exclude-rfc1918",
+			Usage: "Keep the private RFC1918 ranges (10/8, 172.16/12, 192.168/16) off the tunnel",
+		},
+		&cli.IntFlag{
+			Name:  "mtu",
+			Usage: "Interface MTU, 0 lets wg-quick choose",
+		},
+		&cli.StringFlag{
+			Name:  "table",
+			Usage: "Routing table for the tunnel routes, 'off' disables route creation",
+		},
+		&cli.StringFlag{
+			Name:  "fwmark",
+			Usage: "Firewall mark for outgoing wireguard packets, decimal or 0x hex",
+		},
+		&cli.IntFlag{
+			Name:  "listen-port",
+			Usage: "Local UDP port to listen on, 0 picks a random port",
+		},
+		&cli.IntFlag{
+			Name:  "keepalive",
+			Value: pia.DefaultPersistentKeepalive,
+			Usage: "Persistent keepalive interval in seconds, 0 disables it",
+		},
+		&cli.StringFlag{
+			Name:  "dns-mode",
+			Value: string(pia.DNSModePIA),
+			Usage: "DNS servers to use: 'pia' (all PIA servers), 'custom' (the --dns list) or 'none'",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "Comma separated DNS servers, implies --dns-mode custom",
+		},
+		&cli.StringFlag{
+			Name:  "killswitch",
+			Usage: "Add PostUp/PreDown firewall rules that block traffic outside the tunnel: 'iptables' or 'nftables'",
+		},
+		&cli.StringSliceFlag{
+			Name:  "killswitch-allow",
+			Usage: "Comma separated CIDRs, e.g. the LAN, the kill-switch lets through",
+		},
+		&cli.StringFlag{
+			Name:  "ipv6",
+			Value: string(pia.IPv6ModeIgnore),
+			Usage: "IPv6 handling: 'block' routes ::/0 into the tunnel so IPv6 can't leak, 'ignore' leaves it alone",
+		},
+		&cli.BoolFlag{
+			Name:  "ipv6-disable-sysctl",
+			Usage: "With --ipv6 block, also disable IPv6 on the host via sysctl while the tunnel is up",
+		},
+	}
+}
+
 func defaultAction(c *cli.Context) error {
-	// Validate arguments
-	if c.NArg() < 2 {
+	// get username and password, from the arguments or a profile
+	prof, err := applyProfile(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	username, password, err := credentials(c, prof)
+	if errors.Is(err, errNoCredentials) {
 		fmt.Println("Error: Username and password are required")
 		fmt.Println()
 		fmt.Println("Usage:")
@@ -63,27 +308,42 @@ func defaultAction(c *cli.Context) error {
 		fmt.Println("  pia-wg-config myuser mypass")
 		fmt.Println("  pia-wg-config -r uk_london myuser mypass")
 		fmt.Println("  pia-wg-config -o config.conf -r de_frankfurt myuser mypass")
+		fmt.Println("  pia-wg-config --profile work")
 		fmt.Println()
 		fmt.Println("To see available regions:")
 		fmt.Println("  pia-wg-config regions")
 		return cli.Exit("", 1)
 	}
 
-	// get username and password
-	username := c.Args().Get(0)
-	password := c.Args().Get(1)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
 	verbose := c.Bool("verbose")
 	region := c.String("region")
 
-	if username == "" || password == "" {
-		return cli.Exit("Error: Username and password cannot be empty", 1)
+	generatorConfig, err := newGeneratorConfig(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	writeOpts, err := newWriteOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	encrypter, err := newEncrypter(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	opts, err := clientOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
 	}
 
 	// create pia client
 	if verbose {
 		log.Printf("Creating PIA client for region: %s", region)
 	}
-	piaClient, err := pia.NewPIAClient(username, password, region, verbose)
+	piaClient, err := pia.NewPIAClient(username, password, region, verbose, opts...)
 	if err != nil {
 		if verbose {
 			log.Printf("Failed to create PIA client: %v", err)
@@ -102,14 +362,15 @@ func defaultAction(c *cli.Context) error {
 	if verbose {
 		log.Print("creating wg config generator")
 	}
-	wgConfigGenerator := pia.NewPIAWgGenerator(piaClient, pia.PIAWgGeneratorConfig{Verbose: verbose})
+	wgConfigGenerator := pia.NewPIAWgGenerator(piaClient, generatorConfig)
 
 	// generate wg config
 	if verbose {
 		log.Print("Generating wireguard config")
 	}
-	config, err := wgConfigGenerator.Generate()
+	data, err := wgConfigGenerator.GenerateData()
 	if err != nil {
+		forgetRejectedCredentials(c, username, err)
 		if verbose {
 			log.Printf("Failed to generate config: %v", err)
 		}
@@ -121,11 +382,43 @@ func defaultAction(c *cli.Context) error {
 		fmt.Printf("\nTry running with -v flag for more details\n")
 		return cli.Exit("", 1)
 	}
+	config, err := wgConfigGenerator.Render(data)
+	var templateErr *pia.TemplateError
+	if errors.As(err, &templateErr) {
+		return cli.Exit(fmt.Sprintf("Error: Failed to render template: %v", templateErr), 1)
+	}
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to generate Wireguard configuration: %v", err), 1)
+	}
+
+	// store the key and config in vault
+	if path := c.String("vault-write-path"); path != "" {
+		vault, err := newVaultClient(c)
+		if err == nil && vault == nil {
+			err = errors.New("--vault-addr is required with --vault-write-path")
+		}
+		if err == nil {
+			err = vault.write(c.Context, path, vaultConfigData(data, config))
+		}
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: Failed to store config in vault: %v", err), 1)
+		}
+		if verbose {
+			log.Printf("Wireguard config written to vault: %s", path)
+		}
+	}
+
+	output := []byte(config)
+	if encrypter != nil {
+		if output, err = encrypter(output); err != nil {
+			return cli.Exit(fmt.Sprintf("Error: Failed to encrypt config: %v", err), 1)
+		}
+	}
 
 	outfile := c.String("outfile")
 	if outfile != "" {
 		// write config to file
-		err = os.WriteFile(outfile, []byte(config), 0600) // More secure permissions
+		err = writeFileAtomic(outfile, output, writeOpts)
 		if err != nil {
 			return cli.Exit(fmt.Sprintf("Error: Failed to write config to file '%s': %v", outfile, err), 1)
 		}
@@ -133,10 +426,16 @@ func defaultAction(c *cli.Context) error {
 			log.Printf("Wireguard config written to: %s", outfile)
 		}
 		fmt.Printf("✓ Wireguard config generated successfully: %s\n", outfile)
-		fmt.Printf("You can now connect using: sudo wg-quick up %s\n", outfile)
+		if generatorConfig.Format == pia.FormatWGQuick && encrypter == nil {
+			fmt.Printf("You can now connect using: sudo wg-quick up %s\n", outfile)
+		}
 	} else {
 		// print config to stdout
-		fmt.Println(config)
+		if encrypter != nil {
+			os.Stdout.Write(output)
+		} else {
+			fmt.Println(config)
+		}
 	}
 
 	return nil
@@ -145,8 +444,12 @@ func defaultAction(c *cli.Context) error {
 func listRegions(c *cli.Context) error {
 	fmt.Println("Fetching available regions from PIA...")
 
-	// Create a dummy client just to get the server list
-	piaClient, err := pia.NewPIAClient("", "", "us_california", false)
+	// A region-less client only downloads the server list
+	opts, err := clientOptions(c)
+	if err != nil {
+		return err
+	}
+	piaClient, err := pia.NewPIAClient("", "", "", false, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to fetch regions: %v", err)
 	}
@@ -174,3 +477,98 @@ func listRegions(c *cli.Context) error {
 
 	return nil
 }
+
+// newGeneratorConfig builds the generator config from the generatorFlags
+func newGeneratorConfig(c *cli.Context) (pia.PIAWgGeneratorConfig, error) {
+	config := pia.PIAWgGeneratorConfig{
+		Verbose:    c.Bool("verbose"),
+		MTU:        c.Int("mtu"),
+		Table:      c.String("table"),
+		ListenPort: c.Int("listen-port"),
+		DNS:        c.StringSlice("dns"),
+	}
+
+	// split tunneling
+	var err error
+	config.AllowedIPs, err = pia.ParsePrefixes(c.StringSlice("allowed-ips"))
+	if err != nil {
+		return config, fmt.Errorf("invalid --allowed-ips: %v", err)
+	}
+	config.ExcludeIPs, err = pia.ParsePrefixes(c.StringSlice("exclude-ips"))
+	if err != nil {
+		return config, fmt.Errorf("invalid --exclude-ips: %v", err)
+	}
+	if c.Bool("exclude-rfc1918") {
+		config.ExcludeIPs = append(config.ExcludeIPs, pia.RFC1918...)
+	}
+
+	// interface tuning
+	if fwmark := c.String("fwmark"); fwmark != "" && fwmark != "off" {
+		mark, err := strconv.ParseUint(fwmark, 0, 32)
+		if err != nil {
+			return config, fmt.Errorf("invalid --fwmark %q", fwmark)
+		}
+		config.FwMark = uint32(mark)
+	}
+	keepalive := c.Int("keepalive")
+	if keepalive < 0 || keepalive > 65535 {
+		return config, fmt.Errorf("invalid --keepalive %d, expected 0 to 65535 seconds", keepalive)
+	}
+	config.PersistentKeepalive = &keepalive
+
+	// dns
+	config.DNSMode, err = pia.ParseDNSMode(c.String("dns-mode"))
+	if err != nil {
+		return config, err
+	}
+	if len(config.DNS) > 0 && !c.IsSet("dns-mode") {
+		config.DNSMode = pia.DNSModeCustom
+	}
+	if config.DNSMode == pia.DNSModeCustom && len(config.DNS) == 0 {
+		return config, fmt.Errorf("--dns-mode custom requires --dns")
+	}
+
+	// kill-switch
+	config.KillSwitch, err = pia.ParseKillSwitch(c.String("killswitch"))
+	if err != nil {
+		return config, err
+	}
+	config.KillSwitchAllowIPs, err = pia.ParsePrefixes(c.StringSlice("killswitch-allow"))
+	if err != nil {
+		return config, fmt.Errorf("invalid --killswitch-allow: %v", err)
+	}
+
+	// ipv6
+	config.IPv6Mode, err = pia.ParseIPv6Mode(c.String("ipv6"))
+	if err != nil {
+		return config, err
+	}
+	config.IPv6Sysctl = c.Bool("ipv6-disable-sysctl")
+	if config.IPv6Sysctl && config.IPv6Mode != pia.IPv6ModeBlock {
+		return config, fmt.Errorf("--ipv6-disable-sysctl requires --ipv6 block")
+	}
+
+	// output
+	config.Format, err = pia.ParseFormat(c.String("format"))
+	if err != nil {
+		return config, err
+	}
+	config.Peers = c.Int("peers")
+
+	// parse the template up front so mistakes don't cost a key registration
+	if templateFile := c.String("template"); templateFile != "" {
+		if config.Format != pia.FormatWGQuick {
+			return config, fmt.Errorf("--template can't be combined with --format %s", config.Format)
+		}
+		text, err := os.ReadFile(templateFile)
+		if err != nil {
+			return config, fmt.Errorf("failed to read template '%s': %v", templateFile, err)
+		}
+		config.Template, err = pia.ParseConfigTemplate(templateFile, string(text))
+		if err != nil {
+			return config, fmt.Errorf("invalid template: %v", err)
+		}
+	}
+
+	return config, nil
+}
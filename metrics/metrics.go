@@ -0,0 +1,233 @@
+// Package metrics exports the activity of long running pia-wg-config modes in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+)
+
+// serverListBuckets are the upper bounds, in seconds, of the server list
+// fetch latency histogram
+var serverListBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects PIA API and wireguard interface metrics. It implements
+// pia.Observer and serves /metrics as an http.Handler.
+type Metrics struct {
+	mu sync.Mutex
+
+	tokenRefreshes  *vec
+	addKeys         *vec
+	lastHandshake   *vec
+	receiveBytes    *vec
+	transmitBytes   *vec
+	forwardedPort   *vec
+	portExpiry      *vec
+	serverListFetch *histogram
+}
+
+var _ pia.Observer = (*Metrics)(nil)
+
+// New returns an empty set of metrics
+func New() *Metrics {
+	return &Metrics{
+		tokenRefreshes: newVec("pia_token_refreshes_total", "counter",
+			"PIA auth tokens requested, by result.", "result"),
+		addKeys: newVec("pia_addkey_requests_total", "counter",
+			"Wireguard keys registered with PIA, by region, result and status.", "region", "result", "status"),
+		lastHandshake: newVec("pia_wireguard_last_handshake_timestamp_seconds", "gauge",
+			"Unix time of the latest handshake with the PIA peer.", "interface"),
+		receiveBytes: newVec("pia_wireguard_receive_bytes_total", "counter",
+			"Bytes received from the PIA peer.", "interface"),
+		transmitBytes: newVec("pia_wireguard_transmit_bytes_total", "counter",
+			"Bytes sent to the PIA peer.", "interface"),
+		forwardedPort: newVec("pia_port_forward_port", "gauge",
+			"Port forwarded to the interface by the PIA server.", "interface"),
+		portExpiry: newVec("pia_port_forward_expiry_timestamp_seconds", "gauge",
+			"Unix time the forwarded port expires at.", "interface"),
+		serverListFetch: newHistogram("pia_server_list_fetch_duration_seconds",
+			"Time taken to download the PIA server list.", serverListBuckets),
+	}
+}
+
+// ServerListFetched implements pia.Observer
+func (m *Metrics) ServerListFetched(duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.serverListFetch.observe(duration.Seconds())
+}
+
+// TokenFetched implements pia.Observer
+func (m *Metrics) TokenFetched(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokenRefreshes.add(1, result(err))
+}
+
+// KeyAdded implements pia.Observer. The status label is the status returned
+// by PIA, the HTTP status code of a failed request, or "error".
+func (m *Metrics) KeyAdded(region string, res pia.AddKeyResult, err error) {
+	status := res.Status
+	var statusErr *pia.StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		status = strconv.Itoa(statusErr.StatusCode)
+	case err != nil:
+		status = "error"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addKeys.add(1, region, result(err), status)
+}
+
+// ObservePeer records the state of the PIA peer on an interface, e.g. from
+// pia.Daemon's OnCheck
+func (m *Metrics) ObservePeer(iface string, stats pia.PeerStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !stats.LastHandshake.IsZero() {
+		m.lastHandshake.set(float64(stats.LastHandshake.UnixNano())/1e9, iface)
+	}
+	m.receiveBytes.set(float64(stats.ReceiveBytes), iface)
+	m.transmitBytes.set(float64(stats.TransmitBytes), iface)
+}
+
+// ObservePortForward records the port forwarded to an interface, e.g. from
+// pia.Daemon's OnPortForward
+func (m *Metrics) ObservePortForward(iface string, pf pia.PortForward) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.forwardedPort.set(float64(pf.Port), iface)
+	m.portExpiry.set(float64(pf.ExpiresAt.UnixNano())/1e9, iface)
+}
+
+// ServeHTTP writes the metrics in the text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	m.tokenRefreshes.write(&b)
+	m.addKeys.write(&b)
+	m.serverListFetch.write(&b)
+	m.lastHandshake.write(&b)
+	m.receiveBytes.write(&b)
+	m.transmitBytes.write(&b)
+	m.forwardedPort.write(&b)
+	m.portExpiry.write(&b)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// vec is a metric family with one sample per set of label values
+type vec struct {
+	name, typ, help string
+	labels          []string
+	samples         map[string]float64
+}
+
+func newVec(name, typ, help string, labels ...string) *vec {
+	return &vec{name: name, typ: typ, help: help, labels: labels, samples: map[string]float64{}}
+}
+
+func (v *vec) add(delta float64, values ...string) {
+	v.samples[formatLabels(v.labels, values)] += delta
+}
+
+func (v *vec) set(value float64, values ...string) {
+	v.samples[formatLabels(v.labels, values)] = value
+}
+
+func (v *vec) write(b *strings.Builder) {
+	writeHeader(b, v.name, v.typ, v.help)
+
+	keys := make([]string, 0, len(v.samples))
+	for k := range v.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s%s %s\n", v.name, k, formatValue(v.samples[k]))
+	}
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	name, help string
+	buckets    []float64
+	counts     []uint64
+	count      uint64
+	sum        float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) write(b *strings.Builder) {
+	writeHeader(b, h.name, "histogram", h.help)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(bound), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(b, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(b, "%s_count %d\n", h.name, h.count)
+}
+
+func writeHeader(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
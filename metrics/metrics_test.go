@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+)
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	m := New()
+	m.ServerListFetched(300*time.Millisecond, nil)
+	m.ServerListFetched(3*time.Second, errors.New("timeout"))
+	m.TokenFetched(nil)
+	m.TokenFetched(nil)
+	m.TokenFetched(errors.New("timeout"))
+	m.KeyAdded("uk_london", pia.AddKeyResult{Status: "OK"}, nil)
+	m.KeyAdded("uk_london", pia.AddKeyResult{}, fmt.Errorf("error executing request: %w", &pia.StatusError{StatusCode: 401}))
+	m.KeyAdded("de_berlin", pia.AddKeyResult{}, errors.New("connection refused"))
+	m.ObservePeer("pia0", pia.PeerStats{
+		LastHandshake: time.Unix(1767225600, 0),
+		ReceiveBytes:  2048,
+		TransmitBytes: 1024,
+	})
+	m.ObservePortForward("pia0", pia.PortForward{Port: 47123, ExpiresAt: time.Unix(1772409600, 0)})
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	want := `# HELP pia_token_refreshes_total PIA auth tokens requested, by result.
+# TYPE pia_token_refreshes_total counter
+pia_token_refreshes_total{result="failure"} 1
+pia_token_refreshes_total{result="success"} 2
+# HELP pia_addkey_requests_total Wireguard keys registered with PIA, by region, result and status.
+# TYPE pia_addkey_requests_total counter
+pia_addkey_requests_total{region="de_berlin",result="failure",status="error"} 1
+pia_addkey_requests_total{region="uk_london",result="failure",status="401"} 1
+pia_addkey_requests_total{region="uk_london",result="success",status="OK"} 1
+# HELP pia_server_list_fetch_duration_seconds Time taken to download the PIA server list.
+# TYPE pia_server_list_fetch_duration_seconds histogram
+pia_server_list_fetch_duration_seconds_bucket{le="0.1"} 0
+pia_server_list_fetch_duration_seconds_bucket{le="0.25"} 0
+pia_server_list_fetch_duration_seconds_bucket{le="0.5"} 1
+pia_server_list_fetch_duration_seconds_bucket{le="1"} 1
+pia_server_list_fetch_duration_seconds_bucket{le="2.5"} 1
+pia_server_list_fetch_duration_seconds_bucket{le="5"} 2
+pia_server_list_fetch_duration_seconds_bucket{le="10"} 2
+pia_server_list_fetch_duration_seconds_bucket{le="+Inf"} 2
+pia_server_list_fetch_duration_seconds_sum 3.3
+pia_server_list_fetch_duration_seconds_count 2
+# HELP pia_wireguard_last_handshake_timestamp_seconds Unix time of the latest handshake with the PIA peer.
+# TYPE pia_wireguard_last_handshake_timestamp_seconds gauge
+pia_wireguard_last_handshake_timestamp_seconds{interface="pia0"} 1.7672256e+09
+# HELP pia_wireguard_receive_bytes_total Bytes received from the PIA peer.
+# TYPE pia_wireguard_receive_bytes_total counter
+pia_wireguard_receive_bytes_total{interface="pia0"} 2048
+# HELP pia_wireguard_transmit_bytes_total Bytes sent to the PIA peer.
+# TYPE pia_wireguard_transmit_bytes_total counter
+pia_wireguard_transmit_bytes_total{interface="pia0"} 1024
+# HELP pia_port_forward_port Port forwarded to the interface by the PIA server.
+# TYPE pia_port_forward_port gauge
+pia_port_forward_port{interface="pia0"} 47123
+# HELP pia_port_forward_expiry_timestamp_seconds Unix time the forwarded port expires at.
+# TYPE pia_port_forward_expiry_timestamp_seconds gauge
+pia_port_forward_expiry_timestamp_seconds{interface="pia0"} 1.7724096e+09
+`
+	if string(body) != want {
+		t.Errorf("ServeHTTP() body =\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	got := formatLabels([]string{"region", "status"}, []string{`a"b`, "c\\d\ne"})
+	want := `{region="a\"b",status="c\\d\ne"}`
+	if got != want {
+		t.Errorf("formatLabels() = %s, want %s", got, want)
+	}
+}
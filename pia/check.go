@@ -0,0 +1,202 @@
+package pia
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// CheckStatus is the outcome of a health check, its values are the
+// Nagios plugin exit codes
+type CheckStatus int
+
+const (
+	CheckOK CheckStatus = iota
+	CheckWarning
+	CheckCritical
+	CheckUnknown
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckOK:
+		return "OK"
+	case CheckWarning:
+		return "WARNING"
+	case CheckCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// MarshalText encodes the status by name in JSON output
+func (s CheckStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CheckThresholds are the handshake ages at which a check turns WARNING and
+// CRITICAL
+type CheckThresholds struct {
+	HandshakeWarning  time.Duration
+	HandshakeCritical time.Duration
+}
+
+// DefaultCheckThresholds allow for the 2 minute wireguard rekey interval
+var DefaultCheckThresholds = CheckThresholds{
+	HandshakeWarning:  3 * time.Minute,
+	HandshakeCritical: 5 * time.Minute,
+}
+
+// CheckResult reports the health of a managed interface
+type CheckResult struct {
+	Status        CheckStatus `json:"status"`
+	Interface     string      `json:"interface"`
+	Region        string      `json:"region,omitempty"`
+	ServerCN      string      `json:"server_cn,omitempty"`
+	PeerKey       string      `json:"peer_public_key"`
+	Endpoint      string      `json:"endpoint,omitempty"`
+	LastHandshake *time.Time  `json:"last_handshake,omitempty"`
+	HandshakeAge  float64     `json:"handshake_age_seconds,omitempty"`
+	ReceiveBytes  int64       `json:"rx_bytes"`
+	TransmitBytes int64       `json:"tx_bytes"`
+	ExitIP        string      `json:"exit_ip,omitempty"`
+	Messages      []string    `json:"messages,omitempty"`
+}
+
+// severity orders statuses, a CRITICAL result stays CRITICAL even if another
+// problem can't be checked
+func (s CheckStatus) severity() int {
+	if s == CheckCritical {
+		return int(CheckUnknown) + 1
+	}
+	return int(s)
+}
+
+// raise records a problem, keeping the most severe status
+func (r *CheckResult) raise(status CheckStatus, format string, args ...any) {
+	if status.severity() > r.Status.severity() {
+		r.Status = status
+	}
+	r.Messages = append(r.Messages, fmt.Sprintf(format, args...))
+}
+
+// CheckPeer checks the PIA peer recorded in state against the current
+// wireguard state of the interface
+func CheckPeer(state DeviceState, device *wgtypes.Device, now time.Time, thresholds CheckThresholds) CheckResult {
+	result := CheckResult{
+		Status:    CheckOK,
+		Interface: state.Interface,
+		Region:    state.Region,
+		ServerCN:  state.ServerCN,
+		PeerKey:   state.PeerKey,
+	}
+
+	var peer *wgtypes.Peer
+	for i := range device.Peers {
+		if device.Peers[i].PublicKey.String() == state.PeerKey {
+			peer = &device.Peers[i]
+		}
+	}
+	if peer == nil {
+		result.raise(CheckCritical, "PIA peer %s is missing from %s", state.PeerKey, state.Interface)
+		return result
+	}
+
+	if peer.Endpoint != nil {
+		result.Endpoint = peer.Endpoint.String()
+		if state.Endpoint != "" && result.Endpoint != state.Endpoint {
+			result.raise(CheckWarning, "endpoint %s differs from the generated %s", result.Endpoint, state.Endpoint)
+		}
+	}
+	result.ReceiveBytes = peer.ReceiveBytes
+	result.TransmitBytes = peer.TransmitBytes
+
+	if peer.LastHandshakeTime.IsZero() {
+		result.raise(CheckCritical, "no handshake with %s", state.PeerKey)
+		return result
+	}
+
+	handshake := peer.LastHandshakeTime
+	age := now.Sub(handshake)
+	result.LastHandshake = &handshake
+	result.HandshakeAge = age.Seconds()
+	switch {
+	case thresholds.HandshakeCritical > 0 && age >= thresholds.HandshakeCritical:
+		result.raise(CheckCritical, "latest handshake was %v ago", age.Round(time.Second))
+	case thresholds.HandshakeWarning > 0 && age >= thresholds.HandshakeWarning:
+		result.raise(CheckWarning, "latest handshake was %v ago", age.Round(time.Second))
+	}
+
+	return result
+}
+
+// Check checks the PIA peer of the interface, see CheckPeer
+func (d *Device) Check(state DeviceState, thresholds CheckThresholds) CheckResult {
+	device, err := d.Stats()
+	if err != nil {
+		result := CheckResult{Status: CheckOK, Interface: d.Name, PeerKey: state.PeerKey}
+		result.raise(CheckCritical, "error reading %s: %v", d.Name, err)
+		return result
+	}
+
+	return CheckPeer(state, device, time.Now(), thresholds)
+}
+
+// CheckExitIP fetches url, which must respond with the public IP address of
+// the caller as plain text, and compares it to the expected exit IP. An empty
+// expected address only records the exit IP.
+func (r *CheckResult) CheckExitIP(ctx context.Context, client *http.Client, url string, expected string) {
+	ip, err := fetchExitIP(ctx, client, url)
+	if err != nil {
+		r.raise(CheckCritical, "error checking exit ip: %v", err)
+		return
+	}
+	r.ExitIP = ip.String()
+
+	if expected == "" {
+		return
+	}
+	want, err := netip.ParseAddr(expected)
+	if err != nil {
+		r.raise(CheckUnknown, "invalid expected exit ip %q", expected)
+		return
+	}
+	if ip != want.Unmap() {
+		r.raise(CheckCritical, "exit ip %v is not the expected %v", ip, want)
+	}
+}
+
+func fetchExitIP(ctx context.Context, client *http.Client, url string) (netip.Addr, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("status code %v", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return netip.Addr{}, errors.Wrap(err, "unexpected response")
+	}
+
+	return ip.Unmap(), nil
+}
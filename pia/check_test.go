@@ -0,0 +1,135 @@
+package pia
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckPeer(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 10, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		handshake  time.Duration
+		endpoint   string
+		peerKey    string
+		wantStatus CheckStatus
+	}{
+		{
+			name:       "recent handshake",
+			handshake:  30 * time.Second,
+			wantStatus: CheckOK,
+		},
+		{
+			name:       "handshake past warning",
+			handshake:  4 * time.Minute,
+			wantStatus: CheckWarning,
+		},
+		{
+			name:       "handshake past critical",
+			handshake:  6 * time.Minute,
+			wantStatus: CheckCritical,
+		},
+		{
+			name:       "no handshake",
+			wantStatus: CheckCritical,
+		},
+		{
+			name:       "endpoint changed",
+			handshake:  30 * time.Second,
+			endpoint:   "5.6.7.8:1337",
+			wantStatus: CheckWarning,
+		},
+		{
+			name:       "peer missing",
+			handshake:  30 * time.Second,
+			peerKey:    "bm90IHRoZSBwZWVyIHlvdSBhcmUgbG9va2luZyBmb3I=",
+			wantStatus: CheckCritical,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, wg, _, _ := testDevice()
+			state, err := d.Up(testConfigData(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.handshake > 0 {
+				wg.handshake = now.Add(-tt.handshake)
+			}
+			if tt.endpoint != "" {
+				state.Endpoint = tt.endpoint
+			}
+			if tt.peerKey != "" {
+				state.PeerKey = tt.peerKey
+			}
+
+			device, err := d.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := CheckPeer(state, device, now, DefaultCheckThresholds)
+			if got.Status != tt.wantStatus {
+				t.Errorf("CheckPeer() status = %v, want %v (%q)", got.Status, tt.wantStatus, got.Messages)
+			}
+			if tt.wantStatus == CheckOK && (got.Endpoint != "1.2.3.4:1337" || got.HandshakeAge != tt.handshake.Seconds()) {
+				t.Errorf("CheckPeer() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestCheckResult_CheckExitIP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "1.2.3.4")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		expected   string
+		wantStatus CheckStatus
+		wantIP     string
+	}{
+		{
+			name:       "matches",
+			url:        server.URL,
+			expected:   "1.2.3.4",
+			wantStatus: CheckOK,
+			wantIP:     "1.2.3.4",
+		},
+		{
+			name:       "record only",
+			url:        server.URL,
+			wantStatus: CheckOK,
+			wantIP:     "1.2.3.4",
+		},
+		{
+			name:       "leaking",
+			url:        server.URL,
+			expected:   "5.6.7.8",
+			wantStatus: CheckCritical,
+			wantIP:     "1.2.3.4",
+		},
+		{
+			name:       "unreachable",
+			url:        server.URL + "/%zz",
+			expected:   "1.2.3.4",
+			wantStatus: CheckCritical,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := CheckResult{Status: CheckOK}
+			result.CheckExitIP(context.Background(), server.Client(), tt.url, tt.expected)
+			if result.Status != tt.wantStatus || result.ExitIP != tt.wantIP {
+				t.Errorf("CheckExitIP() = %v %q, want %v %q (%q)", result.Status, result.ExitIP, tt.wantStatus, tt.wantIP, result.Messages)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package pia
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// DefaultRoutes are the IPv4 and IPv6 default routes
+	DefaultRoutes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+	}
+
+	// RFC1918 are the private IPv4 address ranges
+	RFC1918 = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+)
+
+// ParsePrefixes parses a list of CIDRs, bare addresses are treated as single
+// host prefixes. Host bits are masked off.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix, errors.Wrapf(err, "invalid CIDR %q", s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, errors.Wrapf(err, "invalid address %q", s)
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ExcludePrefixes returns the smallest set of prefixes that covers everything
+// in include but nothing in exclude. The result is sorted.
+func ExcludePrefixes(include, exclude []netip.Prefix) []netip.Prefix {
+	result := normalizePrefixes(include)
+	for _, e := range exclude {
+		e = e.Masked()
+		var next []netip.Prefix
+		for _, p := range result {
+			next = append(next, subtractPrefix(p, e)...)
+		}
+		result = next
+	}
+
+	sortPrefixes(result)
+	return mergePrefixes(result)
+}
+
+// IsDefaultRouteOnly reports whether prefixes only contains default routes
+func IsDefaultRouteOnly(prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Bits() != 0 {
+			return false
+		}
+	}
+
+	return len(prefixes) > 0
+}
+
+// subtractPrefix returns p with e removed from it
+func subtractPrefix(p, e netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(e) {
+		return []netip.Prefix{p}
+	}
+	if e.Bits() <= p.Bits() {
+		// e covers all of p
+		return nil
+	}
+
+	// e lies within p, split p in half and carry on with both halves
+	lower, upper := splitPrefix(p)
+	return append(subtractPrefix(lower, e), subtractPrefix(upper, e)...)
+}
+
+// splitPrefix splits p into its two halves
+func splitPrefix(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := p.Bits()
+	lower := netip.PrefixFrom(p.Addr(), bits+1)
+
+	b := p.Addr().AsSlice()
+	b[bits/8] |= 0x80 >> (bits % 8)
+	addr, _ := netip.AddrFromSlice(b)
+	upper := netip.PrefixFrom(addr, bits+1)
+
+	return lower, upper
+}
+
+// mergePrefixes replaces sibling prefixes of a sorted list without overlaps
+// by their parent, as long as any are left
+func mergePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, p := range prefixes {
+		result = append(result, p)
+		for n := len(result); n >= 2 && result[n-2].Bits() == result[n-1].Bits() && result[n-1].Bits() > 0; n-- {
+			parent := netip.PrefixFrom(result[n-2].Addr(), result[n-2].Bits()-1).Masked()
+			if lower, upper := splitPrefix(parent); lower != result[n-2] || upper != result[n-1] {
+				break
+			}
+			result = append(result[:n-2], parent)
+		}
+	}
+
+	return result
+}
+
+// normalizePrefixes masks prefixes and drops any covered by another prefix
+func normalizePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	masked := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		masked = append(masked, p.Masked())
+	}
+	sort.SliceStable(masked, func(i, j int) bool {
+		return masked[i].Bits() < masked[j].Bits()
+	})
+
+	var result []netip.Prefix
+	for _, p := range masked {
+		covered := false
+		for _, r := range result {
+			if r.Overlaps(p) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, p)
+		}
+	}
+
+	return result
+}
+
+func sortPrefixes(prefixes []netip.Prefix) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	list := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		list = append(list, p.String())
+	}
+
+	return list
+}
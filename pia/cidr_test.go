@@ -0,0 +1,163 @@
+package pia
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func mustParsePrefixes(t *testing.T, list ...string) []netip.Prefix {
+	t.Helper()
+	prefixes, err := ParsePrefixes(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefixes
+}
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "cidrs and addresses",
+			list: []string{"10.0.0.0/8", " 1.2.3.4", "fd00::1", ""},
+			want: []string{"10.0.0.0/8", "1.2.3.4/32", "fd00::1/128"},
+		},
+		{
+			name: "host bits are masked",
+			list: []string{"192.168.1.1/24"},
+			want: []string{"192.168.1.0/24"},
+		},
+		{
+			name:    "invalid",
+			list:    []string{"10.0.0.0/33"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePrefixes(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePrefixes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(prefixStrings(got), tt.want) {
+				t.Errorf("ParsePrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name:    "nothing excluded",
+			include: []string{"0.0.0.0/0"},
+			want:    []string{"0.0.0.0/0"},
+		},
+		{
+			name:    "single host",
+			include: []string{"10.0.0.0/30"},
+			exclude: []string{"10.0.0.2"},
+			want:    []string{"10.0.0.0/31", "10.0.0.3/32"},
+		},
+		{
+			name:    "rfc1918",
+			include: []string{"0.0.0.0/0"},
+			exclude: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
+			want: []string{
+				"0.0.0.0/5", "8.0.0.0/7", "11.0.0.0/8", "12.0.0.0/6", "16.0.0.0/4",
+				"32.0.0.0/3", "64.0.0.0/2", "128.0.0.0/3", "160.0.0.0/5", "168.0.0.0/6",
+				"172.0.0.0/12", "172.32.0.0/11", "172.64.0.0/10", "172.128.0.0/9",
+				"173.0.0.0/8", "174.0.0.0/7", "176.0.0.0/4", "192.0.0.0/9",
+				"192.128.0.0/11", "192.160.0.0/13", "192.169.0.0/16", "192.170.0.0/15",
+				"192.172.0.0/14", "192.176.0.0/12", "192.192.0.0/10", "193.0.0.0/8",
+				"194.0.0.0/7", "196.0.0.0/6", "200.0.0.0/5", "208.0.0.0/4", "224.0.0.0/3",
+			},
+		},
+		{
+			name:    "exclude covers include",
+			include: []string{"10.1.0.0/16"},
+			exclude: []string{"10.0.0.0/8"},
+			want:    nil,
+		},
+		{
+			name:    "families are independent",
+			include: []string{"0.0.0.0/0", "::/0"},
+			exclude: []string{"::/1"},
+			want:    []string{"0.0.0.0/0", "8000::/1"},
+		},
+		{
+			name:    "overlapping includes are merged",
+			include: []string{"10.0.0.0/8", "10.1.0.0/16"},
+			exclude: []string{"10.128.0.0/9"},
+			want:    []string{"10.0.0.0/9"},
+		},
+		{
+			name:    "adjacent siblings are coalesced",
+			include: []string{"10.0.0.2/31", "10.0.0.0/31", "10.0.0.4/30", "10.0.0.9/32"},
+			want:    []string{"10.0.0.0/29", "10.0.0.9/32"},
+		},
+		{
+			name:    "adjacent non-siblings are kept apart",
+			include: []string{"10.0.0.1/32", "10.0.0.2/32"},
+			want:    []string{"10.0.0.1/32", "10.0.0.2/32"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExcludePrefixes(mustParsePrefixes(t, tt.include...), mustParsePrefixes(t, tt.exclude...))
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(prefixStrings(got), tt.want) {
+				t.Errorf("ExcludePrefixes() = %v, want %v", prefixStrings(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestPIAWgGenerator_routedPrefixes(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowedIPs []string
+		excludeIPs []string
+		want       []string
+	}{
+		{
+			name: "default route keeps the endpoint",
+			want: []string{"0.0.0.0/0"},
+		},
+		{
+			name:       "endpoint is excluded from split tunnels",
+			allowedIPs: []string{"1.2.3.4/30"},
+			want:       []string{"1.2.3.5/32", "1.2.3.6/31"},
+		},
+		{
+			name:       "excludes always drop the endpoint",
+			allowedIPs: []string{"1.2.3.0/29"},
+			excludeIPs: []string{"1.2.3.0/31"},
+			want:       []string{"1.2.3.2/31", "1.2.3.5/32", "1.2.3.6/31"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPIAWgGenerator(&PIAClientMock{}, PIAWgGeneratorConfig{
+				AllowedIPs: mustParsePrefixes(t, tt.allowedIPs...),
+				ExcludeIPs: mustParsePrefixes(t, tt.excludeIPs...),
+			})
+			got := prefixStrings(p.routedPrefixes("1.2.3.4"))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PIAWgGenerator.routedPrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
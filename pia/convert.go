@@ -0,0 +1,143 @@
+package pia
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ConfigData converts a parsed wg-quick config into the data model the
+// renderers use, so configs generated earlier or by other tools can be
+// rendered in another format. Region and ServerCN come from the
+// "# pia-wg-config" header when there is one; GeneratedAt is left zero as
+// wg-quick configs don't record it. Options the model has no field for, see
+// UnsupportedKeys, are dropped.
+func (c *WGQuickConfig) ConfigData() (ConfigData, error) {
+	iface := c.Interface()
+	if iface == nil {
+		return ConfigData{}, fmt.Errorf("no [Interface] section")
+	}
+
+	privateKey, err := wgtypes.ParseKey(iface.Get("PrivateKey"))
+	if err != nil {
+		return ConfigData{}, fmt.Errorf("invalid PrivateKey: %v", err)
+	}
+
+	meta := c.Meta()
+	data := ConfigData{
+		AddKeyResult: AddKeyResult{Region: meta["region"], ServerCN: meta["server"]},
+		PrivateKey:   privateKey.String(),
+		PublicKey:    privateKey.PublicKey().String(),
+		Interface: InterfaceConfig{
+			Table:   iface.Get("Table"),
+			PostUp:  iface.Values("PostUp"),
+			PreDown: iface.Values("PreDown"),
+		},
+	}
+	for _, addr := range iface.Values("Address") {
+		data.Interface.Address = append(data.Interface.Address, splitList(addr)...)
+	}
+	for _, dns := range iface.Values("DNS") {
+		data.Interface.DNS = append(data.Interface.DNS, splitList(dns)...)
+	}
+	if len(data.Interface.Address) == 0 {
+		return ConfigData{}, fmt.Errorf("[Interface] has no Address")
+	}
+
+	if data.Interface.MTU, err = optionalInt(iface, "MTU"); err != nil {
+		return ConfigData{}, err
+	}
+	if data.Interface.ListenPort, err = optionalInt(iface, "ListenPort"); err != nil {
+		return ConfigData{}, err
+	}
+	if fwmark := iface.Get("FwMark"); fwmark != "" && fwmark != "off" {
+		mark, err := strconv.ParseUint(fwmark, 0, 32)
+		if err != nil {
+			return ConfigData{}, fmt.Errorf("invalid FwMark %q", fwmark)
+		}
+		data.Interface.FwMark = uint32(mark)
+	}
+
+	for _, section := range c.Peers() {
+		peer := PeerConfig{
+			PublicKey: section.Get("PublicKey"),
+			Endpoint:  section.Get("Endpoint"),
+		}
+		if peer.PublicKey == "" {
+			return ConfigData{}, fmt.Errorf("[Peer] on line %d has no PublicKey", section.Line)
+		}
+		for _, allowed := range section.Values("AllowedIPs") {
+			peer.AllowedIPs = append(peer.AllowedIPs, splitList(allowed)...)
+		}
+		if keepalive := section.Get("PersistentKeepalive"); keepalive != "off" {
+			if peer.PersistentKeepalive, err = optionalInt(section, "PersistentKeepalive"); err != nil {
+				return ConfigData{}, err
+			}
+		}
+		data.Peers = append(data.Peers, peer)
+
+		if data.ServerKey == "" {
+			// the first peer stands in for the addKey response
+			data.ServerKey = peer.PublicKey
+			if host, port, err := net.SplitHostPort(peer.Endpoint); err == nil {
+				data.ServerIP = host
+				data.ServerPort, _ = strconv.Atoi(port)
+			}
+			data.PeerIP, _, _ = strings.Cut(data.Interface.Address[0], "/")
+			data.DNSServers = data.Interface.DNS
+		}
+	}
+
+	return data, nil
+}
+
+// UnsupportedKeys lists the [Interface] keys of a config that are lost when
+// it is converted to format: hooks are shell commands only wg-quick runs,
+// and the data model has no place for PreUp, PostDown or SaveConfig.
+func (c *WGQuickConfig) UnsupportedKeys(format Format) []string {
+	iface := c.Interface()
+	if iface == nil {
+		return nil
+	}
+
+	var keys []string
+	for _, key := range []string{"PreUp", "PostUp", "PreDown", "PostDown", "SaveConfig"} {
+		if !iface.Has(key) {
+			continue
+		}
+		kept := (format == FormatWGQuick || format == FormatJSON) && (key == "PostUp" || key == "PreDown")
+		if !kept {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// DropsIPv6Sysctl reports whether converting to format drops the PostUp hook
+// of IPv6Sysctl that disables IPv6 on the host, which only wg-quick runs
+func (c *WGQuickConfig) DropsIPv6Sysctl(format Format) bool {
+	iface := c.Interface()
+	if iface == nil || !slices.Contains(c.UnsupportedKeys(format), "PostUp") {
+		return false
+	}
+	return slices.Contains(iface.Values("PostUp"), ipv6SysctlUp)
+}
+
+// optionalInt parses the value of key, 0 if the section doesn't set it
+func optionalInt(section *WGQuickSection, key string) (int, error) {
+	value := section.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", key, value)
+	}
+	return n, nil
+}
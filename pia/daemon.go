@@ -0,0 +1,297 @@
+package pia
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Daemon keeps a Device connected. It watches the latest handshake of the
+// PIA peer and re-registers the key with PIA, reconfiguring the interface in
+// place, when the handshake goes stale, a health probe fails or the key is due
+// for renewal. Failed attempts are retried with exponential backoff.
+type Daemon struct {
+	Device    *Device
+	Generator *PIAWgGenerator
+
+	// State is the state of the interface, as returned by Device.Up. It is
+	// kept up to date and saved to StateDir, if set, after every re-key.
+	State    DeviceState
+	StateDir string
+
+	// CheckInterval is how often the handshake is checked. A handshake older
+	// than HandshakeTimeout triggers a re-key, as does a key older than
+	// RekeyInterval when it is set.
+	CheckInterval    time.Duration
+	HandshakeTimeout time.Duration
+	RekeyInterval    time.Duration
+
+	// MaxBackoff caps the delay between failed re-key attempts
+	MaxBackoff time.Duration
+
+	// HealthCheck is an optional probe run on every check, an error triggers
+	// a re-key
+	HealthCheck func(ctx context.Context) error
+
+	// OnCheck, when set, is called with the interface state after every check
+	OnCheck func(stats PeerStats)
+
+	// PortForward requests a forwarded port from the server of Key and keeps
+	// it bound. OnPortForward, when set, is called with the port after every
+	// bind. Key is the addKey result the interface was brought up with and is
+	// kept up to date after every re-key.
+	PortForward   bool
+	Key           AddKeyResult
+	OnPortForward func(pf PortForward)
+
+	Verbose bool
+
+	now      func() time.Time
+	failures int
+	retryAt  time.Time
+	port     PortForward
+	boundAt  time.Time
+}
+
+// PIAWgPortForwardClient is a PIAWgClient that can forward a port through the
+// server a key was registered with, like *PIAClient
+type PIAWgPortForwardClient interface {
+	PIAWgClient
+	GetPortForward(token string, key AddKeyResult) (PortForward, error)
+	BindPort(pf PortForward) error
+}
+
+// PIAWgFailoverClient is a client that can move on to other servers of its
+// region, like *PIAClient. A Daemon re-keying through one refreshes the server
+// list and moves to the next server after a failed attempt, so a server that
+// went away isn't retried forever.
+type PIAWgFailoverClient interface {
+	RefreshServers() error
+	NextServer()
+}
+
+// PeerStats is the state of the PIA peer observed by a Daemon check
+type PeerStats struct {
+	LastHandshake time.Time
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+const (
+	// DefaultHandshakeTimeout is well past the 2 minute rekey interval of the
+	// wireguard protocol, so a handshake this old means the peer is gone
+	DefaultHandshakeTimeout = 3 * time.Minute
+	DefaultCheckInterval    = 30 * time.Second
+	DefaultMaxBackoff       = 5 * time.Minute
+
+	initialBackoff = 5 * time.Second
+
+	// portRenewBefore is how long before it expires a forwarded port is
+	// replaced with a new one
+	portRenewBefore = 24 * time.Hour
+)
+
+// Run checks the interface every CheckInterval until ctx is cancelled
+func (d *Daemon) Run(ctx context.Context) error {
+	if d.now == nil {
+		d.now = time.Now
+	}
+	interval := d.CheckInterval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			d.check(ctx)
+		}
+	}
+}
+
+// check re-keys the interface if needed, unless backing off from a failure,
+// then keeps the forwarded port bound
+func (d *Daemon) check(ctx context.Context) {
+	now := d.now()
+	if now.Before(d.retryAt) {
+		return
+	}
+
+	if reason := d.rekeyReason(ctx, now); reason != "" {
+		logf("Re-keying %s: %s", d.Device.Name, reason)
+		if err := d.rekey(); err != nil {
+			d.failures++
+			backoff := d.backoff()
+			d.retryAt = now.Add(backoff)
+			logf("Re-keying %s failed, retrying in %v: %v", d.Device.Name, backoff, err)
+			d.failover()
+			return
+		}
+
+		d.failures = 0
+		d.retryAt = time.Time{}
+		logf("Re-keyed %s, endpoint %s", d.Device.Name, d.State.Endpoint)
+	}
+
+	if d.PortForward {
+		d.keepPortForward(now)
+	}
+}
+
+// rekeyReason returns why the interface needs a re-key, or "" if it doesn't
+func (d *Daemon) rekeyReason(ctx context.Context, now time.Time) string {
+	timeout := d.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	if d.RekeyInterval > 0 && now.Sub(d.State.GeneratedAt) >= d.RekeyInterval {
+		return fmt.Sprintf("key is older than %v", d.RekeyInterval)
+	}
+
+	device, err := d.Device.Stats()
+	if err != nil {
+		return fmt.Sprintf("error reading interface: %v", err)
+	}
+
+	var stats *PeerStats
+	for _, peer := range device.Peers {
+		if peer.PublicKey.String() == d.State.PeerKey {
+			stats = &PeerStats{
+				LastHandshake: peer.LastHandshakeTime,
+				ReceiveBytes:  peer.ReceiveBytes,
+				TransmitBytes: peer.TransmitBytes,
+			}
+		}
+	}
+	if stats == nil {
+		return "PIA peer is missing from the interface"
+	}
+	if d.OnCheck != nil {
+		d.OnCheck(*stats)
+	}
+
+	if stats.LastHandshake.IsZero() {
+		if now.Sub(d.State.GeneratedAt) > timeout {
+			return fmt.Sprintf("no handshake within %v", timeout)
+		}
+	} else if age := now.Sub(stats.LastHandshake); age > timeout {
+		return fmt.Sprintf("latest handshake was %v ago", age.Round(time.Second))
+	}
+
+	if d.HealthCheck != nil {
+		if err := d.HealthCheck(ctx); err != nil {
+			return fmt.Sprintf("health check failed: %v", err)
+		}
+	}
+
+	if d.Verbose {
+		logf("%s is healthy, latest handshake %v", d.Device.Name, stats.LastHandshake)
+	}
+
+	return ""
+}
+
+// rekey registers a key with PIA again and applies it to the interface
+func (d *Daemon) rekey() error {
+	data, err := d.Generator.GenerateData()
+	if err != nil {
+		return err
+	}
+	data.GeneratedAt = d.now().UTC()
+
+	state, err := d.Device.Reconfigure(d.State, data)
+	d.State = state
+	if err != nil {
+		return err
+	}
+
+	// a port is forwarded by one server to one peer IP, so the new key needs
+	// a new port
+	d.Key = data.AddKeyResult
+	d.port = PortForward{}
+
+	if d.StateDir != "" {
+		if err := SaveDeviceState(d.StateDir, d.State); err != nil {
+			return errors.Wrap(err, "error saving interface state")
+		}
+	}
+
+	return nil
+}
+
+// keepPortForward requests a forwarded port when there is none or it is about
+// to expire, and binds it every PortBindInterval. Failures are logged and
+// retried on the next check.
+func (d *Daemon) keepPortForward(now time.Time) {
+	client, ok := d.Generator.pia.(PIAWgPortForwardClient)
+	if !ok {
+		return
+	}
+
+	if d.port.Port == 0 || !now.Add(portRenewBefore).Before(d.port.ExpiresAt) {
+		token, err := client.GetToken()
+		if err != nil {
+			logf("Requesting a forwarded port failed: %v", err)
+			return
+		}
+		port, err := client.GetPortForward(token, d.Key)
+		if err != nil {
+			logf("Requesting a forwarded port failed: %v", err)
+			return
+		}
+		d.port = port
+		d.boundAt = time.Time{}
+	}
+
+	if !d.boundAt.IsZero() && now.Sub(d.boundAt) < PortBindInterval {
+		return
+	}
+	if err := client.BindPort(d.port); err != nil {
+		logf("Binding forwarded port %d failed: %v", d.port.Port, err)
+		return
+	}
+	if d.boundAt.IsZero() {
+		logf("Forwarding port %d to %s, expires %v", d.port.Port, d.Device.Name, d.port.ExpiresAt)
+	}
+	d.boundAt = now
+
+	if d.OnPortForward != nil {
+		d.OnPortForward(d.port)
+	}
+}
+
+// failover refreshes the server list of the client and moves it to the next
+// server of the region for the following attempt
+func (d *Daemon) failover() {
+	client, ok := d.Generator.pia.(PIAWgFailoverClient)
+	if !ok {
+		return
+	}
+	if err := client.RefreshServers(); err != nil {
+		logf("Refreshing the server list failed: %v", err)
+	}
+	client.NextServer()
+}
+
+// backoff doubles the delay for every consecutive failure, up to MaxBackoff
+func (d *Daemon) backoff() time.Duration {
+	limit := d.MaxBackoff
+	if limit <= 0 {
+		limit = DefaultMaxBackoff
+	}
+
+	backoff := initialBackoff
+	for i := 1; i < d.failures && backoff < limit; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, limit)
+}
@@ -0,0 +1,229 @@
+package pia
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+type failingPIAClient struct{}
+
+func (f *failingPIAClient) GetToken() (string, error) {
+	return "", errors.New("status code 500")
+}
+
+func (f *failingPIAClient) AddKey(token, publickey string) (AddKeyResult, error) {
+	return AddKeyResult{}, errors.New("status code 500")
+}
+
+// failoverPIAClient fails every request and records failovers
+type failoverPIAClient struct {
+	failingPIAClient
+	refreshes int
+	next      int
+}
+
+func (f *failoverPIAClient) RefreshServers() error {
+	f.refreshes++
+	return nil
+}
+
+func (f *failoverPIAClient) NextServer() {
+	f.next++
+}
+
+// portForwardPIAClient hands out ports that expire after expiry and records
+// binds
+type portForwardPIAClient struct {
+	PIAClientMock
+	expiry time.Time
+	ports  int
+	binds  []int
+}
+
+func (p *portForwardPIAClient) GetPortForward(token string, key AddKeyResult) (PortForward, error) {
+	p.ports++
+	return PortForward{Port: 40000 + p.ports, ExpiresAt: p.expiry, ServerCN: key.ServerCN}, nil
+}
+
+func (p *portForwardPIAClient) BindPort(pf PortForward) error {
+	p.binds = append(p.binds, pf.Port)
+	return nil
+}
+
+func testDaemon(t *testing.T, client PIAWgClient) (*Daemon, *fakeWgClient, time.Time) {
+	t.Helper()
+	device, wg, _, _ := testDevice()
+	data := testConfigData(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	data.GeneratedAt = start
+
+	state, err := device.Up(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Daemon{
+		Device:    device,
+		Generator: NewPIAWgGenerator(client, PIAWgGeneratorConfig{}),
+		State:     state,
+	}, wg, start
+}
+
+func TestDaemon_check(t *testing.T) {
+	tests := []struct {
+		name       string
+		elapsed    time.Duration
+		handshake  time.Duration
+		healthErr  error
+		rekeyAfter time.Duration
+		wantRekey  bool
+	}{
+		{
+			name:      "fresh handshake",
+			elapsed:   10 * time.Minute,
+			handshake: 9 * time.Minute,
+		},
+		{
+			name:      "stale handshake",
+			elapsed:   10 * time.Minute,
+			handshake: 5 * time.Minute,
+			wantRekey: true,
+		},
+		{
+			name:    "no handshake yet",
+			elapsed: time.Minute,
+		},
+		{
+			name:      "never handshaked",
+			elapsed:   10 * time.Minute,
+			wantRekey: true,
+		},
+		{
+			name:      "failed health check",
+			elapsed:   10 * time.Minute,
+			handshake: 9 * time.Minute,
+			healthErr: errors.New("timeout"),
+			wantRekey: true,
+		},
+		{
+			name:       "key due for renewal",
+			elapsed:    13 * time.Hour,
+			handshake:  13 * time.Hour,
+			rekeyAfter: 12 * time.Hour,
+			wantRekey:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, wg, start := testDaemon(t, &PIAClientMock{})
+			now := start.Add(tt.elapsed)
+			d.now = func() time.Time { return now }
+			d.RekeyInterval = tt.rekeyAfter
+			if tt.handshake != 0 {
+				wg.handshake = start.Add(tt.handshake)
+			}
+			if tt.healthErr != nil {
+				d.HealthCheck = func(context.Context) error { return tt.healthErr }
+			}
+
+			configured := wg.configured
+			d.check(context.Background())
+
+			if gotRekey := wg.configured > configured; gotRekey != tt.wantRekey {
+				t.Fatalf("Daemon.check() re-keyed = %v, want %v", gotRekey, tt.wantRekey)
+			}
+			if tt.wantRekey && (!d.State.GeneratedAt.Equal(now) || d.State.Endpoint != "1.2.3.4:1337") {
+				t.Errorf("Daemon.check() state = %+v", d.State)
+			}
+		})
+	}
+}
+
+func TestDaemon_check_backoff(t *testing.T) {
+	d, wg, start := testDaemon(t, &failingPIAClient{})
+	now := start.Add(10 * time.Minute)
+	d.now = func() time.Time { return now }
+
+	wantRetries := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second}
+	for _, want := range wantRetries {
+		d.check(context.Background())
+		if got := d.retryAt.Sub(now); got != want {
+			t.Fatalf("Daemon.check() retry in %v, want %v", got, want)
+		}
+
+		// checks are skipped while backing off
+		d.check(context.Background())
+		now = d.retryAt
+	}
+
+	d.MaxBackoff = 30 * time.Second
+	d.failures = 10
+	d.check(context.Background())
+	if got := d.retryAt.Sub(now); got != 30*time.Second {
+		t.Errorf("Daemon.check() retry in %v, want the 30s max", got)
+	}
+	if wg.configured != 1 {
+		t.Errorf("Daemon.check() configured the device %d times, want only by Up", wg.configured)
+	}
+}
+
+func TestDaemon_check_failover(t *testing.T) {
+	client := &failoverPIAClient{}
+	d, _, start := testDaemon(t, client)
+	now := start.Add(10 * time.Minute)
+	d.now = func() time.Time { return now }
+
+	for range 2 {
+		d.check(context.Background())
+		now = d.retryAt
+	}
+	if client.refreshes != 2 || client.next != 2 {
+		t.Errorf("Daemon.check() refreshed %d times and moved servers %d times, want 2 each", client.refreshes, client.next)
+	}
+}
+
+func TestDaemon_check_portForward(t *testing.T) {
+	client := &portForwardPIAClient{}
+	d, wg, start := testDaemon(t, client)
+	client.expiry = start.Add(48 * time.Hour)
+	d.PortForward = true
+	var observed []PortForward
+	d.OnPortForward = func(pf PortForward) { observed = append(observed, pf) }
+
+	steps := []struct {
+		elapsed   time.Duration
+		wantBinds []int
+	}{
+		{elapsed: time.Minute, wantBinds: []int{40001}},
+		{elapsed: 10 * time.Minute, wantBinds: []int{40001}},
+		{elapsed: 16 * time.Minute, wantBinds: []int{40001, 40001}},
+		// close to expiry, a new port is requested
+		{elapsed: 25 * time.Hour, wantBinds: []int{40001, 40001, 40002}},
+	}
+	for _, step := range steps {
+		now := start.Add(step.elapsed)
+		d.now = func() time.Time { return now }
+		wg.handshake = now.Add(-time.Minute)
+
+		d.check(context.Background())
+		if !slices.Equal(client.binds, step.wantBinds) {
+			t.Fatalf("after %v: Daemon.check() bound %v, want %v", step.elapsed, client.binds, step.wantBinds)
+		}
+	}
+	if len(observed) != 3 || observed[2].Port != 40002 {
+		t.Errorf("Daemon.OnPortForward() called with %+v", observed)
+	}
+
+	// a re-key moves to a new server, which forwards a new port
+	now := start.Add(26 * time.Hour)
+	d.now = func() time.Time { return now }
+	wg.handshake = time.Time{}
+	client.expiry = now.Add(48 * time.Hour)
+	d.check(context.Background())
+	if got := client.binds[len(client.binds)-1]; got != 40003 {
+		t.Errorf("Daemon.check() after re-key bound %d, want a new port", got)
+	}
+}
@@ -0,0 +1,547 @@
+package pia
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultMTU is the interface MTU used unless configured, matching wg-quick
+const DefaultMTU = 1420
+
+// mainTable is the kernel's main routing table
+const mainTable = 254
+
+// wgClient is the part of *wgctrl.Client used by Device
+type wgClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
+// linkManager manages links, addresses and routes, see device_linux.go
+type linkManager interface {
+	AddLink(name string, mtu int) error
+	DeleteLink(name string) error
+	SetLinkUp(name string) error
+	AddAddress(name string, addr netip.Prefix) error
+	DeleteAddress(name string, addr netip.Prefix) error
+	AddRoute(name string, dst netip.Prefix, table int) error
+	DeleteRoute(name string, dst netip.Prefix, table int) error
+
+	// AddBypassRoute pins a host route for dst to the route it currently
+	// takes, so it keeps bypassing the tunnel once default routes point at it
+	AddBypassRoute(dst netip.Addr) error
+	DeleteBypassRoute(dst netip.Addr) error
+
+	// MoveBypassRoute pins dst to the route currently pinned for old, and
+	// removes the pin for old
+	MoveBypassRoute(old, dst netip.Addr) error
+}
+
+// Device is a wireguard kernel interface configured without wg-quick
+type Device struct {
+	Name    string
+	Verbose bool
+
+	wg   wgClient
+	link linkManager
+	run  func(command string) error
+}
+
+// DeviceState records how a Device was brought up, so later commands can tear
+// it down or check on it
+type DeviceState struct {
+	Interface   string    `json:"interface"`
+	Region      string    `json:"region,omitempty"`
+	ServerCN    string    `json:"server_cn,omitempty"`
+	PeerKey     string    `json:"peer_public_key"`
+	Endpoint    string    `json:"endpoint"`
+	Address     []string  `json:"address"`
+	BypassRoute string    `json:"bypass_route,omitempty"`
+	Table       int       `json:"table,omitempty"`
+	Routes      []string  `json:"routes,omitempty"`
+	PostUp      []string  `json:"post_up,omitempty"`
+	PreDown     []string  `json:"pre_down,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// NewDevice returns a Device managing the named interface through wgctrl and
+// netlink
+func NewDevice(name string, verbose bool) (*Device, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening wireguard control client")
+	}
+
+	return &Device{
+		Name:    name,
+		Verbose: verbose,
+		wg:      wg,
+		link:    newLinkManager(),
+		run:     runHook,
+	}, nil
+}
+
+// Close releases the wireguard control client
+func (d *Device) Close() error {
+	return d.wg.Close()
+}
+
+// Up creates the interface, configures its key and peers, assigns addresses
+// and routes and runs the PostUp hooks. A partially configured interface is
+// removed again on error.
+func (d *Device) Up(data ConfigData) (state DeviceState, err error) {
+	cfg, err := deviceConfig(data)
+	if err != nil {
+		return state, err
+	}
+	addresses, err := parseAddresses(data.Interface.Address)
+	if err != nil {
+		return state, errors.Wrap(err, "invalid interface address")
+	}
+	table, err := routeTable(data.Interface.Table)
+	if err != nil {
+		return state, err
+	}
+
+	mtu := data.Interface.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+
+	d.logf("Creating wireguard interface %s", d.Name)
+	if err := d.link.AddLink(d.Name, mtu); err != nil {
+		return state, errors.Wrapf(err, "error creating interface %s", d.Name)
+	}
+	defer func() {
+		// like wg-quick, hooks aren't run when bringing the interface up fails
+		if err != nil {
+			d.Down(DeviceState{BypassRoute: state.BypassRoute})
+		}
+	}()
+
+	state = DeviceState{
+		Interface:   d.Name,
+		Region:      data.Region,
+		ServerCN:    data.ServerCN,
+		Address:     data.Interface.Address,
+		Table:       table,
+		PostUp:      data.Interface.PostUp,
+		PreDown:     data.Interface.PreDown,
+		GeneratedAt: data.GeneratedAt,
+	}
+	if len(data.Peers) > 0 {
+		state.PeerKey = data.Peers[0].PublicKey
+		state.Endpoint = data.Peers[0].Endpoint
+	}
+
+	d.logf("Configuring wireguard device %s", d.Name)
+	if err := d.wg.ConfigureDevice(d.Name, cfg); err != nil {
+		return state, errors.Wrap(err, "error configuring wireguard device")
+	}
+	for _, addr := range addresses {
+		if err := d.link.AddAddress(d.Name, addr); err != nil {
+			return state, errors.Wrapf(err, "error adding address %v", addr)
+		}
+	}
+	if err := d.link.SetLinkUp(d.Name); err != nil {
+		return state, errors.Wrap(err, "error setting interface up")
+	}
+
+	if table != 0 {
+		state.BypassRoute, state.Routes, err = d.addRoutes(data.Peers, table)
+		if err != nil {
+			return state, err
+		}
+	}
+
+	if err := d.runHooks("PostUp", data.Interface.PostUp); err != nil {
+		return state, err
+	}
+
+	return state, nil
+}
+
+// Down runs the PreDown hooks and removes the interface, which takes its
+// addresses and routes with it, along with any bypass route
+func (d *Device) Down(state DeviceState) error {
+	var errs []string
+	for _, hook := range state.PreDown {
+		if err := d.run(strings.ReplaceAll(hook, "%i", d.Name)); err != nil {
+			errs = append(errs, fmt.Sprintf("PreDown %q failed: %v", hook, err))
+		}
+	}
+
+	d.logf("Removing wireguard interface %s", d.Name)
+	if err := d.link.DeleteLink(d.Name); err != nil {
+		errs = append(errs, fmt.Sprintf("error removing interface %s: %v", d.Name, err))
+	}
+
+	if state.BypassRoute != "" {
+		if addr, err := netip.ParseAddr(state.BypassRoute); err == nil {
+			if err := d.link.DeleteBypassRoute(addr); err != nil {
+				errs = append(errs, fmt.Sprintf("error removing route to %v: %v", addr, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Stats returns the current wireguard state of the interface, including the
+// latest handshake and transfer counters of its peers
+func (d *Device) Stats() (*wgtypes.Device, error) {
+	return d.wg.Device(d.Name)
+}
+
+// Reconfigure applies new config data to an interface that is already up,
+// replacing its key and peers in place and swapping its addresses, routes and
+// pinned endpoint route. Hooks that changed, like kill-switch rules allowing
+// the old endpoint, are re-applied: the old PreDown hooks run before the
+// device is reconfigured and the new PostUp hooks after.
+func (d *Device) Reconfigure(state DeviceState, data ConfigData) (DeviceState, error) {
+	cfg, err := deviceConfig(data)
+	if err != nil {
+		return state, err
+	}
+	addresses, err := parseAddresses(data.Interface.Address)
+	if err != nil {
+		return state, errors.Wrap(err, "invalid interface address")
+	}
+	oldAddresses, err := parseAddresses(state.Address)
+	if err != nil {
+		return state, errors.Wrap(err, "invalid interface address in state")
+	}
+	oldRoutes, err := ParsePrefixes(state.Routes)
+	if err != nil {
+		return state, errors.Wrap(err, "invalid route in state")
+	}
+
+	hooksChanged := !slices.Equal(state.PostUp, data.Interface.PostUp) || !slices.Equal(state.PreDown, data.Interface.PreDown)
+	if hooksChanged {
+		d.logf("Hooks of %s changed, running PreDown", d.Name)
+		if err := d.runHooks("PreDown", state.PreDown); err != nil {
+			return state, err
+		}
+		state.PostUp, state.PreDown = nil, nil
+	}
+
+	d.logf("Reconfiguring wireguard device %s", d.Name)
+	if err := d.wg.ConfigureDevice(d.Name, cfg); err != nil {
+		return state, errors.Wrap(err, "error configuring wireguard device")
+	}
+
+	for _, addr := range addresses {
+		if !slices.Contains(oldAddresses, addr) {
+			if err := d.link.AddAddress(d.Name, addr); err != nil {
+				return state, errors.Wrapf(err, "error adding address %v", addr)
+			}
+		}
+	}
+	for _, addr := range oldAddresses {
+		if !slices.Contains(addresses, addr) {
+			if err := d.link.DeleteAddress(d.Name, addr); err != nil {
+				return state, errors.Wrapf(err, "error removing address %v", addr)
+			}
+		}
+	}
+	state.Address = data.Interface.Address
+
+	if len(data.Peers) > 0 {
+		state.PeerKey = data.Peers[0].PublicKey
+		state.Endpoint = data.Peers[0].Endpoint
+
+		endpoint, err := netip.ParseAddrPort(state.Endpoint)
+		if state.BypassRoute != "" && err == nil && endpoint.Addr().String() != state.BypassRoute {
+			old, err := netip.ParseAddr(state.BypassRoute)
+			if err != nil {
+				return state, errors.Wrap(err, "invalid bypass route in state")
+			}
+			d.logf("Moving endpoint route from %v to %v", old, endpoint.Addr())
+			if err := d.link.MoveBypassRoute(old, endpoint.Addr()); err != nil {
+				return state, errors.Wrap(err, "error moving endpoint route")
+			}
+			state.BypassRoute = endpoint.Addr().String()
+		}
+	}
+
+	// the allowed ips change with the endpoint when it is excluded from them
+	if state.Table != 0 {
+		routes, _, err := deviceRoutes(data.Peers, state.Table)
+		if err != nil {
+			return state, err
+		}
+		for _, route := range routes {
+			if !slices.Contains(oldRoutes, route) {
+				d.logf("Adding route %v", route)
+				if err := d.link.AddRoute(d.Name, route, state.Table); err != nil {
+					return state, errors.Wrapf(err, "error adding route %v", route)
+				}
+			}
+		}
+		for _, route := range oldRoutes {
+			if !slices.Contains(routes, route) {
+				d.logf("Removing route %v", route)
+				if err := d.link.DeleteRoute(d.Name, route, state.Table); err != nil {
+					return state, errors.Wrapf(err, "error removing route %v", route)
+				}
+			}
+		}
+		state.Routes = prefixStrings(routes)
+	}
+
+	state.Region = data.Region
+	state.ServerCN = data.ServerCN
+	state.GeneratedAt = data.GeneratedAt
+
+	if hooksChanged {
+		if err := d.runHooks("PostUp", data.Interface.PostUp); err != nil {
+			return state, err
+		}
+		state.PostUp, state.PreDown = data.Interface.PostUp, data.Interface.PreDown
+	}
+
+	return state, nil
+}
+
+// addRoutes routes the allowed ips of peers through the interface and pins
+// the endpoint to its current route where a default route needs it. The
+// pinned endpoint address and the added routes are returned.
+func (d *Device) addRoutes(peers []PeerConfig, table int) (string, []string, error) {
+	routes, endpoint, err := deviceRoutes(peers, table)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var bypass string
+	if endpoint.IsValid() {
+		d.logf("Pinning route to endpoint %v", endpoint)
+		if err := d.link.AddBypassRoute(endpoint); err != nil {
+			return bypass, nil, errors.Wrap(err, "error adding endpoint route")
+		}
+		bypass = endpoint.String()
+	}
+
+	var added []string
+	for _, route := range routes {
+		d.logf("Adding route %v", route)
+		if err := d.link.AddRoute(d.Name, route, table); err != nil {
+			return bypass, added, errors.Wrapf(err, "error adding route %v", route)
+		}
+		added = append(added, route.String())
+	}
+
+	return bypass, added, nil
+}
+
+// deviceRoutes returns the routes for the allowed ips of peers. Default
+// routes in the main table are split in half so they take precedence over the
+// existing default route without replacing it, which requires pinning the
+// returned endpoint to its current route.
+func deviceRoutes(peers []PeerConfig, table int) ([]netip.Prefix, netip.Addr, error) {
+	var routes []netip.Prefix
+	var bypass netip.Addr
+	for _, peer := range peers {
+		allowed, err := ParsePrefixes(peer.AllowedIPs)
+		if err != nil {
+			return nil, bypass, err
+		}
+
+		for _, dst := range allowed {
+			if dst.Bits() != 0 || table != mainTable {
+				routes = append(routes, dst)
+				continue
+			}
+			lower, upper := splitPrefix(dst)
+			routes = append(routes, lower, upper)
+
+			endpoint, err := netip.ParseAddrPort(peer.Endpoint)
+			if err == nil && !bypass.IsValid() && endpoint.Addr().Is4() == dst.Addr().Is4() {
+				bypass = endpoint.Addr()
+			}
+		}
+	}
+
+	return routes, bypass, nil
+}
+
+// runHooks runs PostUp or PreDown hooks, stopping at the first failure
+func (d *Device) runHooks(kind string, hooks []string) error {
+	for _, hook := range hooks {
+		if err := d.run(strings.ReplaceAll(hook, "%i", d.Name)); err != nil {
+			return errors.Wrapf(err, "%s %q failed", kind, hook)
+		}
+	}
+	return nil
+}
+
+func (d *Device) logf(format string, args ...any) {
+	if d.Verbose {
+		logf(format, args...)
+	}
+}
+
+// deviceConfig converts config data into a wgctrl device config
+func deviceConfig(data ConfigData) (wgtypes.Config, error) {
+	privateKey, err := wgtypes.ParseKey(data.PrivateKey)
+	if err != nil {
+		return wgtypes.Config{}, errors.Wrap(err, "invalid private key")
+	}
+
+	cfg := wgtypes.Config{
+		PrivateKey:   &privateKey,
+		ReplacePeers: true,
+	}
+	if data.Interface.ListenPort != 0 {
+		cfg.ListenPort = &data.Interface.ListenPort
+	}
+	if data.Interface.FwMark != 0 {
+		mark := int(data.Interface.FwMark)
+		cfg.FirewallMark = &mark
+	}
+
+	for _, peer := range data.Peers {
+		peerCfg, err := devicePeerConfig(peer)
+		if err != nil {
+			return wgtypes.Config{}, err
+		}
+		cfg.Peers = append(cfg.Peers, peerCfg)
+	}
+
+	return cfg, nil
+}
+
+func devicePeerConfig(peer PeerConfig) (wgtypes.PeerConfig, error) {
+	publicKey, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, errors.Wrap(err, "invalid peer public key")
+	}
+	endpoint, err := netip.ParseAddrPort(peer.Endpoint)
+	if err != nil {
+		return wgtypes.PeerConfig{}, errors.Wrap(err, "invalid peer endpoint")
+	}
+	allowed, err := ParsePrefixes(peer.AllowedIPs)
+	if err != nil {
+		return wgtypes.PeerConfig{}, errors.Wrap(err, "invalid peer allowed ips")
+	}
+
+	keepalive := time.Duration(peer.PersistentKeepalive) * time.Second
+	cfg := wgtypes.PeerConfig{
+		PublicKey:                   publicKey,
+		Endpoint:                    net.UDPAddrFromAddrPort(endpoint),
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+	}
+	for _, prefix := range allowed {
+		cfg.AllowedIPs = append(cfg.AllowedIPs, prefixIPNet(prefix))
+	}
+
+	return cfg, nil
+}
+
+// parseAddresses parses interface addresses, which unlike allowed ips keep
+// their host bits
+func parseAddresses(list []string) ([]netip.Prefix, error) {
+	var addresses []netip.Prefix
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		addr, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, addr)
+	}
+
+	return addresses, nil
+}
+
+// routeTable parses a wg-quick Table value, 0 means no routes are added
+func routeTable(table string) (int, error) {
+	switch table {
+	case "", "auto", "main":
+		return mainTable, nil
+	case "off":
+		return 0, nil
+	}
+
+	id, err := strconv.Atoi(table)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid routing table %q", table)
+	}
+
+	return id, nil
+}
+
+func prefixIPNet(p netip.Prefix) net.IPNet {
+	return net.IPNet{
+		IP:   p.Addr().AsSlice(),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
+
+// runHook runs a PostUp/PreDown command with the shell, like wg-quick does
+func runHook(command string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// SaveDeviceState writes the state of an interface to dir
+func SaveDeviceState(dir string, state DeviceState) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(deviceStatePath(dir, state.Interface), b, 0600)
+}
+
+// LoadDeviceState reads the state of an interface from dir
+func LoadDeviceState(dir, name string) (DeviceState, error) {
+	var state DeviceState
+	b, err := os.ReadFile(deviceStatePath(dir, name))
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(b, &state)
+	return state, err
+}
+
+// RemoveDeviceState removes the state of an interface from dir
+func RemoveDeviceState(dir, name string) error {
+	err := os.Remove(deviceStatePath(dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func deviceStatePath(dir, name string) string {
+	return filepath.Join(dir, name+".json")
+}
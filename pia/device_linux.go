@@ -0,0 +1,132 @@
+package pia
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// netlinkManager manages links, addresses and routes with rtnetlink
+type netlinkManager struct{}
+
+func newLinkManager() linkManager {
+	return netlinkManager{}
+}
+
+func (netlinkManager) AddLink(name string, mtu int) error {
+	return netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}})
+}
+
+func (netlinkManager) DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	return netlink.LinkDel(link)
+}
+
+func (netlinkManager) SetLinkUp(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	return netlink.LinkSetUp(link)
+}
+
+func (netlinkManager) AddAddress(name string, addr netip.Prefix) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	ipnet := prefixIPNet(addr)
+	return netlink.AddrAdd(link, &netlink.Addr{IPNet: &ipnet})
+}
+
+func (netlinkManager) DeleteAddress(name string, addr netip.Prefix) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	ipnet := prefixIPNet(addr)
+	return netlink.AddrDel(link, &netlink.Addr{IPNet: &ipnet})
+}
+
+func (netlinkManager) AddRoute(name string, dst netip.Prefix, table int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	ipnet := prefixIPNet(dst)
+	return netlink.RouteAdd(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &ipnet,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     table,
+	})
+}
+
+func (netlinkManager) DeleteRoute(name string, dst netip.Prefix, table int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	ipnet := prefixIPNet(dst)
+	return netlink.RouteDel(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &ipnet,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     table,
+	})
+}
+
+func (netlinkManager) AddBypassRoute(dst netip.Addr) error {
+	routes, err := netlink.RouteGet(net.IP(dst.AsSlice()))
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return errors.Errorf("no route to %v", dst)
+	}
+
+	host := prefixIPNet(netip.PrefixFrom(dst, dst.BitLen()))
+	return netlink.RouteReplace(&netlink.Route{
+		LinkIndex: routes[0].LinkIndex,
+		Dst:       &host,
+		Gw:        routes[0].Gw,
+	})
+}
+
+func (netlinkManager) DeleteBypassRoute(dst netip.Addr) error {
+	host := prefixIPNet(netip.PrefixFrom(dst, dst.BitLen()))
+	return netlink.RouteDel(&netlink.Route{Dst: &host})
+}
+
+func (netlinkManager) MoveBypassRoute(old, dst netip.Addr) error {
+	routes, err := netlink.RouteGet(net.IP(old.AsSlice()))
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return errors.Errorf("no route to %v", old)
+	}
+
+	host := prefixIPNet(netip.PrefixFrom(dst, dst.BitLen()))
+	err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: routes[0].LinkIndex,
+		Dst:       &host,
+		Gw:        routes[0].Gw,
+	})
+	if err != nil {
+		return err
+	}
+
+	return netlinkManager{}.DeleteBypassRoute(old)
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package pia
+
+import (
+	"net/netip"
+
+	"github.com/pkg/errors"
+)
+
+var errLinkUnsupported = errors.New("managing wireguard interfaces is only supported on linux, use wg-quick instead")
+
+// unsupportedLinkManager is used where there is no netlink
+type unsupportedLinkManager struct{}
+
+func newLinkManager() linkManager {
+	return unsupportedLinkManager{}
+}
+
+func (unsupportedLinkManager) AddLink(string, int) error                { return errLinkUnsupported }
+func (unsupportedLinkManager) DeleteLink(string) error                  { return errLinkUnsupported }
+func (unsupportedLinkManager) SetLinkUp(string) error                   { return errLinkUnsupported }
+func (unsupportedLinkManager) AddAddress(string, netip.Prefix) error    { return errLinkUnsupported }
+func (unsupportedLinkManager) DeleteAddress(string, netip.Prefix) error { return errLinkUnsupported }
+func (unsupportedLinkManager) AddRoute(string, netip.Prefix, int) error { return errLinkUnsupported }
+func (unsupportedLinkManager) DeleteRoute(string, netip.Prefix, int) error {
+	return errLinkUnsupported
+}
+func (unsupportedLinkManager) AddBypassRoute(netip.Addr) error    { return errLinkUnsupported }
+func (unsupportedLinkManager) DeleteBypassRoute(netip.Addr) error { return errLinkUnsupported }
+func (unsupportedLinkManager) MoveBypassRoute(netip.Addr, netip.Addr) error {
+	return errLinkUnsupported
+}
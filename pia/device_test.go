@@ -0,0 +1,376 @@
+package pia
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeWgClient records device configs instead of talking to the kernel
+type fakeWgClient struct {
+	configs    map[string]wgtypes.Config
+	configured int
+	handshake  time.Time
+}
+
+func (f *fakeWgClient) Device(name string) (*wgtypes.Device, error) {
+	cfg, ok := f.configs[name]
+	if !ok {
+		return nil, fmt.Errorf("no device %s", name)
+	}
+
+	device := &wgtypes.Device{Name: name, PrivateKey: *cfg.PrivateKey}
+	for _, peer := range cfg.Peers {
+		device.Peers = append(device.Peers, wgtypes.Peer{
+			PublicKey:         peer.PublicKey,
+			Endpoint:          peer.Endpoint,
+			AllowedIPs:        peer.AllowedIPs,
+			LastHandshakeTime: f.handshake,
+		})
+	}
+	return device, nil
+}
+
+func (f *fakeWgClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	if f.configs == nil {
+		f.configs = map[string]wgtypes.Config{}
+	}
+	f.configs[name] = cfg
+	f.configured++
+	return nil
+}
+
+func (f *fakeWgClient) Close() error {
+	return nil
+}
+
+// fakeLinkManager records link operations
+type fakeLinkManager struct {
+	calls   []string
+	failOn  string
+	failErr error
+}
+
+func (f *fakeLinkManager) record(call string) error {
+	f.calls = append(f.calls, call)
+	if call == f.failOn {
+		return f.failErr
+	}
+	return nil
+}
+
+func (f *fakeLinkManager) AddLink(name string, mtu int) error {
+	return f.record(fmt.Sprintf("link add %s mtu %d", name, mtu))
+}
+
+func (f *fakeLinkManager) DeleteLink(name string) error {
+	return f.record("link del " + name)
+}
+
+func (f *fakeLinkManager) SetLinkUp(name string) error {
+	return f.record("link up " + name)
+}
+
+func (f *fakeLinkManager) AddAddress(name string, addr netip.Prefix) error {
+	return f.record(fmt.Sprintf("addr add %v dev %s", addr, name))
+}
+
+func (f *fakeLinkManager) DeleteAddress(name string, addr netip.Prefix) error {
+	return f.record(fmt.Sprintf("addr del %v dev %s", addr, name))
+}
+
+func (f *fakeLinkManager) AddRoute(name string, dst netip.Prefix, table int) error {
+	return f.record(fmt.Sprintf("route add %v dev %s table %d", dst, name, table))
+}
+
+func (f *fakeLinkManager) DeleteRoute(name string, dst netip.Prefix, table int) error {
+	return f.record(fmt.Sprintf("route del %v dev %s table %d", dst, name, table))
+}
+
+func (f *fakeLinkManager) AddBypassRoute(dst netip.Addr) error {
+	return f.record(fmt.Sprintf("route pin %v", dst))
+}
+
+func (f *fakeLinkManager) DeleteBypassRoute(dst netip.Addr) error {
+	return f.record(fmt.Sprintf("route unpin %v", dst))
+}
+
+func (f *fakeLinkManager) MoveBypassRoute(old, dst netip.Addr) error {
+	return f.record(fmt.Sprintf("route move %v %v", old, dst))
+}
+
+func testDevice() (*Device, *fakeWgClient, *fakeLinkManager, *[]string) {
+	wg := &fakeWgClient{}
+	link := &fakeLinkManager{}
+	hooks := &[]string{}
+	return &Device{
+		Name: "pia0",
+		wg:   wg,
+		link: link,
+		run: func(command string) error {
+			*hooks = append(*hooks, command)
+			return nil
+		},
+	}, wg, link, hooks
+}
+
+func testConfigData(t *testing.T) ConfigData {
+	t.Helper()
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ConfigData{
+		AddKeyResult: AddKeyResult{Region: "uk_london", ServerCN: "london401"},
+		PrivateKey:   privateKey.String(),
+		PublicKey:    privateKey.PublicKey().String(),
+		Interface: InterfaceConfig{
+			Address: []string{"10.1.2.3"},
+			PostUp:  []string{"iptables -A OUTPUT -o %i -j ACCEPT"},
+			PreDown: []string{"iptables -D OUTPUT -o %i -j ACCEPT"},
+		},
+		Peers: []PeerConfig{{
+			PublicKey:           serverKey.PublicKey().String(),
+			Endpoint:            "1.2.3.4:1337",
+			AllowedIPs:          []string{"0.0.0.0/0"},
+			PersistentKeepalive: 25,
+		}},
+	}
+}
+
+func TestDevice_Up(t *testing.T) {
+	d, wg, link, hooks := testDevice()
+	data := testConfigData(t)
+
+	state, err := d.Up(data)
+	if err != nil {
+		t.Fatalf("Device.Up() error = %v", err)
+	}
+
+	wantCalls := []string{
+		"link add pia0 mtu 1420",
+		"addr add 10.1.2.3/32 dev pia0",
+		"link up pia0",
+		"route pin 1.2.3.4",
+		"route add 0.0.0.0/1 dev pia0 table 254",
+		"route add 128.0.0.0/1 dev pia0 table 254",
+	}
+	if !reflect.DeepEqual(link.calls, wantCalls) {
+		t.Errorf("Device.Up() link calls = %q, want %q", link.calls, wantCalls)
+	}
+	if want := []string{"iptables -A OUTPUT -o pia0 -j ACCEPT"}; !reflect.DeepEqual(*hooks, want) {
+		t.Errorf("Device.Up() hooks = %q, want %q", *hooks, want)
+	}
+
+	device, err := wg.Device("pia0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.PrivateKey.String() != data.PrivateKey {
+		t.Errorf("Device.Up() private key = %v, want %v", device.PrivateKey, data.PrivateKey)
+	}
+	if len(device.Peers) != 1 || device.Peers[0].Endpoint.String() != "1.2.3.4:1337" || device.Peers[0].AllowedIPs[0].String() != "0.0.0.0/0" {
+		t.Errorf("Device.Up() peers = %+v", device.Peers)
+	}
+
+	wantState := DeviceState{
+		Interface:   "pia0",
+		Region:      "uk_london",
+		ServerCN:    "london401",
+		PeerKey:     data.Peers[0].PublicKey,
+		Endpoint:    "1.2.3.4:1337",
+		Address:     []string{"10.1.2.3"},
+		BypassRoute: "1.2.3.4",
+		Table:       mainTable,
+		Routes:      []string{"0.0.0.0/1", "128.0.0.0/1"},
+		PostUp:      data.Interface.PostUp,
+		PreDown:     data.Interface.PreDown,
+	}
+	if !reflect.DeepEqual(state, wantState) {
+		t.Errorf("Device.Up() state = %+v, want %+v", state, wantState)
+	}
+}
+
+func TestDevice_Up_table(t *testing.T) {
+	tests := []struct {
+		name       string
+		table      string
+		allowedIPs []string
+		wantRoutes []string
+	}{
+		{
+			name:       "off",
+			table:      "off",
+			allowedIPs: []string{"0.0.0.0/0"},
+		},
+		{
+			name:       "custom table keeps default route",
+			table:      "51820",
+			allowedIPs: []string{"0.0.0.0/0"},
+			wantRoutes: []string{"route add 0.0.0.0/0 dev pia0 table 51820"},
+		},
+		{
+			name:       "split tunnel",
+			allowedIPs: []string{"10.0.0.0/8", "::/0"},
+			wantRoutes: []string{
+				"route add 10.0.0.0/8 dev pia0 table 254",
+				"route add ::/1 dev pia0 table 254",
+				"route add 8000::/1 dev pia0 table 254",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _, link, _ := testDevice()
+			data := testConfigData(t)
+			data.Interface.Table = tt.table
+			data.Peers[0].AllowedIPs = tt.allowedIPs
+
+			if _, err := d.Up(data); err != nil {
+				t.Fatalf("Device.Up() error = %v", err)
+			}
+			if got := link.calls[3:]; fmt.Sprint(got) != fmt.Sprint(tt.wantRoutes) {
+				t.Errorf("Device.Up() routes = %q, want %q", got, tt.wantRoutes)
+			}
+		})
+	}
+}
+
+func TestDevice_Up_rollback(t *testing.T) {
+	d, _, link, hooks := testDevice()
+	link.failOn = "route add 0.0.0.0/1 dev pia0 table 254"
+	link.failErr = errors.New("boom")
+
+	if _, err := d.Up(testConfigData(t)); err == nil {
+		t.Fatal("Device.Up() error = nil, want error")
+	}
+
+	wantTail := []string{"link del pia0", "route unpin 1.2.3.4"}
+	if got := link.calls[len(link.calls)-2:]; !reflect.DeepEqual(got, wantTail) {
+		t.Errorf("Device.Up() rollback calls = %q, want %q", got, wantTail)
+	}
+	if len(*hooks) != 0 {
+		t.Errorf("Device.Up() ran hooks %q on failure", *hooks)
+	}
+}
+
+func TestDevice_Reconfigure(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoint  string
+		wantCalls []string
+		wantHooks []string
+	}{
+		{
+			name:     "same server",
+			endpoint: "1.2.3.4:1337",
+		},
+		{
+			name:     "new server",
+			endpoint: "5.6.7.8:1337",
+			wantCalls: []string{
+				"route move 1.2.3.4 5.6.7.8",
+				"route add 5.6.7.9/32 dev pia0 table 254",
+				"route del 1.2.3.5/32 dev pia0 table 254",
+			},
+			wantHooks: []string{
+				"iptables -D pia-killswitch -d 1.2.3.4/32 -j RETURN",
+				"iptables -A pia-killswitch -d 5.6.7.8/32 -j RETURN",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _, link, hooks := testDevice()
+
+			// a split tunnel routing a neighbour of the endpoint, with a
+			// kill-switch allowing the endpoint
+			config := func(endpoint string) ConfigData {
+				data := testConfigData(t)
+				ip := netip.MustParseAddrPort(endpoint).Addr()
+				data.Interface.PostUp = []string{"iptables -A pia-killswitch -d " + ip.String() + "/32 -j RETURN"}
+				data.Interface.PreDown = []string{"iptables -D pia-killswitch -d " + ip.String() + "/32 -j RETURN"}
+				data.Peers[0].Endpoint = endpoint
+				data.Peers[0].AllowedIPs = []string{"0.0.0.0/0", ip.Next().String() + "/32"}
+				return data
+			}
+			state, err := d.Up(config("1.2.3.4:1337"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			link.calls, *hooks = nil, nil
+
+			data := config(tt.endpoint)
+			state, err = d.Reconfigure(state, data)
+			if err != nil {
+				t.Fatalf("Device.Reconfigure() error = %v", err)
+			}
+
+			if fmt.Sprint(link.calls) != fmt.Sprint(tt.wantCalls) {
+				t.Errorf("Device.Reconfigure() link calls = %q, want %q", link.calls, tt.wantCalls)
+			}
+			if fmt.Sprint(*hooks) != fmt.Sprint(tt.wantHooks) {
+				t.Errorf("Device.Reconfigure() hooks = %q, want %q", *hooks, tt.wantHooks)
+			}
+			if !reflect.DeepEqual(state.PostUp, data.Interface.PostUp) || !reflect.DeepEqual(state.PreDown, data.Interface.PreDown) {
+				t.Errorf("Device.Reconfigure() state hooks = %q, %q", state.PostUp, state.PreDown)
+			}
+			wantRoutes, _, _ := deviceRoutes(data.Peers, mainTable)
+			if !reflect.DeepEqual(state.Routes, prefixStrings(wantRoutes)) {
+				t.Errorf("Device.Reconfigure() state routes = %q, want %q", state.Routes, wantRoutes)
+			}
+		})
+	}
+}
+
+func TestDevice_Down(t *testing.T) {
+	d, _, link, hooks := testDevice()
+	err := d.Down(DeviceState{
+		Interface:   "pia0",
+		BypassRoute: "1.2.3.4",
+		PreDown:     []string{"nft delete table inet %i"},
+	})
+	if err != nil {
+		t.Fatalf("Device.Down() error = %v", err)
+	}
+
+	if want := []string{"link del pia0", "route unpin 1.2.3.4"}; !reflect.DeepEqual(link.calls, want) {
+		t.Errorf("Device.Down() link calls = %q, want %q", link.calls, want)
+	}
+	if want := []string{"nft delete table inet pia0"}; !reflect.DeepEqual(*hooks, want) {
+		t.Errorf("Device.Down() hooks = %q, want %q", *hooks, want)
+	}
+}
+
+func TestDeviceState_saveLoad(t *testing.T) {
+	dir := t.TempDir()
+	state := DeviceState{Interface: "pia0", PeerKey: "key", Endpoint: "1.2.3.4:1337", Address: []string{"10.1.2.3"}}
+
+	if err := SaveDeviceState(dir, state); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadDeviceState(dir, "pia0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Errorf("LoadDeviceState() = %+v, want %+v", got, state)
+	}
+
+	if err := RemoveDeviceState(dir, "pia0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDeviceState(dir, "pia0"); err == nil {
+		t.Error("LoadDeviceState() after RemoveDeviceState() error = nil")
+	}
+}
@@ -0,0 +1,96 @@
+package pia
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JSONConfig is the structured form of a config rendered with FormatJSON.
+// Peers lists the config's own peer first, followed by any alternates. Every
+// server assigns its own address, so each peer carries the Address and DNS to
+// use with it.
+type JSONConfig struct {
+	Region      string        `json:"region,omitempty"`
+	PrivateKey  string        `json:"private_key"`
+	PublicKey   string        `json:"public_key"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Interface   JSONInterface `json:"interface"`
+	Peers       []JSONPeer    `json:"peers"`
+}
+
+// JSONInterface holds the interface options of a JSONConfig
+type JSONInterface struct {
+	Address    []string `json:"address"`
+	DNS        []string `json:"dns,omitempty"`
+	MTU        int      `json:"mtu,omitempty"`
+	Table      string   `json:"table,omitempty"`
+	FwMark     uint32   `json:"fwmark,omitempty"`
+	ListenPort int      `json:"listen_port,omitempty"`
+	PostUp     []string `json:"post_up,omitempty"`
+	PreDown    []string `json:"pre_down,omitempty"`
+}
+
+// JSONPeer is a server the key was registered with
+type JSONPeer struct {
+	ServerCN            string   `json:"server_cn,omitempty"`
+	Address             []string `json:"address"`
+	DNS                 []string `json:"dns,omitempty"`
+	PublicKey           string   `json:"public_key"`
+	Endpoint            string   `json:"endpoint"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+}
+
+// NewJSONConfig converts config data into its structured form
+func NewJSONConfig(data ConfigData) JSONConfig {
+	iface := data.Interface
+	config := JSONConfig{
+		Region:      data.Region,
+		PrivateKey:  data.PrivateKey,
+		PublicKey:   data.PublicKey,
+		GeneratedAt: data.GeneratedAt,
+		Interface: JSONInterface{
+			Address:    iface.Address,
+			DNS:        iface.DNS,
+			MTU:        iface.MTU,
+			Table:      iface.Table,
+			FwMark:     iface.FwMark,
+			ListenPort: iface.ListenPort,
+			PostUp:     iface.PostUp,
+			PreDown:    iface.PreDown,
+		},
+	}
+
+	for _, peer := range data.Peers {
+		config.Peers = append(config.Peers, jsonPeer(data.ServerCN, iface.Address, iface.DNS, peer))
+	}
+	for _, alt := range data.Alternates {
+		config.Peers = append(config.Peers, jsonPeer(alt.ServerCN, alt.Address, alt.DNS, alt.Peer))
+	}
+
+	return config
+}
+
+func jsonPeer(serverCN string, address, dns []string, peer PeerConfig) JSONPeer {
+	return JSONPeer{
+		ServerCN:            serverCN,
+		Address:             address,
+		DNS:                 dns,
+		PublicKey:           peer.PublicKey,
+		Endpoint:            peer.Endpoint,
+		AllowedIPs:          peer.AllowedIPs,
+		PersistentKeepalive: peer.PersistentKeepalive,
+	}
+}
+
+// RenderJSON renders config data as an indented JSONConfig
+func RenderJSON(data ConfigData) (string, error) {
+	b, err := json.MarshalIndent(NewJSONConfig(data), "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding config as json")
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,129 @@
+package pia
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// KillSwitch is the firewall backend used for kill-switch rules
+type KillSwitch string
+
+const (
+	KillSwitchIptables KillSwitch = "iptables"
+	KillSwitchNftables KillSwitch = "nftables"
+)
+
+// killSwitchName is the iptables chain and nftables table holding the rules
+const killSwitchName = "pia-killswitch"
+
+// ParseKillSwitch parses a kill-switch backend, an empty string disables it
+func ParseKillSwitch(s string) (KillSwitch, error) {
+	switch backend := KillSwitch(s); backend {
+	case "", KillSwitchIptables, KillSwitchNftables:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unknown kill-switch backend %q, expected iptables or nftables", s)
+	}
+}
+
+// KillSwitchOptions describes the traffic a kill-switch lets through
+type KillSwitchOptions struct {
+	// Endpoints are the wireguard servers, encrypted traffic to them is
+	// allowed. Alternate servers of --peers are listed along with the
+	// primary one, so failing over to them isn't blocked.
+	Endpoints []netip.AddrPort
+
+	// AllowIPs are destinations that may bypass the tunnel, e.g. LAN ranges
+	// and split tunnel excludes. IPv6 ranges are only used with BlockIPv6.
+	AllowIPs []netip.Prefix
+
+	// BlockIPv6 rejects all IPv6 traffic that doesn't use the tunnel
+	BlockIPv6 bool
+}
+
+// KillSwitchRules returns wg-quick PostUp and PreDown commands that reject
+// all traffic leaving through any interface but the tunnel, except to the
+// wireguard endpoints and the allowed ranges.
+func KillSwitchRules(backend KillSwitch, opts KillSwitchOptions) (postUp, preDown []string, err error) {
+	var v4, v6 []netip.Prefix
+	for _, p := range opts.AllowIPs {
+		if p.Addr().Is4() {
+			v4 = append(v4, p.Masked())
+		} else {
+			v6 = append(v6, p.Masked())
+		}
+	}
+
+	switch backend {
+	case KillSwitchIptables:
+		postUp, preDown = iptablesKillSwitch("iptables", opts.Endpoints, v4)
+		if opts.BlockIPv6 {
+			up, down := iptablesKillSwitch("ip6tables", nil, v6)
+			postUp = append(postUp, up...)
+			preDown = append(preDown, down...)
+		}
+	case KillSwitchNftables:
+		postUp, preDown = nftablesKillSwitch(opts.Endpoints, v4, v6, opts.BlockIPv6)
+	default:
+		return nil, nil, fmt.Errorf("unknown kill-switch backend %q", backend)
+	}
+
+	return postUp, preDown, nil
+}
+
+func iptablesKillSwitch(cmd string, endpoints []netip.AddrPort, allow []netip.Prefix) (postUp, preDown []string) {
+	rule := func(format string, args ...any) {
+		postUp = append(postUp, fmt.Sprintf("%s -A %s ", cmd, killSwitchName)+fmt.Sprintf(format, args...))
+	}
+
+	postUp = append(postUp, fmt.Sprintf("%s -N %s", cmd, killSwitchName))
+	rule("-o lo -j RETURN")
+	rule("-o %%i -j RETURN")
+	for _, endpoint := range endpoints {
+		rule("-d %v/32 -p udp --dport %d -j RETURN", endpoint.Addr(), endpoint.Port())
+	}
+	for _, p := range allow {
+		rule("-d %v -j RETURN", p)
+	}
+	rule("-j REJECT")
+	postUp = append(postUp, fmt.Sprintf("%s -I OUTPUT -j %s", cmd, killSwitchName))
+
+	preDown = []string{
+		fmt.Sprintf("%s -D OUTPUT -j %s", cmd, killSwitchName),
+		fmt.Sprintf("%s -F %s", cmd, killSwitchName),
+		fmt.Sprintf("%s -X %s", cmd, killSwitchName),
+	}
+
+	return postUp, preDown
+}
+
+func nftablesKillSwitch(endpoints []netip.AddrPort, v4, v6 []netip.Prefix, blockIPv6 bool) (postUp, preDown []string) {
+	table := fmt.Sprintf("inet %s", killSwitchName)
+	rule := func(format string, args ...any) {
+		postUp = append(postUp, fmt.Sprintf("nft add rule %s output ", table)+fmt.Sprintf(format, args...))
+	}
+
+	postUp = []string{
+		fmt.Sprintf("nft add table %s", table),
+		fmt.Sprintf("nft add chain %s output '{ type filter hook output priority 0; policy accept; }'", table),
+	}
+	rule("oifname lo accept")
+	rule("oifname %%i accept")
+	for _, endpoint := range endpoints {
+		rule("ip daddr %v udp dport %d accept", endpoint.Addr(), endpoint.Port())
+	}
+	for _, p := range v4 {
+		rule("ip daddr %v accept", p)
+	}
+	rule("meta nfproto ipv4 reject")
+	if blockIPv6 {
+		for _, p := range v6 {
+			rule("ip6 daddr %v accept", p)
+		}
+		rule("meta nfproto ipv6 reject")
+	}
+
+	preDown = []string{fmt.Sprintf("nft delete table %s", table)}
+
+	return postUp, preDown
+}
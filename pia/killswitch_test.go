@@ -0,0 +1,167 @@
+package pia
+
+import (
+	"flag"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file: %v (run go test -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s mismatch\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestKillSwitchRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend KillSwitch
+		opts    KillSwitchOptions
+		wantErr bool
+	}{
+		{
+			name:    "iptables",
+			backend: KillSwitchIptables,
+			opts: KillSwitchOptions{
+				Endpoints: []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:1337")},
+				AllowIPs:  mustParsePrefixes(t, "192.168.0.0/16", "fd00::/8"),
+			},
+		},
+		{
+			name:    "iptables_ipv6",
+			backend: KillSwitchIptables,
+			opts: KillSwitchOptions{
+				Endpoints: []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:1337")},
+				AllowIPs:  mustParsePrefixes(t, "192.168.0.0/16", "fd00::/8"),
+				BlockIPv6: true,
+			},
+		},
+		{
+			name:    "nftables",
+			backend: KillSwitchNftables,
+			opts: KillSwitchOptions{
+				Endpoints: []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:1337")},
+				AllowIPs:  mustParsePrefixes(t, "192.168.0.0/16", "fd00::/8"),
+			},
+		},
+		{
+			name:    "nftables_ipv6",
+			backend: KillSwitchNftables,
+			opts: KillSwitchOptions{
+				Endpoints: []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:1337")},
+				AllowIPs:  mustParsePrefixes(t, "192.168.0.0/16", "fd00::/8"),
+				BlockIPv6: true,
+			},
+		},
+		{
+			name:    "unknown backend",
+			backend: "pf",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postUp, preDown, err := KillSwitchRules(tt.backend, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("KillSwitchRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var got strings.Builder
+			for _, rule := range postUp {
+				got.WriteString("PostUp = " + rule + "\n")
+			}
+			for _, rule := range preDown {
+				got.WriteString("PreDown = " + rule + "\n")
+			}
+			assertGolden(t, filepath.Join("killswitch", tt.name), got.String())
+		})
+	}
+}
+
+func TestPIAWgGenerator_Generate_killSwitch(t *testing.T) {
+	tests := []struct {
+		name   string
+		pia    PIAWgClient
+		config PIAWgGeneratorConfig
+	}{
+		{
+			name: "iptables_split_tunnel",
+			config: PIAWgGeneratorConfig{
+				KillSwitch:         KillSwitchIptables,
+				ExcludeIPs:         mustParsePrefixes(t, "10.0.0.0/8"),
+				KillSwitchAllowIPs: mustParsePrefixes(t, "192.168.1.0/24"),
+			},
+		},
+		{
+			name: "nftables_split_tunnel",
+			config: PIAWgGeneratorConfig{
+				KillSwitch:         KillSwitchNftables,
+				ExcludeIPs:         mustParsePrefixes(t, "10.0.0.0/8"),
+				KillSwitchAllowIPs: mustParsePrefixes(t, "192.168.1.0/24"),
+			},
+		},
+		{
+			name: "iptables_ipv6_block",
+			config: PIAWgGeneratorConfig{
+				KillSwitch: KillSwitchIptables,
+				IPv6Mode:   IPv6ModeBlock,
+				IPv6Sysctl: true,
+			},
+		},
+		{
+			name: "iptables_peers",
+			pia:  &multiServerMock{},
+			config: PIAWgGeneratorConfig{
+				KillSwitch: KillSwitchIptables,
+				Peers:      2,
+			},
+		},
+		{
+			name: "nftables_peers",
+			pia:  &multiServerMock{},
+			config: PIAWgGeneratorConfig{
+				KillSwitch: KillSwitchNftables,
+				Peers:      2,
+				ExcludeIPs: mustParsePrefixes(t, "10.0.0.0/8"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.pia == nil {
+				tt.pia = &PIAClientMock{}
+			}
+			tt.config.PrivateKey = "test_privatekey"
+			tt.config.PublicKey = "test_publickey"
+			got, err := NewPIAWgGenerator(tt.pia, tt.config).Generate()
+			if err != nil {
+				t.Fatalf("PIAWgGenerator.Generate() error = %v", err)
+			}
+			// the golden file ends with a newline, the config doesn't
+			assertGolden(t, filepath.Join("killswitch", tt.name), got+"\n")
+		})
+	}
+}
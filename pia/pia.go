@@ -2,20 +2,17 @@ package pia
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/benburkert/dns"
 	"github.com/pkg/errors"
 )
 
@@ -24,6 +21,13 @@ type PIAWgClient interface {
 	AddKey(token, publickey string) (AddKeyResult, error)
 }
 
+// PIAWgMultiClient is a PIAWgClient that can register a key with several
+// servers of a region at once
+type PIAWgMultiClient interface {
+	PIAWgClient
+	AddKeys(token, publickey string, n int) ([]AddKeyResult, error)
+}
+
 type Region string
 type ServerList map[Region][]Server
 
@@ -31,10 +35,77 @@ type PIAClient struct {
 	region           string
 	wireguardServers ServerList
 	metadataServers  ServerList
+	regionNames      map[Region]string
 	username         string
 	password         string
 	verbose          bool
 	caCert           []byte
+	observer         Observer
+	serverListURL    string
+	serverOffset     int
+	transports       *transports
+	retryPolicy      RetryPolicy
+	proxy            *url.URL
+	envProxy         func(*url.URL) (*url.URL, error)
+	dialContext      func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DefaultServerListURL is the PIA server list the client fetches
+const DefaultServerListURL = "https://serverlist.piaservers.net/vpninfo/servers/v4"
+
+// Observer is notified of requests made by a PIAClient, e.g. to export
+// metrics. Methods may be called concurrently.
+type Observer interface {
+	// ServerListFetched reports a server list download and how long it took
+	ServerListFetched(duration time.Duration, err error)
+	// TokenFetched reports a GetToken call
+	TokenFetched(err error)
+	// KeyAdded reports an AddKey call for region
+	KeyAdded(region string, result AddKeyResult, err error)
+}
+
+// PIAClientOption configures optional behaviour of a PIAClient
+type PIAClientOption func(*PIAClient)
+
+// WithObserver reports the requests of the client to o
+func WithObserver(o Observer) PIAClientOption {
+	return func(p *PIAClient) {
+		p.observer = o
+	}
+}
+
+// WithServerListURL fetches the server list from url instead of
+// DefaultServerListURL
+func WithServerListURL(url string) PIAClientOption {
+	return func(p *PIAClient) {
+		p.serverListURL = url
+	}
+}
+
+// WithCACert trusts the PEM encoded certificate for PIA servers instead of
+// downloading the PIA CA
+func WithCACert(pem []byte) PIAClientOption {
+	return func(p *PIAClient) {
+		p.caCert = pem
+	}
+}
+
+// WithDialContext connects to PIA servers with dial instead of resolving
+// their common names to the IPs of the server list, e.g. to reach a fake
+// server in tests
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) PIAClientOption {
+	return func(p *PIAClient) {
+		p.dialContext = dial
+	}
+}
+
+// StatusError is returned when a PIA API responds with an unexpected status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code %v", e.StatusCode)
 }
 
 type piaServerList struct {
@@ -62,6 +133,11 @@ type AddKeyResult struct {
 	PeerIP     string   `json:"peer_ip"`
 	PeerPubkey string   `json:"peer_pubkey"`
 	DNSServers []string `json:"dns_servers"`
+
+	// Region and ServerCN identify the server the key was added to. They
+	// are filled in by the client, not returned by PIA.
+	Region   string `json:"region,omitempty"`
+	ServerCN string `json:"server_cn,omitempty"`
 }
 
 type Server struct {
@@ -69,14 +145,26 @@ type Server struct {
 	IP string
 }
 
-// NewPIAClient creates a new PIA client for with the list of servers populated
-func NewPIAClient(username, password, region string, verbose bool) (*PIAClient, error) {
+// NewPIAClient creates a new PIA client for with the list of servers populated.
+// An empty region creates a client that only lists regions, e.g. to pick
+// them with ForRegion.
+func NewPIAClient(username, password, region string, verbose bool, opts ...PIAClientOption) (*PIAClient, error) {
 	piaClient := PIAClient{
-		username: username,
-		password: password,
-		region:   region,
-		verbose:  verbose,
+		username:      username,
+		password:      password,
+		region:        region,
+		verbose:       verbose,
+		serverListURL: DefaultServerListURL,
+		retryPolicy:   DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(&piaClient)
+	}
+	if err := checkProxy(piaClient.proxy); err != nil {
+		return nil, err
 	}
+	piaClient.envProxy = environmentProxy()
+	piaClient.transports = newTransports(&piaClient)
 
 	// Get list of servers
 	serverList, err := piaClient.getServerList()
@@ -85,31 +173,101 @@ func NewPIAClient(username, password, region string, verbose bool) (*PIAClient,
 	}
 
 	// Set servers
-	piaClient.metadataServers = piaClient.generateMetadataServerList(serverList)
-	piaClient.wireguardServers = piaClient.generateWireguardServerList(serverList)
+	piaClient.setServers(serverList)
 
 	// Validate region exists
-	if _, exists := piaClient.wireguardServers[Region(region)]; !exists {
-		availableRegions := make([]string, 0, len(piaClient.wireguardServers))
-		for r := range piaClient.wireguardServers {
-			availableRegions = append(availableRegions, string(r))
-		}
-		return nil, fmt.Errorf("region '%s' not found. Available regions: %v. Use 'pia-wg-config regions' to see all available regions", region, availableRegions[:5]) // Show first 5 as example
+	if _, exists := piaClient.wireguardServers[Region(region)]; !exists && region != "" {
+		availableRegions := piaClient.Regions()
+		return nil, fmt.Errorf("region '%s' not found. Available regions: %v. Use 'pia-wg-config regions' to see all available regions", region, availableRegions[:min(5, len(availableRegions))]) // Show first 5 as example
 	}
 
 	return &piaClient, nil
 }
 
+// setServers replaces the servers of the client with those of a server list
+func (p *PIAClient) setServers(list piaServerList) {
+	p.metadataServers = p.generateMetadataServerList(list)
+	p.wireguardServers = p.generateWireguardServerList(list)
+	p.regionNames = make(map[Region]string, len(list.Regions))
+	for _, r := range list.Regions {
+		p.regionNames[Region(r.ID)] = r.Name
+	}
+	p.transports.setServerIPs(serverIPs(p.metadataServers, p.wireguardServers))
+}
+
+// RefreshServers downloads the server list again, so servers that were
+// removed from it are no longer used
+func (p *PIAClient) RefreshServers() error {
+	serverList, err := p.getServerList()
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch server list from PIA")
+	}
+	if p.verbose {
+		logf("Refreshed server list")
+	}
+	p.setServers(serverList)
+	if _, exists := p.wireguardServers[Region(p.region)]; !exists && p.region != "" {
+		return fmt.Errorf("region '%s' is no longer in the server list", p.region)
+	}
+
+	return nil
+}
+
+// NextServer moves the client on to the next metadata and wireguard server
+// of its region, wrapping around, e.g. after the current one failed
+func (p *PIAClient) NextServer() {
+	p.serverOffset++
+}
+
+// ForRegion returns a client for another region that shares the server
+// list, CA certificate, credentials and connections of p, so many regions can
+// be served from one download and token
+func (p *PIAClient) ForRegion(region string) (*PIAClient, error) {
+	if _, exists := p.wireguardServers[Region(region)]; !exists {
+		return nil, fmt.Errorf("region '%s' not found. Use 'pia-wg-config regions' to see all available regions", region)
+	}
+
+	client := *p
+	client.region = region
+	client.serverOffset = 0
+	return &client, nil
+}
+
+// Regions returns the sorted IDs of all regions with wireguard servers
+func (p *PIAClient) Regions() []string {
+	regions := make([]string, 0, len(p.wireguardServers))
+	for r := range p.wireguardServers {
+		regions = append(regions, string(r))
+	}
+	sort.Strings(regions)
+
+	return regions
+}
+
+// RegionNames returns the names of all regions by ID, from the server list the
+// client downloaded
+func (p *PIAClient) RegionNames() map[Region]string {
+	return maps.Clone(p.regionNames)
+}
+
 // GetToken
-func (p *PIAClient) GetToken() (string, error) {
-	server := p.getMetadataServerForRegion()
+func (p *PIAClient) GetToken() (token string, err error) {
+	if p.observer != nil {
+		defer func() { p.observer.TokenFetched(err) }()
+	}
+
+	server, err := p.getMetadataServerForRegion()
+	if err != nil {
+		return "", err
+	}
 	url := fmt.Sprintf("https://%v/authv3/generateToken", server.Cn)
 
 	// Send request
-	resp, err := p.executePIARequest(server, url, "")
+	resp, err := p.executePIARequest(context.Background(), url, basicAuth)
 	if err != nil {
 		return "", errors.Wrap(err, "error executing request")
 	}
+	defer drainAndClose(resp.Body)
 
 	// Parse response
 	var tokenResp struct {
@@ -122,7 +280,7 @@ func (p *PIAClient) GetToken() (string, error) {
 	}
 
 	if p.verbose {
-		log.Print("Got token: ", tokenResp.Token)
+		logf("Got token: %s", secret(tokenResp.Token))
 	}
 
 	return tokenResp.Token, nil
@@ -145,57 +303,109 @@ func (p *PIAClient) GetAvailableRegions() (map[Region]string, error) {
 
 // AddKey
 func (p *PIAClient) AddKey(token, publickey string) (AddKeyResult, error) {
-	var addKeyResp AddKeyResult
-	server := p.getWireguardServerForRegion()
+	server, err := p.getWireguardServerForRegion()
+	if err != nil {
+		return AddKeyResult{}, err
+	}
+	return p.addKey(server, token, publickey)
+}
+
+// AddKeys registers publickey with up to n distinct wireguard servers of the
+// region, for clients that fail over between them. Servers that fail are
+// skipped, an error is only returned if none accepted the key.
+func (p *PIAClient) AddKeys(token, publickey string, n int) ([]AddKeyResult, error) {
+	servers := p.wireguardServers[Region(p.region)]
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no wireguard servers available for region: %s", p.region)
+	}
+
+	var results []AddKeyResult
+	var lastErr error
+	for i := range servers {
+		if len(results) == n {
+			break
+		}
+		server := servers[(p.serverOffset+i)%len(servers)]
+		result, err := p.addKey(server, token, publickey)
+		if err != nil {
+			if p.verbose {
+				logf("Failed to add key to %s: %v", server.Cn, err)
+			}
+			lastErr = err
+			continue
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return nil, lastErr
+	}
+
+	return results, nil
+}
+
+func (p *PIAClient) addKey(server Server, token, publickey string) (addKeyResp AddKeyResult, err error) {
+	if p.observer != nil {
+		defer func() { p.observer.KeyAdded(p.region, addKeyResp, err) }()
+	}
 
 	// Build http request
 	url := fmt.Sprintf("https://%v:1337/addKey?pt=%v&pubkey=%v", server.Cn, url.QueryEscape(token), url.QueryEscape(publickey))
 
 	// Send request
-	resp, err := p.executePIARequest(server, url, token)
+	resp, err := p.executePIARequest(context.Background(), url, tokenAuth)
 	if err != nil {
 		return addKeyResp, errors.Wrap(err, "error executing request")
 	}
+	defer drainAndClose(resp.Body)
 
 	// Parse response
 	err = json.NewDecoder(resp.Body).Decode(&addKeyResp)
 	if err != nil {
 		return addKeyResp, errors.Wrap(err, "error decoding add key response")
 	}
+	addKeyResp.Region = p.region
+	addKeyResp.ServerCN = server.Cn
 
 	return addKeyResp, nil
 }
 
-func (p *PIAClient) getWireguardServerForRegion() Server {
+func (p *PIAClient) getWireguardServerForRegion() (Server, error) {
 	if p.verbose {
-		log.Print("Getting wireguard server for region: ", p.region)
+		logf("Getting wireguard server for region: %s", p.region)
 	}
 	servers := p.wireguardServers[Region(p.region)]
 	if len(servers) == 0 {
-		log.Fatalf("No Wireguard servers available for region: %s", p.region)
+		return Server{}, fmt.Errorf("no wireguard servers available for region: %s", p.region)
 	}
-	return servers[0]
+	return servers[p.serverOffset%len(servers)], nil
 }
 
-func (p *PIAClient) getMetadataServerForRegion() Server {
+func (p *PIAClient) getMetadataServerForRegion() (Server, error) {
 	if p.verbose {
-		log.Print("Getting metadata server for region: ", p.region)
+		logf("Getting metadata server for region: %s", p.region)
 	}
 	servers := p.metadataServers[Region(p.region)]
 	if len(servers) == 0 {
-		log.Fatalf("No metadata servers available for region: %s", p.region)
+		return Server{}, fmt.Errorf("no metadata servers available for region: %s", p.region)
 	}
-	return servers[0]
+	return servers[p.serverOffset%len(servers)], nil
 }
 
 // getSeverList returns a list of servers from the PIA API
-func (p *PIAClient) getServerList() (piaServerList, error) {
-	var serverList piaServerList
+func (p *PIAClient) getServerList() (serverList piaServerList, err error) {
+	if p.observer != nil {
+		start := time.Now()
+		defer func() { p.observer.ServerListFetched(time.Since(start), err) }()
+	}
 
-	resp, err := http.Get("https://serverlist.piaservers.net/vpninfo/servers/v4")
+	resp, err := p.transports.web.Get(p.serverListURL)
 	if err != nil {
 		return piaServerList{}, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return piaServerList{}, &StatusError{StatusCode: resp.StatusCode}
+	}
 
 	// Strip the base64 garbage
 	respBytes, err := io.ReadAll(resp.Body)
@@ -248,8 +458,19 @@ func (p *PIAClient) generateMetadataServerList(list piaServerList) ServerList {
 	return servers
 }
 
-func (p *PIAClient) executePIARequest(server Server, url, token string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// requestAuth is how a PIA API request authenticates
+type requestAuth int
+
+const (
+	// basicAuth sends the account credentials, only generateToken takes them
+	basicAuth requestAuth = iota
+	// tokenAuth sends no credentials, the request carries a token or
+	// signature in its query
+	tokenAuth
+)
+
+func (p *PIAClient) executePIARequest(ctx context.Context, url string, auth requestAuth) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -258,57 +479,14 @@ func (p *PIAClient) executePIARequest(server Server, url, token string) (*http.R
 	req.Header.Set("Content-Type", "application/json")
 
 	// Set basic auth
-	if token == "" {
+	if auth == basicAuth {
 		req.SetBasicAuth(p.username, p.password)
 	}
 
-	// Add certificate to shared pool
-	err = p.downloadPIACertificate()
+	client, err := p.apiClient()
 	if err != nil {
-		return nil, errors.Wrap(err, "error downloading ca certificate")
-	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(p.caCert)
-
-	// Create DNS resolver for PIA addresses
-	zone := &dns.Zone{
-		Origin: "",
-		TTL:    5 * time.Minute,
-		RRs: dns.RRSet{
-			server.Cn: {
-				dns.TypeA: []dns.Record{
-					&dns.A{A: net.ParseIP(server.IP)},
-				},
-			},
-		},
-	}
-	mux := new(dns.ResolveMux)
-	mux.Handle(dns.TypeANY, zone.Origin, zone)
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: (&dns.Client{
-			Resolver: mux,
-		}).Dial,
-	}
-
-	// Set custom DNS server
-	dialer := &net.Dialer{
-		Resolver: resolver,
-	}
-
-	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return dialer.DialContext(ctx, network, addr)
-	}
-
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: caCertPool,
-			},
-			DialContext: dialContext,
-		},
+		return nil, err
 	}
-
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -316,30 +494,39 @@ func (p *PIAClient) executePIARequest(server Server, url, token string) (*http.R
 
 	// Return error if status code is not 200
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("status code %v", resp.StatusCode)
+		drainAndClose(resp.Body)
+		return nil, &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	return resp, nil
 }
 
-// downloadPIACertificate downloads the PIA certificate
-func (p *PIAClient) downloadPIACertificate() error {
+// httpClient sends requests over transport, retrying them according to the
+// retry policy of the client
+func (p *PIAClient) httpClient(transport http.RoundTripper) *http.Client {
+	if p.retryPolicy.MaxAttempts > 1 {
+		transport = newRetryTransport(transport, p.retryPolicy, p.verbose)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// downloadPIACertificate returns the PIA CA certificate, downloading it
+// unless WithCACert gave it
+func (p *PIAClient) downloadPIACertificate() ([]byte, error) {
 	// caCert already loaded
 	if len(p.caCert) > 0 {
-		return nil
+		return p.caCert, nil
 	}
 
 	// Download certificate
-	resp, err := http.Get("https://raw.githubusercontent.com/pia-foss/desktop/master/daemon/res/ca/rsa_4096.crt")
+	resp, err := p.transports.web.Get("https://raw.githubusercontent.com/pia-foss/desktop/master/daemon/res/ca/rsa_4096.crt")
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// Parse certificate
-	p.caCert, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
 	}
 
-	return nil
+	return io.ReadAll(resp.Body)
 }
@@ -0,0 +1,40 @@
+package pia
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPIAClient_ForRegion(t *testing.T) {
+	p := &PIAClient{
+		region:   "uk_london",
+		username: "user",
+		caCert:   []byte("cert"),
+		wireguardServers: ServerList{
+			"uk_london": {{Cn: "london401", IP: "1.2.3.4"}},
+			"de_berlin": {{Cn: "berlin402", IP: "5.6.7.8"}},
+		},
+	}
+
+	if got, want := p.Regions(), []string{"de_berlin", "uk_london"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PIAClient.Regions() = %v, want %v", got, want)
+	}
+
+	berlin, err := p.ForRegion("de_berlin")
+	if err != nil {
+		t.Fatalf("PIAClient.ForRegion() error = %v", err)
+	}
+	if berlin.region != "de_berlin" || p.region != "uk_london" {
+		t.Errorf("PIAClient.ForRegion() region = %v, original %v", berlin.region, p.region)
+	}
+	if berlin.username != "user" || string(berlin.caCert) != "cert" {
+		t.Errorf("PIAClient.ForRegion() didn't share credentials and certificate")
+	}
+	if got, err := berlin.getWireguardServerForRegion(); err != nil || got.Cn != "berlin402" {
+		t.Errorf("PIAClient.ForRegion() server = %v, %v", got.Cn, err)
+	}
+
+	if _, err := p.ForRegion("nowhere"); err == nil {
+		t.Error("PIAClient.ForRegion() error = nil for unknown region")
+	}
+}
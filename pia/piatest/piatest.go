@@ -0,0 +1,586 @@
+// Package piatest runs a local fake of the PIA APIs a PIAClient talks to, so
+// clients can be tested end to end, over HTTP, TLS and the client's dialing,
+// without a network or a PIA account.
+//
+//	server := piatest.NewServer()
+//	defer server.Close()
+//
+//	client, err := pia.NewPIAClient(piatest.DefaultUsername, piatest.DefaultPassword,
+//		"uk_london", false, server.ClientOptions()...)
+//
+// The fake serves the server list, with a signature appended like the real
+// one, on plain HTTP, and generateToken, addKey, getSignature and bindPort
+// on TLS with certificates issued by its own CA for whatever server common
+// name the client asks for. Failures can be scripted per endpoint with Fail.
+package piatest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The account the fake accepts unless SetAccount changes it
+const (
+	DefaultUsername = "p1234567"
+	DefaultPassword = "password"
+)
+
+// Endpoint names a fake PIA API for Fail and Requests
+type Endpoint string
+
+const (
+	ServerList    Endpoint = "serverlist"
+	GenerateToken Endpoint = "generateToken"
+	AddKey        Endpoint = "addKey"
+	GetSignature  Endpoint = "getSignature"
+	BindPort      Endpoint = "bindPort"
+)
+
+// Failure is how the fake answers a request instead of serving it
+type Failure struct {
+	// Status is the HTTP status to respond with, 0 to respond normally
+	Status int
+	// Delay is how long to wait before responding, or until the client gives
+	// up
+	Delay time.Duration
+	// Malformed responds 200 with JSON that is cut short
+	Malformed bool
+	// Count is the number of requests the failure applies to, 0 for every
+	// request until Reset
+	Count int
+}
+
+// Common failures
+var (
+	Unauthorized  = Failure{Status: http.StatusUnauthorized}
+	InternalError = Failure{Status: http.StatusInternalServerError}
+	MalformedJSON = Failure{Malformed: true}
+)
+
+// Slow delays responses by d
+func Slow(d time.Duration) Failure {
+	return Failure{Delay: d}
+}
+
+// Region is a region of the fake server list
+type Region struct {
+	ID      string
+	Name    string
+	Country string
+	Meta    []pia.Server
+	WG      []pia.Server
+}
+
+// DefaultRegions is the server list of a new Server
+var DefaultRegions = []Region{
+	{
+		ID: "us_california", Name: "US California", Country: "US",
+		Meta: []pia.Server{{Cn: "losangeles401", IP: "192.0.2.1"}},
+		WG:   []pia.Server{{Cn: "losangeles402", IP: "192.0.2.2"}, {Cn: "losangeles403", IP: "192.0.2.3"}},
+	},
+	{
+		ID: "uk_london", Name: "UK London", Country: "GB",
+		Meta: []pia.Server{{Cn: "london401", IP: "192.0.2.11"}},
+		WG:   []pia.Server{{Cn: "london402", IP: "192.0.2.12"}, {Cn: "london403", IP: "192.0.2.13"}},
+	},
+	{
+		ID: "de_berlin", Name: "DE Berlin", Country: "DE",
+		Meta: []pia.Server{{Cn: "berlin401", IP: "192.0.2.21"}},
+		WG:   []pia.Server{{Cn: "berlin402", IP: "192.0.2.22"}},
+	},
+}
+
+// Server is a running fake of the PIA APIs
+type Server struct {
+	list *httptest.Server
+	api  *httptest.Server
+
+	caPEM     []byte
+	caCert    *x509.Certificate
+	caKey     *ecdsa.PrivateKey
+	certs     sync.Map // server common name to *tls.Certificate
+	signer    ed25519.PrivateKey
+	serverKey wgtypes.Key
+
+	mu       sync.Mutex
+	username string
+	password string
+	regions  []Region
+	failures map[Endpoint][]Failure
+	requests map[Endpoint]int
+	tokens   map[string]bool
+	keys     []string
+	peers    int
+	conns    int
+}
+
+// NewServer starts a fake with DefaultRegions and the default account. It
+// panics if it can't start, like httptest.NewServer.
+func NewServer() *Server {
+	s := &Server{
+		username: DefaultUsername,
+		password: DefaultPassword,
+		regions:  DefaultRegions,
+		failures: map[Endpoint][]Failure{},
+		requests: map[Endpoint]int{},
+		tokens:   map[string]bool{},
+	}
+	if err := s.newCA(); err != nil {
+		panic(fmt.Sprintf("piatest: %v", err))
+	}
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("piatest: %v", err))
+	}
+	s.signer = signer
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		panic(fmt.Sprintf("piatest: %v", err))
+	}
+	s.serverKey = serverKey
+
+	list := http.NewServeMux()
+	list.Handle("/vpninfo/servers/v4", s.endpoint(ServerList, s.serveServerList))
+	s.list = httptest.NewServer(list)
+
+	api := http.NewServeMux()
+	api.Handle("/authv3/generateToken", s.endpoint(GenerateToken, s.serveGenerateToken))
+	api.Handle("/addKey", s.endpoint(AddKey, s.serveAddKey))
+	api.Handle("/getSignature", s.endpoint(GetSignature, s.serveGetSignature))
+	api.Handle("/bindPort", s.endpoint(BindPort, s.serveBindPort))
+	s.api = httptest.NewUnstartedServer(api)
+	s.api.TLS = &tls.Config{GetCertificate: s.certificate}
+	s.api.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+		}
+	}
+	s.api.StartTLS()
+
+	return s
+}
+
+// Close shuts the fake down
+func (s *Server) Close() {
+	s.list.Close()
+	s.api.Close()
+}
+
+// ServerListURL is the URL of the fake server list
+func (s *Server) ServerListURL() string {
+	return s.list.URL + "/vpninfo/servers/v4"
+}
+
+// CACert is the PEM encoded CA certificate the fake's servers are issued by
+func (s *Server) CACert() []byte {
+	return s.caPEM
+}
+
+// ServerKey is the wireguard public key the fake's servers return
+func (s *Server) ServerKey() string {
+	return s.serverKey.PublicKey().String()
+}
+
+// ClientOptions point a PIAClient at the fake: its server list, its CA and
+// a dialer connecting the common names of its servers to it
+func (s *Server) ClientOptions() []pia.PIAClientOption {
+	return []pia.PIAClientOption{
+		pia.WithServerListURL(s.ServerListURL()),
+		pia.WithCACert(s.CACert()),
+		pia.WithDialContext(s.DialContext),
+	}
+}
+
+// DialContext connects to the fake for any server of its server list, by
+// common name or IP, on the ports PIA uses. Proxy stand-ins can use it to
+// reach the fake at the pinned server IPs.
+func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.lookup(host); !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	switch port {
+	case "443", "1337", "19999":
+	default:
+		return nil, fmt.Errorf("piatest: nothing listens on %s", addr)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, s.api.Listener.Addr().String())
+}
+
+// SetAccount changes the username and password the fake accepts
+func (s *Server) SetAccount(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password = username, password
+}
+
+// SetRegions replaces the server list
+func (s *Server) SetRegions(regions ...Region) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.regions = regions
+}
+
+// Fail queues a failure for the next requests to endpoint. Failures apply in
+// the order they were queued.
+func (s *Server) Fail(endpoint Endpoint, failure Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], failure)
+}
+
+// Reset clears queued failures and the recorded requests, tokens and keys
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = map[Endpoint][]Failure{}
+	s.requests = map[Endpoint]int{}
+	s.tokens = map[string]bool{}
+	s.keys = nil
+	s.conns = 0
+}
+
+// Requests returns how many requests endpoint received, failed ones included
+func (s *Server) Requests(endpoint Endpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// Connections returns how many connections the API servers accepted
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// Keys returns the public keys added with addKey, in order
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keys...)
+}
+
+// endpoint counts requests to an endpoint and applies its queued failures
+// before serving it
+func (s *Server) endpoint(endpoint Endpoint, serve http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[endpoint]++
+		var failure *Failure
+		if queue := s.failures[endpoint]; len(queue) > 0 {
+			f := queue[0]
+			failure = &f
+			if queue[0].Count > 0 {
+				queue[0].Count--
+				if queue[0].Count == 0 {
+					s.failures[endpoint] = queue[1:]
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		if failure == nil {
+			serve(w, r)
+			return
+		}
+		if failure.Delay > 0 {
+			select {
+			case <-time.After(failure.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch {
+		case failure.Status != 0:
+			writeJSON(w, failure.Status, map[string]string{"status": "ERROR", "message": http.StatusText(failure.Status)})
+		case failure.Malformed:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"OK","tok`))
+		default:
+			serve(w, r)
+		}
+	})
+}
+
+func (s *Server) serveServerList(w http.ResponseWriter, r *http.Request) {
+	type server struct {
+		IP string `json:"ip"`
+		Cn string `json:"cn"`
+	}
+	type region struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		Country     string `json:"country"`
+		AutoRegion  bool   `json:"auto_region"`
+		DNS         string `json:"dns"`
+		PortForward bool   `json:"port_forward"`
+		Geo         bool   `json:"geo"`
+		Servers     struct {
+			Meta []server `json:"meta"`
+			Wg   []server `json:"wg"`
+		} `json:"servers"`
+	}
+	list := struct {
+		Groups  map[string]any `json:"groups"`
+		Regions []region       `json:"regions"`
+	}{Groups: map[string]any{}, Regions: []region{}}
+
+	s.mu.Lock()
+	for _, r := range s.regions {
+		out := region{ID: r.ID, Name: r.Name, Country: r.Country, AutoRegion: true, PortForward: true}
+		for _, m := range r.Meta {
+			out.Servers.Meta = append(out.Servers.Meta, server{IP: m.IP, Cn: m.Cn})
+		}
+		for _, wg := range r.WG {
+			out.Servers.Wg = append(out.Servers.Wg, server{IP: wg.IP, Cn: wg.Cn})
+		}
+		list.Regions = append(list.Regions, out)
+	}
+	s.mu.Unlock()
+
+	// like the real list, the JSON is followed by a signature of it
+	b, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(s.signer, b))
+	w.Write(append(b, []byte("\n\n"+signature+"\n")...))
+}
+
+func (s *Server) serveGenerateToken(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	s.mu.Lock()
+	ok = ok && username == s.username && password == s.password
+	s.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "ERROR", "message": "Login failed!"})
+		return
+	}
+
+	token := randomHex(64)
+	s.mu.Lock()
+	s.tokens[token] = true
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "OK", "token": token})
+}
+
+func (s *Server) serveAddKey(w http.ResponseWriter, r *http.Request) {
+	if !s.validToken(r.URL.Query().Get("pt")) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "ERROR", "message": "Login failed!"})
+		return
+	}
+	pubkey, err := wgtypes.ParseKey(r.URL.Query().Get("pubkey"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "ERROR", "message": "Invalid public key"})
+		return
+	}
+
+	server, _ := s.lookup(r.TLS.ServerName)
+	s.mu.Lock()
+	s.peers++
+	peerIP := fmt.Sprintf("10.%d.%d.%d", 10+s.peers/65536%200, s.peers/256%256, s.peers%256)
+	s.keys = append(s.keys, pubkey.String())
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, pia.AddKeyResult{
+		Status:     "OK",
+		ServerKey:  s.ServerKey(),
+		ServerPort: 1337,
+		ServerIP:   server.IP,
+		ServerVip:  "10.0.0.1",
+		PeerIP:     peerIP,
+		PeerPubkey: pubkey.String(),
+		DNSServers: []string{"10.0.0.243", "10.0.0.242"},
+	})
+}
+
+// portPayload is the signed payload of getSignature
+type portPayload struct {
+	Token     string    `json:"token"`
+	Port      int       `json:"port"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// rejectCredentials fails port forwarding requests that send the account
+// credentials, the gateways only take the token and signature in the query
+func rejectCredentials(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") == "" {
+		return false
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]string{"status": "ERROR", "message": "Unexpected credentials"})
+	return true
+}
+
+func (s *Server) serveGetSignature(w http.ResponseWriter, r *http.Request) {
+	if rejectCredentials(w, r) {
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if !s.validToken(token) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "ERROR", "message": "Login failed!"})
+		return
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(20000))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(portPayload{Token: token, Port: 40000 + int(n.Int64()), ExpiresAt: time.Now().Add(60 * 24 * time.Hour).UTC()})
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":    "OK",
+		"payload":   base64.StdEncoding.EncodeToString(b),
+		"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(s.signer, b)),
+	})
+}
+
+func (s *Server) serveBindPort(w http.ResponseWriter, r *http.Request) {
+	if rejectCredentials(w, r) {
+		return
+	}
+	payload, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("payload"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "ERROR", "message": "Invalid payload"})
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("signature"))
+	if err != nil || !ed25519.Verify(s.signer.Public().(ed25519.PublicKey), payload, signature) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "ERROR", "message": "Invalid signature"})
+		return
+	}
+	var p portPayload
+	if err := json.Unmarshal(payload, &p); err != nil || !s.validToken(p.Token) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "ERROR", "message": "Login failed!"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "OK", "message": "port scheduled for add"})
+}
+
+func (s *Server) validToken(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[token]
+}
+
+// lookup finds a server of the server list by common name or IP
+func (s *Server) lookup(name string) (pia.Server, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.regions {
+		for _, servers := range [][]pia.Server{r.Meta, r.WG} {
+			for _, server := range servers {
+				if server.Cn == name || server.IP == name {
+					return server, true
+				}
+			}
+		}
+	}
+	return pia.Server{}, false
+}
+
+// newCA creates the self-signed CA the fake's certificates are issued by
+func (s *Server) newCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "piatest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	s.caCert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	s.caKey = key
+	s.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return nil
+}
+
+// certificate issues a certificate for the server common name the client
+// asked for, PIA servers are addressed by bare names like london401
+func (s *Server) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if cert, ok := s.certs.Load(name); ok {
+		return cert.(*tls.Certificate), nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.DNSNames, template.IPAddresses = nil, []net.IP{ip}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, &key.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	s.certs.Store(name, cert)
+	return cert, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,414 @@
+package piatest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// newClient returns a client of the fake that doesn't retry, so scripted
+// failures reach the caller
+func newClient(t *testing.T, s *Server, username, password string) (*pia.PIAClient, error) {
+	t.Helper()
+	opts := append(s.ClientOptions(), pia.WithRetryPolicy(pia.RetryPolicy{MaxAttempts: 1}))
+	return pia.NewPIAClient(username, password, "uk_london", false, opts...)
+}
+
+func TestGenerate(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	client, err := newClient(t, s, DefaultUsername, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(client.Regions(), ","); got != "de_berlin,uk_london,us_california" {
+		t.Errorf("Regions() = %s", got)
+	}
+
+	data, err := pia.NewPIAWgGenerator(client, pia.PIAWgGeneratorConfig{}).GenerateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.ServerKey != s.ServerKey() || data.ServerCN != "london402" || data.ServerIP != "192.0.2.12" {
+		t.Errorf("GenerateData() = %+v", data.AddKeyResult)
+	}
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != data.PublicKey {
+		t.Errorf("Keys() = %v, want [%s]", keys, data.PublicKey)
+	}
+	for endpoint, want := range map[Endpoint]int{ServerList: 1, GenerateToken: 1, AddKey: 1} {
+		if got := s.Requests(endpoint); got != want {
+			t.Errorf("Requests(%s) = %d, want %d", endpoint, got, want)
+		}
+	}
+}
+
+func TestRegionlessClient(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client, err := pia.NewPIAClient(DefaultUsername, DefaultPassword, "", false, s.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(client.Regions(), ","); got != "de_berlin,uk_london,us_california" {
+		t.Errorf("Regions() = %s", got)
+	}
+	if names := client.RegionNames(); names["uk_london"] != "UK London" {
+		t.Errorf("RegionNames() = %v", names)
+	}
+	if _, err := client.GetToken(); err == nil {
+		t.Error("GetToken() without a region succeeded")
+	}
+
+	regionClient, err := client.ForRegion("de_berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := regionClient.GetToken(); err != nil {
+		t.Errorf("GetToken() of ForRegion() error = %v", err)
+	}
+	if got := s.Requests(ServerList); got != 1 {
+		t.Errorf("Requests(serverlist) = %d, want 1", got)
+	}
+}
+
+func TestUnknownRegion(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	// fewer regions than the error lists as examples
+	_, err := pia.NewPIAClient(DefaultUsername, DefaultPassword, "nowhere", false, s.ClientOptions()...)
+	if err == nil {
+		t.Fatal("NewPIAClient() with an unknown region succeeded")
+	}
+	if want := "region 'nowhere' not found. Available regions: [de_berlin uk_london us_california]"; !strings.Contains(err.Error(), want) {
+		t.Errorf("NewPIAClient() error = %v, want it to contain %q", err, want)
+	}
+}
+
+func TestAddKeys(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client, err := newClient(t, s, DefaultUsername, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := client.GetToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := wgtypes.GeneratePrivateKey()
+
+	// the first server fails, the client fails over to the second
+	s.Fail(AddKey, Failure{Status: http.StatusServiceUnavailable, Count: 1})
+	results, err := client.AddKeys(token, key.PublicKey().String(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ServerCN != "london403" {
+		t.Errorf("AddKeys() = %+v", results)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client, err := newClient(t, s, DefaultUsername, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := wgtypes.GeneratePrivateKey()
+
+	// one connection each to london401 for tokens and london402 for keys
+	for range 3 {
+		token, err := client.GetToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.AddKeys(token, key.PublicKey().String(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.Connections(); got != 2 {
+		t.Errorf("Connections() = %d after 6 requests to 2 servers, want 2", got)
+	}
+
+	// clients for other regions share the connections
+	berlin, err := client.ForRegion("de_berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := berlin.GetToken(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.GetToken(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.Connections(); got != 3 {
+		t.Errorf("Connections() = %d after requests to a third server, want 3", got)
+	}
+}
+
+func TestServerFailover(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client, err := newClient(t, s, DefaultUsername, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := client.GetToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := wgtypes.GeneratePrivateKey()
+
+	client.NextServer()
+	result, err := client.AddKey(token, key.PublicKey().String())
+	if err != nil || result.ServerCN != "london403" {
+		t.Errorf("AddKey() after NextServer() = %s, %v, want london403", result.ServerCN, err)
+	}
+
+	// servers removed from the list are no longer used once it is refreshed
+	london := DefaultRegions[1]
+	london.WG = []pia.Server{{Cn: "london404", IP: "192.0.2.14"}}
+	s.SetRegions(DefaultRegions[0], london)
+	if err := client.RefreshServers(); err != nil {
+		t.Fatal(err)
+	}
+	result, err = client.AddKey(token, key.PublicKey().String())
+	if err != nil || result.ServerCN != "london404" || result.ServerIP != "192.0.2.14" {
+		t.Errorf("AddKey() after RefreshServers() = %+v, %v, want london404", result, err)
+	}
+
+	s.SetRegions(DefaultRegions[0])
+	if err := client.RefreshServers(); err == nil {
+		t.Error("RefreshServers() error = nil after the region was removed")
+	}
+}
+
+func TestFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint Endpoint
+		failure  Failure
+		password string
+		status   int
+		err      string
+	}{
+		{name: "wrong password", endpoint: GenerateToken, password: "wrong", status: http.StatusUnauthorized},
+		{name: "unauthorized", endpoint: GenerateToken, failure: Unauthorized, status: http.StatusUnauthorized},
+		{name: "token server error", endpoint: GenerateToken, failure: InternalError, status: http.StatusInternalServerError},
+		{name: "malformed token", endpoint: GenerateToken, failure: MalformedJSON, err: "error decoding token response"},
+		{name: "add key server error", endpoint: AddKey, failure: InternalError, status: http.StatusInternalServerError},
+		{name: "malformed add key", endpoint: AddKey, failure: MalformedJSON, err: "error decoding add key response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			defer s.Close()
+			password := DefaultPassword
+			if tt.password != "" {
+				password = tt.password
+			}
+			client, err := newClient(t, s, DefaultUsername, password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.failure != (Failure{}) {
+				s.Fail(tt.endpoint, tt.failure)
+			}
+
+			_, err = pia.NewPIAWgGenerator(client, pia.PIAWgGeneratorConfig{}).GenerateData()
+			if err == nil {
+				t.Fatal("GenerateData() error = nil")
+			}
+			if tt.status != 0 {
+				var statusErr *pia.StatusError
+				if !errors.As(err, &statusErr) || statusErr.StatusCode != tt.status {
+					t.Errorf("GenerateData() error = %v, want status %d", err, tt.status)
+				}
+			}
+			if tt.err != "" && !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("GenerateData() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestServerListFailures(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Fail(ServerList, Failure{Status: http.StatusBadGateway, Count: 1})
+	var statusErr *pia.StatusError
+	if _, err := newClient(t, s, DefaultUsername, DefaultPassword); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("NewPIAClient() error = %v, want status 502", err)
+	}
+
+	s.Fail(ServerList, Failure{Malformed: true, Count: 1})
+	if _, err := newClient(t, s, DefaultUsername, DefaultPassword); err == nil {
+		t.Error("NewPIAClient() error = nil for malformed server list")
+	}
+
+	// failures with a count run out
+	if _, err := newClient(t, s, DefaultUsername, DefaultPassword); err != nil {
+		t.Errorf("NewPIAClient() error = %v after failures", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	policy := pia.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	client, err := pia.NewPIAClient(DefaultUsername, DefaultPassword, "uk_london", false,
+		append(s.ClientOptions(), pia.WithRetryPolicy(policy))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Fail(GenerateToken, Failure{Status: http.StatusServiceUnavailable, Count: 2})
+	s.Fail(AddKey, Failure{Status: http.StatusInternalServerError, Count: 1})
+	if _, err := pia.NewPIAWgGenerator(client, pia.PIAWgGeneratorConfig{}).GenerateData(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Requests(GenerateToken); got != 3 {
+		t.Errorf("Requests(generateToken) = %d, want 3", got)
+	}
+	if got := s.Requests(AddKey); got != 2 {
+		t.Errorf("Requests(addKey) = %d, want 2", got)
+	}
+
+	// 401s are never retried
+	s.Reset()
+	s.Fail(GenerateToken, Unauthorized)
+	if _, err := client.GetToken(); err == nil {
+		t.Fatal("GetToken() error = nil")
+	}
+	if got := s.Requests(GenerateToken); got != 1 {
+		t.Errorf("Requests(generateToken) = %d after 401, want 1", got)
+	}
+}
+
+func TestSlow(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client, err := newClient(t, s, DefaultUsername, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Fail(GenerateToken, Failure{Delay: 100 * time.Millisecond, Count: 1})
+	start := time.Now()
+	if _, err := client.GetToken(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("GetToken() took %v, want at least 100ms", elapsed)
+	}
+}
+
+func TestSlow_retryDeadline(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	opts := append(s.ClientOptions(), pia.WithRetryPolicy(pia.RetryPolicy{MaxAttempts: 3, Deadline: 200 * time.Millisecond}))
+	client, err := pia.NewPIAClient(DefaultUsername, DefaultPassword, "uk_london", false, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server never answers, the deadline has to cut the attempt short
+	s.Fail(GenerateToken, Slow(time.Hour))
+	start := time.Now()
+	if _, err := client.GetToken(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetToken() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetToken() took %v with a 200ms deadline", elapsed)
+	}
+	if got := s.Requests(GenerateToken); got != 1 {
+		t.Errorf("Requests(generateToken) = %d, want 1", got)
+	}
+}
+
+func TestPortForwarding(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client, err := newClient(t, s, DefaultUsername, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := client.GetToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := client.AddKey(token, s.ServerKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err := client.GetPortForward(token, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pf.Port < 40000 || pf.ServerCN != "london402" || pf.Gateway != "10.0.0.1" || time.Until(pf.ExpiresAt) < 24*time.Hour {
+		t.Errorf("GetPortForward() = %+v", pf)
+	}
+	if err := client.BindPort(pf); err != nil {
+		t.Errorf("BindPort() error = %v", err)
+	}
+
+	forged := pf
+	forged.Signature = "AAAA"
+	if err := client.BindPort(forged); err == nil {
+		t.Error("BindPort() with a forged signature succeeded")
+	}
+	if _, err := client.GetPortForward("wrong", key); err == nil {
+		t.Error("GetPortForward() with a wrong token succeeded")
+	}
+	if _, err := client.GetPortForward(token, pia.AddKeyResult{}); err == nil {
+		t.Error("GetPortForward() without a server succeeded")
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext:     s.DialContext,
+		TLSClientConfig: tlsConfig(t, s),
+	}}
+	if _, err := httpClient.Get("https://nowhere401:443/"); err == nil {
+		t.Error("dialing a server that isn't in the server list succeeded")
+	}
+}
+
+func tlsConfig(t *testing.T, s *Server) *tls.Config {
+	t.Helper()
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(s.CACert()) {
+		t.Fatal("invalid CA certificate")
+	}
+	return &tls.Config{RootCAs: pool}
+}
+
+func getJSON(t *testing.T, client *http.Client, rawURL string, status int, v any) {
+	t.Helper()
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("GET %s status = %d, want %d", rawURL, resp.StatusCode, status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,273 @@
+package piatest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+)
+
+// proxyStandIn records the addresses it is asked to connect to and
+// connects the ones of the fake's servers to the fake
+type proxyStandIn struct {
+	fake *Server
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (p *proxyStandIn) dial(ctx context.Context, addr string) (net.Conn, error) {
+	p.mu.Lock()
+	p.targets = append(p.targets, addr)
+	p.mu.Unlock()
+	if conn, err := p.fake.DialContext(ctx, "tcp", addr); err == nil {
+		return conn, nil
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (p *proxyStandIn) seen() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// newHTTPProxy starts an HTTP proxy handling CONNECT and absolute-form
+// requests, requiring auth as user:password if it isn't empty
+func newHTTPProxy(t *testing.T, p *proxyStandIn, auth string) *url.URL {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			r.RequestURI = ""
+			p.dial(r.Context(), r.URL.Host)
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		upstream, err := p.dial(r.Context(), r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, upstream)
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	if auth != "" {
+		user, password, _ := strings.Cut(auth, ":")
+		u.User = url.UserPassword(user, password)
+	}
+	return u
+}
+
+// newSOCKS5Proxy starts a SOCKS5 proxy without authentication
+func newSOCKS5Proxy(t *testing.T, p *proxyStandIn) *url.URL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(p, conn)
+		}
+	}()
+	return &url.URL{Scheme: "socks5", Host: listener.Addr().String()}
+}
+
+func serveSOCKS5(p *proxyStandIn, conn net.Conn) {
+	// greeting: version, methods; choose no authentication
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		conn.Close()
+		return
+	}
+	io.ReadFull(conn, make([]byte, header[1]))
+	conn.Write([]byte{5, 0})
+
+	// request: version, connect, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		conn.Close()
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n := make([]byte, 1)
+		io.ReadFull(conn, n)
+		name := make([]byte, n[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+
+	upstream, err := p.dial(context.Background(), net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, upstream)
+}
+
+// pipe copies between two connections until either side is done
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+func TestProxy(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy func(t *testing.T, p *proxyStandIn) *url.URL
+		env   bool
+		// serverList is whether the server list download went through the
+		// proxy, loopback addresses are exempt from HTTPS_PROXY
+		serverList bool
+	}{
+		{
+			name:       "http",
+			proxy:      func(t *testing.T, p *proxyStandIn) *url.URL { return newHTTPProxy(t, p, "") },
+			serverList: true,
+		},
+		{
+			name:       "http with auth",
+			proxy:      func(t *testing.T, p *proxyStandIn) *url.URL { return newHTTPProxy(t, p, "proxyuser:proxypass") },
+			serverList: true,
+		},
+		{
+			name:       "socks5",
+			proxy:      newSOCKS5Proxy,
+			serverList: true,
+		},
+		{
+			name:  "HTTPS_PROXY",
+			proxy: func(t *testing.T, p *proxyStandIn) *url.URL { return newHTTPProxy(t, p, "") },
+			env:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			defer s.Close()
+			standIn := &proxyStandIn{fake: s}
+			proxy := tt.proxy(t, standIn)
+
+			opts := []pia.PIAClientOption{
+				pia.WithServerListURL(s.ServerListURL()),
+				pia.WithCACert(s.CACert()),
+				pia.WithRetryPolicy(pia.RetryPolicy{MaxAttempts: 1}),
+			}
+			if tt.env {
+				t.Setenv("HTTPS_PROXY", proxy.String())
+			} else {
+				opts = append(opts, pia.WithProxy(proxy))
+			}
+			client, err := pia.NewPIAClient(DefaultUsername, DefaultPassword, "uk_london", false, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.env {
+				// the environment is only read when the client is created
+				t.Setenv("HTTPS_PROXY", "http://127.0.0.1:1")
+			}
+			data, err := pia.NewPIAWgGenerator(client, pia.PIAWgGeneratorConfig{}).GenerateData()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the fake only knows the server if TLS asked for its common name
+			if data.ServerCN != "london402" || data.ServerIP != "192.0.2.12" {
+				t.Errorf("GenerateData() = %+v", data.AddKeyResult)
+			}
+			seen := standIn.seen()
+			for _, want := range []string{"192.0.2.11:443", "192.0.2.12:1337"} {
+				if !slices.Contains(seen, want) {
+					t.Errorf("proxy connected to %v, want %s among them", seen, want)
+				}
+			}
+			listHost, _ := url.Parse(s.ServerListURL())
+			if got := slices.Contains(seen, listHost.Host); got != tt.serverList {
+				t.Errorf("server list through the proxy = %v, want %v", got, tt.serverList)
+			}
+		})
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	_, err := pia.NewPIAClient(DefaultUsername, DefaultPassword, "uk_london", false,
+		pia.WithServerListURL(s.ServerListURL()), pia.WithProxy(&url.URL{Scheme: "ftp", Host: "proxy:21"}))
+	if err == nil || !strings.Contains(err.Error(), `unsupported proxy scheme "ftp"`) {
+		t.Errorf("NewPIAClient() error = %v for ftp proxy", err)
+	}
+
+	// the proxy wants credentials that weren't given, the server list on a
+	// loopback address is fetched directly
+	proxy := newHTTPProxy(t, &proxyStandIn{fake: s}, "proxyuser:proxypass")
+	proxy.User = nil
+	t.Setenv("HTTPS_PROXY", proxy.String())
+	client, err := pia.NewPIAClient(DefaultUsername, DefaultPassword, "uk_london", false,
+		pia.WithServerListURL(s.ServerListURL()), pia.WithCACert(s.CACert()),
+		pia.WithRetryPolicy(pia.RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetToken()
+	if err == nil || !strings.Contains(err.Error(), "proxy refused to connect to 192.0.2.11:443: 407 Proxy Authentication Required") {
+		t.Errorf("GetToken() error = %v", err)
+	}
+}
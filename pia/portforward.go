@@ -0,0 +1,106 @@
+package pia
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PortBindInterval is how often a forwarded port has to be bound again, PIA
+// releases ports that weren't bound for longer
+const PortBindInterval = 15 * time.Minute
+
+// PortForward is a port a PIA wireguard server forwards to the peer IP of a
+// key registered with it
+type PortForward struct {
+	Port      int
+	ExpiresAt time.Time
+
+	// ServerCN and Gateway are the server that forwards the port and its
+	// address inside the tunnel. Payload and Signature authorize BindPort.
+	ServerCN  string
+	Gateway   string
+	Payload   string
+	Signature string
+}
+
+// portForwardResponse is the response of getSignature and bindPort
+type portForwardResponse struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// GetPortForward requests a forwarded port from the server key was
+// registered with. The request goes to the gateway of the server, so it only
+// works through the tunnel of key. The port has to be bound with BindPort
+// before it forwards anything.
+func (p *PIAClient) GetPortForward(token string, key AddKeyResult) (PortForward, error) {
+	pf := PortForward{ServerCN: key.ServerCN, Gateway: key.ServerVip}
+	if pf.ServerCN == "" || pf.Gateway == "" {
+		return pf, errors.New("the addKey result has no server to request a port from")
+	}
+
+	var resp portForwardResponse
+	if err := p.portForwardRequest(pf, "getSignature?token="+url.QueryEscape(token), &resp); err != nil {
+		return pf, errors.Wrap(err, "error requesting port forward")
+	}
+	pf.Payload, pf.Signature = resp.Payload, resp.Signature
+
+	b, err := base64.StdEncoding.DecodeString(resp.Payload)
+	if err != nil {
+		return pf, errors.Wrap(err, "error decoding port forward payload")
+	}
+	var payload struct {
+		Port      int       `json:"port"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return pf, errors.Wrap(err, "error decoding port forward payload")
+	}
+	pf.Port, pf.ExpiresAt = payload.Port, payload.ExpiresAt
+
+	if p.verbose {
+		logf("Got forwarded port %d from %s, expires %v", pf.Port, pf.ServerCN, pf.ExpiresAt)
+	}
+
+	return pf, nil
+}
+
+// BindPort binds a forwarded port, which activates it and keeps it from being
+// released. It has to be called every PortBindInterval.
+func (p *PIAClient) BindPort(pf PortForward) error {
+	query := "bindPort?payload=" + url.QueryEscape(pf.Payload) + "&signature=" + url.QueryEscape(pf.Signature)
+	var resp portForwardResponse
+	if err := p.portForwardRequest(pf, query, &resp); err != nil {
+		return errors.Wrapf(err, "error binding port %d", pf.Port)
+	}
+
+	return nil
+}
+
+// portForwardRequest sends a port forwarding API request to the gateway of
+// the server of pf
+func (p *PIAClient) portForwardRequest(pf PortForward, query string, v *portForwardResponse) error {
+	ctx := context.WithValue(context.Background(), gatewayKey{}, pf.Gateway)
+	resp, err := p.executePIARequest(ctx, fmt.Sprintf("https://%s:19999/%s", pf.ServerCN, query), tokenAuth)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "error decoding response")
+	}
+	if v.Status != "OK" {
+		return fmt.Errorf("status %s: %s", v.Status, v.Message)
+	}
+
+	return nil
+}
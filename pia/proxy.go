@@ -0,0 +1,147 @@
+package pia
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// WithProxy sends all requests to PIA through proxy, an http://, https://
+// or socks5:// URL, instead of the proxy set by HTTPS_PROXY and HTTP_PROXY
+func WithProxy(proxy *url.URL) PIAClientOption {
+	return func(p *PIAClient) {
+		p.proxy = proxy
+	}
+}
+
+// checkProxy rejects proxies that can't be dialed through
+func checkProxy(proxy *url.URL) error {
+	if proxy == nil {
+		return nil
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", proxy.Scheme)
+	}
+	if proxy.Host == "" {
+		return fmt.Errorf("proxy %q has no host", proxy.Redacted())
+	}
+	return nil
+}
+
+// proxyFor returns the proxy for requests to u, nil to connect directly
+func (p *PIAClient) proxyFor(u *url.URL) (*url.URL, error) {
+	if p.proxy != nil {
+		return p.proxy, nil
+	}
+	return p.envProxy(u)
+}
+
+// environmentProxy resolves the proxy set by HTTPS_PROXY, HTTP_PROXY and
+// NO_PROXY once, when the client is created
+func environmentProxy() func(*url.URL) (*url.URL, error) {
+	return httpproxy.FromEnvironment().ProxyFunc()
+}
+
+// proxyTransport is transport sending requests through the proxy of the
+// client, for requests to hosts that resolve normally
+func (p *PIAClient) proxyTransport(transport *http.Transport) *http.Transport {
+	transport = transport.Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return p.proxyFor(req.URL)
+	}
+	return transport
+}
+
+// dialThroughProxy connects to addr through an http(s) or socks5 proxy.
+// addr is connected to as given, so the pinned server IPs are used rather
+// than having the proxy resolve server common names.
+func dialThroughProxy(ctx context.Context, proxy *url.URL, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		socks, err := xproxy.FromURL(proxy, &dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(xproxy.ContextDialer).DialContext(ctx, network, addr)
+	case "http", "https":
+		return dialConnect(ctx, &dialer, proxy, addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request
+func dialConnect(ctx context.Context, dialer *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// don't wait forever on a proxy that never answers
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "error reading proxy response")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("proxy sent data before the tunnel was used")
+	}
+
+	return conn, nil
+}
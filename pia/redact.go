@@ -0,0 +1,89 @@
+package pia
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sync/atomic"
+)
+
+// Redacted replaces secrets in log output
+const Redacted = "[REDACTED]"
+
+// logSecrets disables redaction, see SetLogSecrets
+var logSecrets atomic.Bool
+
+// SetLogSecrets turns redaction of tokens, passwords and private keys in log
+// output off (true) or back on. Only meant for debugging the PIA API, logs
+// written with it enabled contain credentials.
+func SetLogSecrets(enabled bool) {
+	logSecrets.Store(enabled)
+}
+
+// secretPatterns match secrets in free form text, the first group is kept
+// and the second replaced
+var secretPatterns = []*regexp.Regexp{
+	// credential query parameters: the token of addKey and getSignature
+	// urls, and the payload and signature of bindPort urls, the payload
+	// carries the token too
+	regexp.MustCompile(`([?&](?:pt|token|payload|signature)=)([^&\s"']+)`),
+	// credentials in urls
+	regexp.MustCompile(`(://[^/:@\s]+:)([^/@\s]+)@`),
+	// json fields
+	regexp.MustCompile(`("(?:token|password|private_key|privateKey|secret_id)"\s*:\s*")((?:[^"\\]|\\.)*)"`),
+	// wg-quick config and key=value lines
+	regexp.MustCompile(`(?i)(\b(?:PrivateKey|PresharedKey)\s*=\s*)(\S+)`),
+	regexp.MustCompile(`(?i)(\bpassword=)(\S+)`),
+	// authorization headers
+	regexp.MustCompile(`(?i)(\bAuthorization:\s*(?:Basic|Bearer)\s+)(\S+)`),
+}
+
+// Redact masks tokens, passwords and private keys in s, unless
+// SetLogSecrets(true) was called
+func Redact(s string) string {
+	if logSecrets.Load() {
+		return s
+	}
+
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllStringFunc(s, func(match string) string {
+			m := pattern.FindStringSubmatchIndex(match)
+			// keep the prefix group and anything after the secret
+			return match[:m[3]] + Redacted + match[m[5]:]
+		})
+	}
+	return s
+}
+
+// secret masks a value known to be secret for logging
+func secret(s string) string {
+	if logSecrets.Load() {
+		return s
+	}
+	return Redacted
+}
+
+// logf logs through Redact, all logging of the package goes through it
+func logf(format string, args ...any) {
+	log.Print(Redact(fmt.Sprintf(format, args...)))
+}
+
+// NewRedactingWriter returns a writer that passes every write through
+// Redact, e.g. for log.SetOutput so messages logged outside of this package,
+// like errors carrying request urls, are masked too. Every write is expected
+// to be a whole message, as written by a log.Logger.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return redactingWriter{w}
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
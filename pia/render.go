@@ -0,0 +1,316 @@
+package pia
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultInterfaceName names the interface in formats that declare one when
+// no name is given
+const DefaultInterfaceName = "wg0"
+
+// policyTable and policyMark route a default route through the tunnel the
+// way wg-quick does, with the endpoint traffic marked so it bypasses it
+const (
+	policyTable = 51820
+	policyMark  = 0xca6c
+)
+
+// ParseConvertFormat parses a format configs can be converted to, which
+// besides the generated formats includes the networkd, nmconnection and uci
+// formats of other network managers
+func ParseConvertFormat(s string) (Format, error) {
+	switch format := Format(s); format {
+	case FormatWGQuick, FormatJSON, FormatNetworkd, FormatNMConnection, FormatUCI:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, expected wg-quick, json, networkd, nmconnection or uci", s)
+	}
+}
+
+// RenderConfig renders data in format with the built-in renderers. name is
+// the interface name networkd, nmconnection and uci configs declare. The two
+// networkd units are returned one after the other, see RenderNetworkd to get
+// them separately.
+func RenderConfig(data ConfigData, format Format, name string) (string, error) {
+	if name == "" {
+		name = DefaultInterfaceName
+	}
+
+	switch format {
+	case "", FormatWGQuick:
+		return NewPIAWgGenerator(nil, PIAWgGeneratorConfig{}).Render(data)
+	case FormatJSON:
+		return RenderJSON(data)
+	case FormatNetworkd:
+		netdev, network, err := RenderNetworkd(data, name)
+		if err != nil {
+			return "", err
+		}
+		return "# " + name + ".netdev\n" + netdev + "\n# " + name + ".network\n" + network, nil
+	case FormatNMConnection:
+		return RenderNMConnection(data, name)
+	case FormatUCI:
+		return RenderUCI(data, name)
+	default:
+		return "", fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// RenderNetworkd renders data as a systemd-networkd .netdev and .network unit
+// pair. A default route is routed like wg-quick does, through its own table
+// with a policy rule that keeps the marked wireguard traffic out of it.
+func RenderNetworkd(data ConfigData, name string) (string, string, error) {
+	iface := data.Interface
+	routes, err := peerRoutes(data.Peers)
+	if err != nil {
+		return "", "", err
+	}
+
+	table, policy := "", false
+	switch iface.Table {
+	case "off":
+	case "", "auto":
+		table = "main"
+		if hasDefaultRoute(routes) {
+			table, policy = strconv.Itoa(policyTable), true
+		}
+	default:
+		table = iface.Table
+	}
+	mark := iface.FwMark
+	if policy && mark == 0 {
+		mark = policyMark
+	}
+
+	var netdev strings.Builder
+	fmt.Fprintf(&netdev, "[NetDev]\nName=%s\nKind=wireguard\n", name)
+	if iface.MTU != 0 {
+		fmt.Fprintf(&netdev, "MTUBytes=%d\n", iface.MTU)
+	}
+	fmt.Fprintf(&netdev, "\n[WireGuard]\nPrivateKey=%s\n", data.PrivateKey)
+	if iface.ListenPort != 0 {
+		fmt.Fprintf(&netdev, "ListenPort=%d\n", iface.ListenPort)
+	}
+	if mark != 0 {
+		fmt.Fprintf(&netdev, "FirewallMark=0x%x\n", mark)
+	}
+	if table != "" {
+		fmt.Fprintf(&netdev, "RouteTable=%s\n", table)
+	}
+	for _, peer := range data.Peers {
+		fmt.Fprintf(&netdev, "\n[WireGuardPeer]\nPublicKey=%s\n", peer.PublicKey)
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&netdev, "AllowedIPs=%s\n", strings.Join(peer.AllowedIPs, ","))
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&netdev, "Endpoint=%s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&netdev, "PersistentKeepalive=%d\n", peer.PersistentKeepalive)
+		}
+	}
+
+	var network strings.Builder
+	fmt.Fprintf(&network, "[Match]\nName=%s\n\n[Network]\n", name)
+	for _, addr := range iface.Address {
+		fmt.Fprintf(&network, "Address=%s\n", addr)
+	}
+	for _, dns := range iface.DNS {
+		fmt.Fprintf(&network, "DNS=%s\n", dns)
+	}
+	if len(iface.DNS) > 0 && hasDefaultRoute(routes) {
+		network.WriteString("Domains=~.\n")
+	}
+	if policy {
+		fmt.Fprintf(&network, "\n[RoutingPolicyRule]\nFamily=both\nFirewallMark=0x%x\nInvertRule=true\nTable=%d\nPriority=10\n", mark, policyTable)
+		network.WriteString("\n[RoutingPolicyRule]\nFamily=both\nTable=main\nSuppressPrefixLength=0\nPriority=9\n")
+	}
+
+	return netdev.String(), network.String(), nil
+}
+
+// RenderNMConnection renders data as a NetworkManager keyfile connection
+func RenderNMConnection(data ConfigData, name string) (string, error) {
+	iface := data.Interface
+	var v4, v6 []string
+	for _, addr := range iface.Address {
+		prefix, err := parsePrefix(addr)
+		if err != nil {
+			return "", err
+		}
+		if prefix.Addr().Is4() {
+			v4 = append(v4, prefix.String())
+		} else {
+			v6 = append(v6, prefix.String())
+		}
+	}
+
+	routes, err := peerRoutes(data.Peers)
+	if err != nil {
+		return "", err
+	}
+	routesV6 := slices.ContainsFunc(routes, func(p netip.Prefix) bool { return !p.Addr().Is4() })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[connection]\nid=%s\ntype=wireguard\ninterface-name=%s\n", name, name)
+	fmt.Fprintf(&b, "\n[wireguard]\nprivate-key=%s\n", data.PrivateKey)
+	if iface.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen-port=%d\n", iface.ListenPort)
+	}
+	if iface.FwMark != 0 {
+		fmt.Fprintf(&b, "fwmark=%d\n", iface.FwMark)
+	}
+	if iface.MTU != 0 {
+		fmt.Fprintf(&b, "mtu=%d\n", iface.MTU)
+	}
+	if iface.Table == "off" {
+		b.WriteString("peer-routes=false\n")
+	}
+	for _, peer := range data.Peers {
+		fmt.Fprintf(&b, "\n[wireguard-peer.%s]\n", peer.PublicKey)
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "endpoint=%s\n", peer.Endpoint)
+		}
+		fmt.Fprintf(&b, "allowed-ips=%s\n", nmList(peer.AllowedIPs))
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "persistent-keepalive=%d\n", peer.PersistentKeepalive)
+		}
+	}
+
+	for _, family := range []struct {
+		name  string
+		addrs []string
+		v4    bool
+	}{{"ipv4", v4, true}, {"ipv6", v6, false}} {
+		fmt.Fprintf(&b, "\n[%s]\n", family.name)
+		switch {
+		case len(family.addrs) > 0:
+			b.WriteString("method=manual\n")
+		case !family.v4 && routesV6:
+			// PIA hands out no IPv6 address, but disabling IPv6 would also
+			// drop the peer routes, like the ::/0 of --ipv6 block. manual
+			// requires an address, link-local keeps the routes without one.
+			b.WriteString("method=link-local\n")
+			if table, err := strconv.Atoi(iface.Table); err == nil {
+				fmt.Fprintf(&b, "route-table=%d\n", table)
+			}
+			continue
+		default:
+			b.WriteString("method=disabled\n")
+			continue
+		}
+		for i, addr := range family.addrs {
+			fmt.Fprintf(&b, "address%d=%s\n", i+1, addr)
+		}
+		var dns []string
+		for _, server := range iface.DNS {
+			if addr, err := netip.ParseAddr(server); err == nil && addr.Is4() == family.v4 {
+				dns = append(dns, server)
+			}
+		}
+		if len(dns) > 0 {
+			fmt.Fprintf(&b, "dns=%s\ndns-search=~;\n", nmList(dns))
+		}
+		if table, err := strconv.Atoi(iface.Table); err == nil {
+			fmt.Fprintf(&b, "route-table=%d\n", table)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// nmList formats a keyfile list, every item is terminated by a semicolon
+func nmList(items []string) string {
+	var b strings.Builder
+	for _, item := range items {
+		b.WriteString(item + ";")
+	}
+	return b.String()
+}
+
+// RenderUCI renders data as OpenWrt /etc/config/network sections
+func RenderUCI(data ConfigData, name string) (string, error) {
+	iface := data.Interface
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "config interface %s\n", uciQuote(name))
+	fmt.Fprintf(&b, "\toption proto 'wireguard'\n\toption private_key %s\n", uciQuote(data.PrivateKey))
+	if iface.ListenPort != 0 {
+		fmt.Fprintf(&b, "\toption listen_port '%d'\n", iface.ListenPort)
+	}
+	if iface.MTU != 0 {
+		fmt.Fprintf(&b, "\toption mtu '%d'\n", iface.MTU)
+	}
+	if iface.FwMark != 0 {
+		fmt.Fprintf(&b, "\toption fwmark '0x%x'\n", iface.FwMark)
+	}
+	for _, addr := range iface.Address {
+		prefix, err := parsePrefix(addr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "\tlist addresses %s\n", uciQuote(prefix.String()))
+	}
+	for _, dns := range iface.DNS {
+		fmt.Fprintf(&b, "\tlist dns %s\n", uciQuote(dns))
+	}
+	if table, err := strconv.Atoi(iface.Table); err == nil {
+		fmt.Fprintf(&b, "\toption ip4table '%d'\n\toption ip6table '%d'\n", table, table)
+	}
+
+	for _, peer := range data.Peers {
+		fmt.Fprintf(&b, "\nconfig wireguard_%s\n", name)
+		if data.ServerCN != "" && len(data.Peers) == 1 {
+			fmt.Fprintf(&b, "\toption description %s\n", uciQuote(data.ServerCN))
+		}
+		fmt.Fprintf(&b, "\toption public_key %s\n", uciQuote(peer.PublicKey))
+		if host, port, err := net.SplitHostPort(peer.Endpoint); err == nil {
+			fmt.Fprintf(&b, "\toption endpoint_host %s\n\toption endpoint_port %s\n", uciQuote(host), uciQuote(port))
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "\toption persistent_keepalive '%d'\n", peer.PersistentKeepalive)
+		}
+		if iface.Table == "off" {
+			b.WriteString("\toption route_allowed_ips '0'\n")
+		} else {
+			b.WriteString("\toption route_allowed_ips '1'\n")
+		}
+		for _, allowed := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "\tlist allowed_ips %s\n", uciQuote(allowed))
+		}
+	}
+
+	return b.String(), nil
+}
+
+// uciQuote single quotes a uci value
+func uciQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// peerRoutes parses the AllowedIPs of peers
+func peerRoutes(peers []PeerConfig) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+	for _, peer := range peers {
+		allowed, err := ParsePrefixes(peer.AllowedIPs)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, allowed...)
+	}
+	return routes, nil
+}
+
+func hasDefaultRoute(prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Bits() == 0 {
+			return true
+		}
+	}
+	return false
+}
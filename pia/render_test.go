@@ -0,0 +1,320 @@
+package pia
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConvertConfig = `# pia-wg-config region=uk_london server=london401
+[Interface]
+PrivateKey = ` + testKeyA + `
+Address = 10.1.2.3
+DNS = 10.0.0.243, 10.0.0.242
+MTU = 1420
+PreUp = echo pre
+PostUp = echo up
+[Peer]
+PublicKey = ` + testKeyB + `
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:1337
+PersistentKeepalive = 25
+`
+
+func TestWGQuickConfig_ConfigData(t *testing.T) {
+	config, err := ParseWGQuick(strings.NewReader(testConvertConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := config.ConfigData()
+	if err != nil {
+		t.Fatalf("ConfigData() error = %v", err)
+	}
+	want := ConfigData{
+		AddKeyResult: AddKeyResult{
+			ServerKey:  testKeyB,
+			ServerPort: 1337,
+			ServerIP:   "1.2.3.4",
+			PeerIP:     "10.1.2.3",
+			DNSServers: []string{"10.0.0.243", "10.0.0.242"},
+			Region:     "uk_london",
+			ServerCN:   "london401",
+		},
+		PrivateKey: testKeyA,
+		PublicKey:  "QElQLbksojQsP5LaxdbefIXbXfVAeltJls458u+36Cc=",
+		Interface: InterfaceConfig{
+			Address: []string{"10.1.2.3"},
+			DNS:     []string{"10.0.0.243", "10.0.0.242"},
+			MTU:     1420,
+			PostUp:  []string{"echo up"},
+		},
+		Peers: []PeerConfig{{
+			PublicKey:           testKeyB,
+			Endpoint:            "1.2.3.4:1337",
+			AllowedIPs:          []string{"0.0.0.0/0"},
+			PersistentKeepalive: 25,
+		}},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("ConfigData() =\n%+v\nwant\n%+v", data, want)
+	}
+
+	if got := config.UnsupportedKeys(FormatJSON); !reflect.DeepEqual(got, []string{"PreUp"}) {
+		t.Errorf("UnsupportedKeys(json) = %v", got)
+	}
+	if got := config.UnsupportedKeys(FormatNetworkd); !reflect.DeepEqual(got, []string{"PreUp", "PostUp"}) {
+		t.Errorf("UnsupportedKeys(networkd) = %v", got)
+	}
+}
+
+func TestWGQuickConfig_ConfigData_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "no interface", text: "[Peer]\nPublicKey = " + testKeyB},
+		{name: "bad private key", text: "[Interface]\nPrivateKey = nope\nAddress = 10.1.2.3"},
+		{name: "no address", text: "[Interface]\nPrivateKey = " + testKeyA},
+		{name: "bad mtu", text: "[Interface]\nPrivateKey = " + testKeyA + "\nAddress = 10.1.2.3\nMTU = big"},
+		{name: "peer without key", text: "[Interface]\nPrivateKey = " + testKeyA + "\nAddress = 10.1.2.3\n[Peer]\nEndpoint = 1.2.3.4:1337"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseWGQuick(strings.NewReader(tt.text))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := config.ConfigData(); err == nil {
+				t.Error("ConfigData() error = nil")
+			}
+		})
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	config, err := ParseWGQuick(strings.NewReader(testConvertConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := config.ConfigData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{
+			format: FormatNMConnection,
+			want: `[connection]
+id=pia0
+type=wireguard
+interface-name=pia0
+
+[wireguard]
+private-key=` + testKeyA + `
+mtu=1420
+
+[wireguard-peer.` + testKeyB + `]
+endpoint=1.2.3.4:1337
+allowed-ips=0.0.0.0/0;
+persistent-keepalive=25
+
+[ipv4]
+method=manual
+address1=10.1.2.3/32
+dns=10.0.0.243;10.0.0.242;
+dns-search=~;
+
+[ipv6]
+method=disabled
+`,
+		},
+		{
+			format: FormatUCI,
+			want: `config interface 'pia0'
+	option proto 'wireguard'
+	option private_key '` + testKeyA + `'
+	option mtu '1420'
+	list addresses '10.1.2.3/32'
+	list dns '10.0.0.243'
+	list dns '10.0.0.242'
+
+config wireguard_pia0
+	option description 'london401'
+	option public_key '` + testKeyB + `'
+	option endpoint_host '1.2.3.4'
+	option endpoint_port '1337'
+	option persistent_keepalive '25'
+	option route_allowed_ips '1'
+	list allowed_ips '0.0.0.0/0'
+`,
+		},
+		{
+			format: FormatWGQuick,
+			want: `# pia-wg-config region=uk_london server=london401
+[Interface]
+PrivateKey = ` + testKeyA + `
+Address = 10.1.2.3
+DNS = 10.0.0.243, 10.0.0.242
+MTU = 1420
+PostUp = echo up
+[Peer]
+PublicKey = ` + testKeyB + `
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:1337
+PersistentKeepalive = 25`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			got, err := RenderConfig(data, tt.format, "pia0")
+			if err != nil {
+				t.Fatalf("RenderConfig() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("RenderConfig() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderConfig_blockIPv6(t *testing.T) {
+	generated, err := NewPIAWgGenerator(&PIAClientMock{}, PIAWgGeneratorConfig{
+		PrivateKey: testKeyA,
+		PublicKey:  testKeyB,
+		IPv6Mode:   IPv6ModeBlock,
+		IPv6Sysctl: true,
+	}).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseWGQuick(strings.NewReader(generated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := config.ConfigData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every format keeps ::/0 routed into the tunnel
+	tests := []struct {
+		format      Format
+		want        []string
+		dropsSysctl bool
+	}{
+		{format: FormatWGQuick, want: []string{"AllowedIPs = 0.0.0.0/0, ::/0", "PostUp = " + ipv6SysctlUp}},
+		{format: FormatJSON, want: []string{`"::/0"`, ipv6SysctlUp}},
+		{format: FormatNetworkd, want: []string{"AllowedIPs=0.0.0.0/0,::/0"}, dropsSysctl: true},
+		{format: FormatNMConnection, want: []string{"allowed-ips=0.0.0.0/0;::/0;", "[ipv6]\nmethod=link-local\n"}, dropsSysctl: true},
+		{format: FormatUCI, want: []string{"list allowed_ips '::/0'", "option route_allowed_ips '1'"}, dropsSysctl: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			got, err := RenderConfig(data, tt.format, "pia0")
+			if err != nil {
+				t.Fatalf("RenderConfig() error = %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("RenderConfig() =\n%s\nwant it to contain %q", got, want)
+				}
+			}
+			if drops := config.DropsIPv6Sysctl(tt.format); drops != tt.dropsSysctl {
+				t.Errorf("DropsIPv6Sysctl() = %v, want %v", drops, tt.dropsSysctl)
+			}
+		})
+	}
+}
+
+func TestRenderNetworkd(t *testing.T) {
+	tests := []struct {
+		name        string
+		table       string
+		allowedIPs  []string
+		wantNetdev  []string
+		wantNetwork []string
+		notNetwork  []string
+	}{
+		{
+			name:        "default route uses policy routing",
+			allowedIPs:  []string{"0.0.0.0/0"},
+			wantNetdev:  []string{"Name=pia0\n", "FirewallMark=0xca6c\n", "RouteTable=51820\n", "AllowedIPs=0.0.0.0/0\n"},
+			wantNetwork: []string{"Address=10.1.2.3\n", "DNS=10.0.0.243\n", "Domains=~.\n", "InvertRule=true\n", "SuppressPrefixLength=0\n"},
+		},
+		{
+			name:        "split tunnel routes in main",
+			allowedIPs:  []string{"10.0.0.0/8", "192.168.0.0/16"},
+			wantNetdev:  []string{"RouteTable=main\n", "AllowedIPs=10.0.0.0/8,192.168.0.0/16\n"},
+			notNetwork:  []string{"RoutingPolicyRule", "Domains"},
+			wantNetwork: []string{"Address=10.1.2.3\n"},
+		},
+		{
+			name:       "table off",
+			table:      "off",
+			allowedIPs: []string{"0.0.0.0/0"},
+			notNetwork: []string{"RoutingPolicyRule"},
+		},
+		{
+			name:        "custom table",
+			table:       "1234",
+			allowedIPs:  []string{"0.0.0.0/0"},
+			wantNetdev:  []string{"RouteTable=1234\n"},
+			notNetwork:  []string{"RoutingPolicyRule"},
+			wantNetwork: []string{"Domains=~.\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := ConfigData{
+				PrivateKey: testKeyA,
+				Interface: InterfaceConfig{
+					Address: []string{"10.1.2.3"},
+					DNS:     []string{"10.0.0.243"},
+					Table:   tt.table,
+				},
+				Peers: []PeerConfig{{PublicKey: testKeyB, Endpoint: "1.2.3.4:1337", AllowedIPs: tt.allowedIPs}},
+			}
+
+			netdev, network, err := RenderNetworkd(data, "pia0")
+			if err != nil {
+				t.Fatalf("RenderNetworkd() error = %v", err)
+			}
+			for _, want := range tt.wantNetdev {
+				if !strings.Contains(netdev, want) {
+					t.Errorf("netdev doesn't contain %q:\n%s", want, netdev)
+				}
+			}
+			if tt.table == "off" && strings.Contains(netdev, "RouteTable") {
+				t.Errorf("netdev sets RouteTable with Table = off:\n%s", netdev)
+			}
+			for _, want := range tt.wantNetwork {
+				if !strings.Contains(network, want) {
+					t.Errorf("network doesn't contain %q:\n%s", want, network)
+				}
+			}
+			for _, unwanted := range tt.notNetwork {
+				if strings.Contains(network, unwanted) {
+					t.Errorf("network contains %q:\n%s", unwanted, network)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConvertFormat(t *testing.T) {
+	for _, s := range []string{"wg-quick", "json", "networkd", "nmconnection", "uci"} {
+		if _, err := ParseConvertFormat(s); err != nil {
+			t.Errorf("ParseConvertFormat(%q) error = %v", s, err)
+		}
+	}
+	if _, err := ParseConvertFormat("ini"); err == nil {
+		t.Error("ParseConvertFormat(ini) error = nil")
+	}
+	if _, err := ParseFormat("networkd"); err == nil {
+		t.Error("ParseFormat(networkd) error = nil, generated configs are wg-quick or json")
+	}
+}
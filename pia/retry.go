@@ -0,0 +1,208 @@
+package pia
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how requests to PIA are retried after network errors
+// and 429, 500, 502, 503 and 504 responses. 401s and other client errors are
+// never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent, 1 disables
+	// retries
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, doubling for every
+	// retry after it
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff between two attempts
+	MaxDelay time.Duration
+	// Deadline is how long a request may take over all attempts before it is
+	// given up on, including an attempt still waiting for a response, 0 for
+	// no limit
+	Deadline time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of a PIAClient without
+// WithRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	Deadline:    time.Minute,
+}
+
+// WithRetryPolicy retries requests to PIA according to policy
+func WithRetryPolicy(policy RetryPolicy) PIAClientOption {
+	return func(p *PIAClient) {
+		p.retryPolicy = policy
+	}
+}
+
+// retryTransport is a RoundTripper retrying requests with exponential
+// backoff and jitter, honoring Retry-After on 429 and 503 responses
+type retryTransport struct {
+	next    http.RoundTripper
+	policy  RetryPolicy
+	verbose bool
+
+	// sleep and jitter are replaced in tests
+	sleep  func(ctx context.Context, d time.Duration) error
+	jitter func(d time.Duration) time.Duration
+}
+
+func newRetryTransport(next http.RoundTripper, policy RetryPolicy, verbose bool) *retryTransport {
+	return &retryTransport{
+		next:    next,
+		policy:  policy,
+		verbose: verbose,
+		sleep:   sleepContext,
+		jitter:  equalJitter,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	if t.policy.Deadline > 0 {
+		// bound every attempt, not only the backoff between them, so a
+		// server that never answers can't hold the request past the deadline
+		ctx, cancel := context.WithDeadline(req.Context(), start.Add(t.policy.Deadline))
+		resp, err := t.roundTrip(req.WithContext(ctx), start)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = cancelBody{resp.Body, cancel}
+		return resp, nil
+	}
+	return t.roundTrip(req, start)
+}
+
+func (t *retryTransport) roundTrip(req *http.Request, start time.Time) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.policy.MaxAttempts || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if after, ok := retryAfter(resp); ok {
+			delay = after
+		}
+		if t.policy.Deadline > 0 && time.Since(start)+delay > t.policy.Deadline {
+			return resp, err
+		}
+
+		if t.verbose {
+			reason := "error: " + errString(err)
+			if resp != nil {
+				reason = "status: " + resp.Status
+			}
+			logf("Retrying %s in %v after %s", req.URL, delay.Round(time.Millisecond), reason)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err := t.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// cancelBody releases the deadline of a request once its response body is
+// closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// backoff is the jittered delay before retry n, starting at 1
+func (t *retryTransport) backoff(n int) time.Duration {
+	delay := t.policy.BaseDelay
+	for i := 1; i < n && delay < t.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if t.policy.MaxDelay > 0 && delay > t.policy.MaxDelay {
+		delay = t.policy.MaxDelay
+	}
+	return t.jitter(delay)
+}
+
+// retryable reports whether a request is worth sending again
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		// the caller gave up, it isn't the server failing
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay a 429 or 503 response asks for
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// equalJitter picks a delay between d/2 and d, so clients retrying together
+// spread out without retrying right away
+func equalJitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
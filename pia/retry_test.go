@@ -0,0 +1,182 @@
+package pia
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fault is one scripted outcome of faultTransport
+type fault struct {
+	status     int
+	retryAfter string
+	err        error
+}
+
+// faultTransport answers requests with scripted faults, then 200s
+type faultTransport struct {
+	faults   []fault
+	requests int
+}
+
+func (f *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.requests++
+	if len(f.faults) == 0 {
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+	}
+	next := f.faults[0]
+	f.faults = f.faults[1:]
+	if next.err != nil {
+		return nil, next.err
+	}
+	header := http.Header{}
+	if next.retryAfter != "" {
+		header.Set("Retry-After", next.retryAfter)
+	}
+	return &http.Response{StatusCode: next.status, Status: http.StatusText(next.status), Header: header, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: 250 * time.Millisecond}
+	connReset := errors.New("connection reset by peer")
+
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		faults   []fault
+		status   int
+		err      error
+		requests int
+		delays   []time.Duration
+	}{
+		{
+			name:     "success",
+			policy:   policy,
+			status:   200,
+			requests: 1,
+		},
+		{
+			name:     "exponential backoff",
+			policy:   policy,
+			faults:   []fault{{status: 500}, {status: 502}, {err: connReset}},
+			status:   200,
+			requests: 4,
+			delays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond},
+		},
+		{
+			name:     "gives up after max attempts",
+			policy:   policy,
+			faults:   []fault{{status: 500}, {status: 500}, {status: 500}, {status: 500}, {status: 500}},
+			status:   500,
+			requests: 4,
+			delays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond},
+		},
+		{
+			name:     "last network error is returned",
+			policy:   RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond},
+			faults:   []fault{{err: connReset}, {err: connReset}},
+			err:      connReset,
+			requests: 2,
+			delays:   []time.Duration{time.Millisecond},
+		},
+		{
+			name:     "never retries 401",
+			policy:   policy,
+			faults:   []fault{{status: 401}},
+			status:   401,
+			requests: 1,
+		},
+		{
+			name:     "client errors aren't retried",
+			policy:   policy,
+			faults:   []fault{{status: 404}},
+			status:   404,
+			requests: 1,
+		},
+		{
+			name:     "retry-after seconds on 429",
+			policy:   policy,
+			faults:   []fault{{status: 429, retryAfter: "3"}},
+			status:   200,
+			requests: 2,
+			delays:   []time.Duration{3 * time.Second},
+		},
+		{
+			name:     "retry-after on 503",
+			policy:   policy,
+			faults:   []fault{{status: 503, retryAfter: "1"}, {status: 503}},
+			status:   200,
+			requests: 3,
+			delays:   []time.Duration{time.Second, 200 * time.Millisecond},
+		},
+		{
+			name:     "retry-after beyond the deadline",
+			policy:   RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, Deadline: 2 * time.Second},
+			faults:   []fault{{status: 429, retryAfter: "30"}},
+			status:   429,
+			requests: 1,
+		},
+		{
+			name:     "retries disabled",
+			policy:   RetryPolicy{MaxAttempts: 1},
+			faults:   []fault{{status: 503}},
+			status:   503,
+			requests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			faults := &faultTransport{faults: tt.faults}
+			var delays []time.Duration
+			transport := newRetryTransport(faults, tt.policy, false)
+			transport.jitter = func(d time.Duration) time.Duration { return d }
+			transport.sleep = func(ctx context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				return nil
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "https://london401/authv3/generateToken", nil)
+			resp, err := transport.RoundTrip(req)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("RoundTrip() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && resp.StatusCode != tt.status {
+				t.Errorf("RoundTrip() status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if faults.requests != tt.requests {
+				t.Errorf("sent %d requests, want %d", faults.requests, tt.requests)
+			}
+			if !reflect.DeepEqual(delays, tt.delays) {
+				t.Errorf("slept %v, want %v", delays, tt.delays)
+			}
+		})
+	}
+}
+
+func TestRetryTransport_canceled(t *testing.T) {
+	faults := &faultTransport{faults: []fault{{status: 503}, {status: 503}}}
+	transport := newRetryTransport(faults, RetryPolicy{MaxAttempts: 4, BaseDelay: time.Hour}, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://london401/", nil)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("RoundTrip() error = %v, want context.Canceled", err)
+	}
+	if faults.requests != 1 {
+		t.Errorf("sent %d requests, want 1", faults.requests)
+	}
+}
+
+func TestEqualJitter(t *testing.T) {
+	for range 100 {
+		if d := equalJitter(time.Second); d < 500*time.Millisecond || d >= time.Second {
+			t.Fatalf("equalJitter(1s) = %v", d)
+		}
+	}
+}
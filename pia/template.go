@@ -0,0 +1,238 @@
+package pia
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ConfigData is the data model every config is rendered from. The built-in
+// wg-quick template and user supplied templates (--template) are executed
+// against it, so fields are only ever added, never renamed or removed.
+//
+// The fields of the addKey response are promoted, so templates can use
+// {{.ServerKey}}, {{.ServerIP}}, {{.PeerIP}}, {{.DNSServers}} and friends
+// directly.
+type ConfigData struct {
+	AddKeyResult
+
+	// PrivateKey and PublicKey are the local wireguard keypair.
+	PrivateKey string
+	PublicKey  string
+
+	// GeneratedAt is the UTC time the config was generated.
+	GeneratedAt time.Time
+
+	// Interface and Peers hold the options chosen for this config.
+	Interface InterfaceConfig
+	Peers     []PeerConfig
+
+	// Alternates are other servers of the region the key was registered
+	// with, for clients that fail over between endpoints (--peers).
+	Alternates []Alternate
+}
+
+// Alternate is another server the public key was registered with. Every
+// server assigns its own peer IP, so failing over means switching Address
+// and DNS along with the peer.
+type Alternate struct {
+	AddKeyResult
+
+	Address []string
+	DNS     []string
+	Peer    PeerConfig
+}
+
+// InterfaceConfig holds the [Interface] options of a config.
+type InterfaceConfig struct {
+	Address    []string
+	DNS        []string
+	MTU        int
+	Table      string
+	FwMark     uint32
+	ListenPort int
+	PostUp     []string
+	PreDown    []string
+}
+
+// PeerConfig holds the [Peer] options of a config.
+type PeerConfig struct {
+	PublicKey           string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// TemplateFuncs are the helper functions available to config templates.
+//
+//	join   {{join ", " .DNSServers}}  joins a list with a separator
+//	base64 {{base64 .PrivateKey}}     base64 encodes a string
+//	cidr   {{cidr .PeerIP 32}}        appends a prefix length to an address
+var TemplateFuncs = template.FuncMap{
+	"join": func(sep string, elems []string) string {
+		return strings.Join(elems, sep)
+	},
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"cidr": func(addr string, bits int) (string, error) {
+		addr, _, _ = strings.Cut(addr, "/")
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return "", err
+		}
+		if bits < 0 || bits > ip.BitLen() {
+			return "", fmt.Errorf("invalid prefix length %d for %v", bits, ip)
+		}
+		return netip.PrefixFrom(ip, bits).String(), nil
+	},
+}
+
+// TemplateError is a template parse or execution error with its position in
+// the template source.
+type TemplateError struct {
+	Name   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Name, e.Line, e.Column, e.Msg)
+}
+
+// ParseConfigTemplate parses a user supplied config template. Parse errors are
+// returned as a *TemplateError pointing at the offending line and column.
+func ParseConfigTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(TemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, newTemplateError(name, text, err)
+	}
+
+	return tmpl, nil
+}
+
+var (
+	templateErrorPosition = regexp.MustCompile(`^template: .*?:(\d+):(?:(\d+):)? (.*)$`)
+	templateErrorToken    = regexp.MustCompile(`"([^"]+)"|<([^>]+)>|(\{\{[^}]*\}\})`)
+
+	// templateErrorNamedTokens are tokens text/template names rather than
+	// quotes, in the order they are looked up
+	templateErrorNamedTokens = [][2]string{
+		{"left paren", "("},
+		{"right paren", ")"},
+		{"left delim", "{{"},
+		{"right delim", "}}"},
+	}
+)
+
+// newTemplateError converts a text/template error into a *TemplateError.
+// Execution errors already carry a column; for parse errors the column is
+// recovered by locating the token named in the message on the reported line.
+func newTemplateError(name, text string, err error) error {
+	m := templateErrorPosition.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+
+	line, _ := strconv.Atoi(m[1])
+	msg := m[3]
+	column := templateErrorColumn(text, line, msg)
+	if m[2] != "" {
+		// execution errors carry a zero based byte offset
+		column, _ = strconv.Atoi(m[2])
+		column++
+	}
+
+	return &TemplateError{Name: name, Line: line, Column: column, Msg: msg}
+}
+
+// templateErrorColumn returns the one based column of the token a parse error
+// message names on the given line, falling back to the line's first action
+func templateErrorColumn(text string, line int, msg string) int {
+	lines := strings.Split(text, "\n")
+	if line < 1 || line > len(lines) {
+		return 1
+	}
+	src := lines[line-1]
+
+	if strings.Contains(msg, "unexpected EOF") {
+		return len(src) + 1
+	}
+	var needles []string
+	for _, tok := range templateErrorToken.FindAllStringSubmatch(msg, -1) {
+		needles = append(needles, tok[1]+tok[2]+tok[3])
+	}
+	for _, named := range templateErrorNamedTokens {
+		if strings.Contains(msg, named[0]) {
+			needles = append(needles, named[1])
+		}
+	}
+	for _, needle := range needles {
+		if i := strings.Index(src, needle); i >= 0 {
+			return i + 1
+		}
+	}
+	if i := strings.Index(src, "{{"); i >= 0 {
+		return i + 1
+	}
+
+	return 1
+}
+
+var wireguardConfigTemplate = `
+{{- if .Region}}# pia-wg-config region={{.Region}} server={{.ServerCN}}
+{{end -}}
+[Interface]
+PrivateKey = {{.PrivateKey}}
+Address = {{join ", " .Interface.Address}}
+{{- if .Interface.DNS}}
+DNS = {{join ", " .Interface.DNS}}
+{{- end}}
+{{- if .Interface.MTU}}
+MTU = {{.Interface.MTU}}
+{{- end}}
+{{- if .Interface.Table}}
+Table = {{.Interface.Table}}
+{{- end}}
+{{- if .Interface.FwMark}}
+FwMark = {{printf "0x%x" .Interface.FwMark}}
+{{- end}}
+{{- if .Interface.ListenPort}}
+ListenPort = {{.Interface.ListenPort}}
+{{- end}}
+{{- range .Interface.PostUp}}
+PostUp = {{.}}
+{{- end}}
+{{- range .Interface.PreDown}}
+PreDown = {{.}}
+{{- end}}
+{{- range .Peers}}
+[Peer]
+PublicKey = {{.PublicKey}}
+AllowedIPs = {{join ", " .AllowedIPs}}
+Endpoint = {{.Endpoint}}
+{{- if .PersistentKeepalive}}
+PersistentKeepalive = {{.PersistentKeepalive}}
+{{- end}}
+{{- end}}
+{{- range .Alternates}}
+
+# Alternate server {{.ServerCN}}, fail over by switching to
+# Address = {{join ", " .Address}}
+{{- if .DNS}}
+# DNS = {{join ", " .DNS}}
+{{- end}}
+# [Peer]
+# PublicKey = {{.Peer.PublicKey}}
+# AllowedIPs = {{join ", " .Peer.AllowedIPs}}
+# Endpoint = {{.Peer.Endpoint}}
+{{- if .Peer.PersistentKeepalive}}
+# PersistentKeepalive = {{.Peer.PersistentKeepalive}}
+{{- end}}
+{{- end}}`
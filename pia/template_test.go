@@ -0,0 +1,98 @@
+package pia
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPIAWgGenerator_Generate_template(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "addKey fields and helpers",
+			template: `{{.PeerIP}} {{cidr .PeerIP 32}} {{join "," .DNSServers}} {{base64 .PublicKey}}`,
+			want:     `4.5.6.7 4.5.6.7/32 1.1.1.1 dGVzdF9wdWJsaWNrZXk=`,
+		},
+		{
+			name:     "options",
+			template: `{{range .Peers}}{{.Endpoint}} {{join "," .AllowedIPs}} {{.PersistentKeepalive}}{{end}}`,
+			want:     `1.2.3.4:1337 0.0.0.0/0 25`,
+		},
+		{
+			name:     "unknown field",
+			template: "line one\n  {{.Nope}}",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseConfigTemplate("test.tmpl", tt.template)
+			if err != nil {
+				t.Fatalf("ParseConfigTemplate() error = %v", err)
+			}
+			p := NewPIAWgGenerator(&PIAClientMock{}, PIAWgGeneratorConfig{
+				PrivateKey: "test_privatekey",
+				PublicKey:  "test_publickey",
+				Template:   tmpl,
+			})
+			got, err := p.Generate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PIAWgGenerator.Generate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				var templateErr *TemplateError
+				if !errors.As(err, &templateErr) || templateErr.Line != 2 || templateErr.Column != 5 {
+					t.Errorf("PIAWgGenerator.Generate() error = %v, want test.tmpl:2:5", err)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("PIAWgGenerator.Generate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigTemplate_errorPosition(t *testing.T) {
+	tests := []struct {
+		name       string
+		template   string
+		wantLine   int
+		wantColumn int
+	}{
+		{
+			name:       "undefined function",
+			template:   "[Interface]\nAddress = {{nope .PeerIP}}",
+			wantLine:   2,
+			wantColumn: 13,
+		},
+		{
+			name:       "bad operand",
+			template:   "[Interface]\n\nDNS = {{join \", \" .DNSServers)}}",
+			wantLine:   3,
+			wantColumn: 30,
+		},
+		{
+			name:       "unclosed if",
+			template:   "{{if .PeerIP}}\nAddress = {{.PeerIP}}",
+			wantLine:   2,
+			wantColumn: 22,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfigTemplate("test.tmpl", tt.template)
+			var templateErr *TemplateError
+			if !errors.As(err, &templateErr) {
+				t.Fatalf("ParseConfigTemplate() error = %v, want *TemplateError", err)
+			}
+			if templateErr.Line != tt.wantLine || templateErr.Column != tt.wantColumn {
+				t.Errorf("ParseConfigTemplate() error = %v, want line %d column %d", err, tt.wantLine, tt.wantColumn)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package pia
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// transports are the long-lived HTTP clients of a PIAClient. They are shared
+// with the clients ForRegion returns, so connections are kept alive and
+// reused across requests and regions.
+type transports struct {
+	// web fetches the server list and CA certificate from public hosts
+	web *http.Client
+
+	mu  sync.Mutex
+	api *http.Client
+
+	// ips maps server common names to the IPs they are dialed at
+	ipsMu sync.RWMutex
+	ips   map[string]string
+}
+
+func newTransports(p *PIAClient) *transports {
+	return &transports{
+		web: p.httpClient(p.proxyTransport(http.DefaultTransport.(*http.Transport))),
+	}
+}
+
+func (t *transports) setServerIPs(ips map[string]string) {
+	t.ipsMu.Lock()
+	defer t.ipsMu.Unlock()
+	t.ips = ips
+}
+
+func (t *transports) serverIP(cn string) (string, bool) {
+	t.ipsMu.RLock()
+	defer t.ipsMu.RUnlock()
+	ip, ok := t.ips[cn]
+	return ip, ok
+}
+
+// apiClient returns the client for requests to PIA servers, creating it
+// with the PIA CA on first use
+func (p *PIAClient) apiClient() (*http.Client, error) {
+	t := p.transports
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.api != nil {
+		return t.api, nil
+	}
+
+	caCert, err := p.downloadPIACertificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "error downloading ca certificate")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("invalid ca certificate")
+	}
+
+	dial := p.dialServer
+	if p.dialContext != nil {
+		dial = p.dialContext
+	}
+	t.api = p.httpClient(&http.Transport{
+		// requests address servers by common name, which TLS verifies the
+		// certificate against, while dialing connects to their IPs
+		TLSClientConfig:     &tls.Config{RootCAs: pool},
+		DialContext:         dial,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	})
+	return t.api, nil
+}
+
+// gatewayKey is the context key of the gateway IP requests to a server are
+// sent to instead of the IP of the server list, see GetPortForward
+type gatewayKey struct{}
+
+// dialServer connects to addr of a PIA server at the IP the server list
+// gives for its common name, through the proxy for it if there is one
+func (p *PIAClient) dialServer(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	// the gateway of a server is only reachable through its tunnel
+	if gateway, ok := ctx.Value(gatewayKey{}).(string); ok {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(gateway, port))
+	}
+
+	ip, ok := p.transports.serverIP(host)
+	if !ok {
+		return nil, fmt.Errorf("unknown PIA server %s", host)
+	}
+	target := net.JoinHostPort(ip, port)
+
+	proxy, err := p.proxyFor(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		return dialThroughProxy(ctx, proxy, network, target)
+	}
+
+	return dialer.DialContext(ctx, network, target)
+}
+
+// serverIPs maps the common names of all servers to their IPs
+func serverIPs(lists ...ServerList) map[string]string {
+	ips := map[string]string{}
+	for _, list := range lists {
+		for _, servers := range list {
+			for _, server := range servers {
+				ips[server.Cn] = server.IP
+			}
+		}
+	}
+	return ips
+}
+
+// drainAndClose reads what is left of a response body, up to a limit, so its
+// connection can be reused
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
@@ -0,0 +1,271 @@
+package pia
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Severity of a Diagnostic
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a problem found on a line of a wg-quick config
+type Diagnostic struct {
+	Line     int
+	Severity Severity
+	Msg      string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("line %d: %s: %s", d.Line, d.Severity, d.Msg)
+}
+
+// wgQuickKeys are the keys wg-quick understands in each section, by lower
+// case name
+var wgQuickKeys = map[string]map[string]bool{
+	"interface": {
+		"privatekey": true, "address": true, "dns": true, "mtu": true, "table": true,
+		"fwmark": true, "listenport": true, "preup": true, "postup": true,
+		"predown": true, "postdown": true, "saveconfig": true,
+	},
+	"peer": {
+		"publickey": true, "presharedkey": true, "endpoint": true,
+		"allowedips": true, "persistentkeepalive": true,
+	},
+}
+
+// Validate checks a config for mistakes wg-quick or the kernel would reject
+// or silently misroute: key encodings, addresses and CIDRs, endpoints,
+// numeric options, duplicate peers and AllowedIPs claimed by more than one
+// peer. Unknown keys and sections are reported as warnings.
+func (c *WGQuickConfig) Validate() []Diagnostic {
+	v := &validator{}
+
+	var ifaces []*WGQuickSection
+	for _, section := range c.Sections {
+		switch strings.ToLower(section.Name) {
+		case "":
+		case "interface":
+			ifaces = append(ifaces, section)
+			v.validateInterface(section)
+		case "peer":
+			v.validatePeer(section)
+		default:
+			v.warn(section.Line, "unknown section [%s]", section.Name)
+		}
+	}
+
+	switch {
+	case len(ifaces) == 0:
+		v.error(1, "missing [Interface] section")
+	case len(ifaces) > 1:
+		v.error(ifaces[1].Line, "duplicate [Interface] section, first on line %d", ifaces[0].Line)
+	}
+
+	sort.SliceStable(v.diagnostics, func(i, j int) bool {
+		return v.diagnostics[i].Line < v.diagnostics[j].Line
+	})
+	return v.diagnostics
+}
+
+type validator struct {
+	diagnostics []Diagnostic
+
+	// peerKeys and routes remember where peers and their AllowedIPs were
+	// first seen
+	peerKeys map[string]int
+	routes   []peerRoute
+}
+
+type peerRoute struct {
+	prefix netip.Prefix
+	line   int
+	peer   int
+}
+
+func (v *validator) error(line int, format string, args ...any) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{Line: line, Severity: SeverityError, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warn(line int, format string, args ...any) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{Line: line, Severity: SeverityWarning, Msg: fmt.Sprintf(format, args...)})
+}
+
+// validateKeys reports unknown and repeated keys of a section. Hooks,
+// Address, DNS and AllowedIPs may be repeated.
+func (v *validator) validateKeys(section *WGQuickSection, repeatable ...string) {
+	known := wgQuickKeys[strings.ToLower(section.Name)]
+	seen := map[string]int{}
+	for _, line := range section.Lines {
+		if line.Key == "" {
+			continue
+		}
+		key := strings.ToLower(line.Key)
+		if !known[key] {
+			v.warn(line.Line, "unknown key %s in [%s]", line.Key, section.Name)
+			continue
+		}
+		if first, ok := seen[key]; ok && !containsFold(repeatable, key) {
+			v.error(line.Line, "duplicate %s, first set on line %d", line.Key, first)
+		}
+		seen[key] = line.Line
+	}
+}
+
+func (v *validator) validateInterface(section *WGQuickSection) {
+	v.validateKeys(section, "address", "dns", "preup", "postup", "predown", "postdown")
+	if !section.Has("PrivateKey") {
+		v.error(section.Line, "[Interface] is missing PrivateKey")
+	}
+
+	for _, line := range section.Lines {
+		switch strings.ToLower(line.Key) {
+		case "privatekey":
+			v.validateKey(line, "PrivateKey")
+		case "address":
+			for _, addr := range splitList(line.Value) {
+				if _, err := parsePrefix(addr); err != nil {
+					v.error(line.Line, "invalid Address %q", addr)
+				}
+			}
+		case "dns":
+			if len(splitList(line.Value)) == 0 {
+				v.error(line.Line, "empty DNS")
+			}
+		case "mtu":
+			v.validateInt(line, 576, 65535)
+		case "listenport":
+			v.validateInt(line, 0, 65535)
+		case "fwmark":
+			if line.Value != "off" {
+				if _, err := strconv.ParseUint(line.Value, 0, 32); err != nil {
+					v.error(line.Line, "invalid FwMark %q, expected a number or off", line.Value)
+				}
+			}
+		case "table":
+			if _, err := routeTable(line.Value); err != nil {
+				v.error(line.Line, "invalid Table %q, expected a number, auto or off", line.Value)
+			}
+		case "saveconfig":
+			if line.Value != "true" && line.Value != "false" {
+				v.error(line.Line, "invalid SaveConfig %q, expected true or false", line.Value)
+			}
+		}
+	}
+}
+
+func (v *validator) validatePeer(section *WGQuickSection) {
+	v.validateKeys(section, "allowedips")
+	if !section.Has("PublicKey") {
+		v.error(section.Line, "[Peer] is missing PublicKey")
+	}
+
+	var own []peerRoute
+	for _, line := range section.Lines {
+		switch strings.ToLower(line.Key) {
+		case "publickey":
+			if !v.validateKey(line, "PublicKey") {
+				continue
+			}
+			if v.peerKeys == nil {
+				v.peerKeys = map[string]int{}
+			}
+			if first, ok := v.peerKeys[line.Value]; ok {
+				v.error(line.Line, "duplicate peer, the [Peer] on line %d has the same PublicKey", first)
+			} else {
+				v.peerKeys[line.Value] = section.Line
+			}
+		case "presharedkey":
+			v.validateKey(line, "PresharedKey")
+		case "endpoint":
+			v.validateEndpoint(line)
+		case "persistentkeepalive":
+			if line.Value != "off" {
+				v.validateInt(line, 0, 65535)
+			}
+		case "allowedips":
+			for _, cidr := range splitList(line.Value) {
+				prefix, err := parsePrefix(cidr)
+				if err != nil {
+					v.error(line.Line, "invalid AllowedIPs %q", cidr)
+					continue
+				}
+				if prefix != prefix.Masked() {
+					v.warn(line.Line, "AllowedIPs %s has host bits set, it is treated as %s", prefix, prefix.Masked())
+				}
+				own = append(own, peerRoute{prefix: prefix.Masked(), line: line.Line, peer: section.Line})
+			}
+		}
+	}
+
+	for i, route := range own {
+		for _, other := range own[:i] {
+			if route.prefix.Overlaps(other.prefix) {
+				v.warn(route.line, "AllowedIPs %s overlaps %s of the same peer", route.prefix, other.prefix)
+			}
+		}
+		for _, other := range v.routes {
+			if route.prefix.Overlaps(other.prefix) {
+				v.error(route.line, "AllowedIPs %s overlaps %s of the [Peer] on line %d", route.prefix, other.prefix, other.peer)
+			}
+		}
+	}
+	v.routes = append(v.routes, own...)
+}
+
+// validateKey checks a base64 encoded wireguard key
+func (v *validator) validateKey(line *WGQuickLine, name string) bool {
+	if _, err := wgtypes.ParseKey(line.Value); err != nil {
+		v.error(line.Line, "invalid %s, expected a base64 encoded 32 byte key", name)
+		return false
+	}
+	return true
+}
+
+func (v *validator) validateEndpoint(line *WGQuickLine) {
+	host, port, err := net.SplitHostPort(line.Value)
+	if err != nil || host == "" {
+		v.error(line.Line, "invalid Endpoint %q, expected host:port", line.Value)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		v.error(line.Line, "invalid Endpoint port %q", port)
+	}
+}
+
+func (v *validator) validateInt(line *WGQuickLine, min, max int) {
+	n, err := strconv.Atoi(line.Value)
+	if err != nil || n < min || n > max {
+		v.error(line.Line, "invalid %s %q, expected a number from %d to %d", line.Key, line.Value, min, max)
+	}
+}
+
+// splitList splits a comma separated value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package pia
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyA = "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="
+	testKeyB = "YmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmI="
+	testKeyC = "Y2NjY2NjY2NjY2NjY2NjY2NjY2NjY2NjY2NjY2NjY2M="
+)
+
+func TestWGQuickConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			name: "valid",
+			text: `# pia-wg-config region=uk_london server=london401
+[Interface]
+PrivateKey = ` + testKeyA + `
+Address = 10.1.2.3, fd00::2/128
+DNS = 10.0.0.243
+MTU = 1420
+FwMark = 0xca6c
+Table = off
+PostUp = echo up
+PostUp = echo still up
+[Peer]
+PublicKey = ` + testKeyB + `
+AllowedIPs = 0.0.0.0/1, 128.0.0.0/1
+Endpoint = 1.2.3.4:1337
+PersistentKeepalive = 25
+[Peer]
+PublicKey = ` + testKeyC + `
+AllowedIPs = fd00::/64
+Endpoint = vpn.example.com:51820`,
+		},
+		{
+			name: "bad values",
+			text: `[Interface]
+PrivateKey = not-a-key
+Address = 10.1.2.300
+MTU = big
+ListenPort = 70000
+[Peer]
+PublicKey = ` + testKeyB + `
+AllowedIPs = 10.0.0.0/33
+Endpoint = 1.2.3.4
+PersistentKeepalive = -1`,
+			want: []string{
+				"line 2: error: invalid PrivateKey, expected a base64 encoded 32 byte key",
+				`line 3: error: invalid Address "10.1.2.300"`,
+				`line 4: error: invalid MTU "big", expected a number from 576 to 65535`,
+				`line 5: error: invalid ListenPort "70000", expected a number from 0 to 65535`,
+				`line 8: error: invalid AllowedIPs "10.0.0.0/33"`,
+				`line 9: error: invalid Endpoint "1.2.3.4", expected host:port`,
+				`line 10: error: invalid PersistentKeepalive "-1", expected a number from 0 to 65535`,
+			},
+		},
+		{
+			name: "duplicate peers and overlapping routes",
+			text: `[Interface]
+PrivateKey = ` + testKeyA + `
+[Peer]
+PublicKey = ` + testKeyB + `
+AllowedIPs = 10.0.0.0/8, 10.1.0.0/16
+[Peer]
+PublicKey = ` + testKeyB + `
+AllowedIPs = 10.2.0.0/16`,
+			want: []string{
+				"line 5: warning: AllowedIPs 10.1.0.0/16 overlaps 10.0.0.0/8 of the same peer",
+				"line 7: error: duplicate peer, the [Peer] on line 3 has the same PublicKey",
+				"line 8: error: AllowedIPs 10.2.0.0/16 overlaps 10.0.0.0/8 of the [Peer] on line 3",
+			},
+		},
+		{
+			name: "missing and unknown",
+			text: `[Interface]
+Address = 10.1.2.3
+Colour = blue
+[Peer]
+Endpoint = 1.2.3.4:1337
+Endpoint = 1.2.3.5:1337
+[Extra]
+Anything = goes`,
+			want: []string{
+				"line 1: error: [Interface] is missing PrivateKey",
+				"line 3: warning: unknown key Colour in [Interface]",
+				"line 4: error: [Peer] is missing PublicKey",
+				"line 6: error: duplicate Endpoint, first set on line 5",
+				"line 7: warning: unknown section [Extra]",
+			},
+		},
+		{
+			name: "no interface",
+			text: `[Peer]
+PublicKey = ` + testKeyB,
+			want: []string{"line 1: error: missing [Interface] section"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseWGQuick(strings.NewReader(tt.text))
+			if err != nil {
+				t.Fatalf("ParseWGQuick() error = %v", err)
+			}
+
+			var got []string
+			for _, d := range config.Validate() {
+				got = append(got, d.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestWGQuickConfig_Validate_generated(t *testing.T) {
+	p := NewPIAWgGenerator(&PIAClientMock{}, PIAWgGeneratorConfig{MTU: 1420, KillSwitch: KillSwitchNftables, IPv6Mode: IPv6ModeBlock})
+	config, err := p.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseWGQuick(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := parsed.Validate(); len(diagnostics) > 0 {
+		t.Errorf("Validate() of a generated config = %v", diagnostics)
+	}
+}
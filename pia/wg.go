@@ -3,9 +3,11 @@ package pia
 import (
 	"bytes"
 	"fmt"
-	"log"
-
+	"net/netip"
+	"slices"
+	"strconv"
 	"text/template"
+	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
@@ -15,74 +17,289 @@ import (
 type PIAWgGenerator struct {
 	pia        PIAWgClient
 	verbose    bool
+	token      string
 	privatekey string
 	publickey  string
+	template   *template.Template
+	allowedIPs []netip.Prefix
+	excludeIPs []netip.Prefix
+	iface      InterfaceConfig
+	keepalive  int
+	dnsMode    DNSMode
+	killSwitch KillSwitch
+	lanIPs     []netip.Prefix
+	ipv6Mode   IPv6Mode
+	ipv6Sysctl bool
+	format     Format
+	peers      int
 }
 
 type PIAWgGeneratorConfig struct {
 	Verbose    bool
 	PrivateKey string
 	PublicKey  string
+
+	// Token is a PIA auth token to reuse instead of requesting one, e.g. when
+	// generating configs for many regions at once
+	Token string
+
+	// Template replaces the built-in wg-quick template, see ConfigData for
+	// the data model and ParseConfigTemplate for parsing user templates.
+	Template *template.Template
+
+	// AllowedIPs are the ranges routed through the tunnel, defaulting to
+	// 0.0.0.0/0. ExcludeIPs are removed from them, e.g. to keep LAN traffic
+	// off the tunnel. Unless the result is just the default route the
+	// wireguard endpoint is always excluded so it isn't routed through itself.
+	AllowedIPs []netip.Prefix
+	ExcludeIPs []netip.Prefix
+
+	// Interface tuning, zero values are left out of the config
+	MTU        int
+	Table      string
+	FwMark     uint32
+	ListenPort int
+
+	// PersistentKeepalive in seconds, nil uses DefaultPersistentKeepalive and
+	// 0 disables it
+	PersistentKeepalive *int
+
+	// DNSMode selects the DNS servers of the config, DNS holds the servers
+	// for DNSModeCustom
+	DNSMode DNSMode
+	DNS     []string
+
+	// KillSwitch adds PostUp/PreDown firewall rules that stop traffic from
+	// leaving outside the tunnel. KillSwitchAllowIPs are extra ranges, like
+	// the LAN, that may still bypass it; split tunnel excludes always can.
+	KillSwitch         KillSwitch
+	KillSwitchAllowIPs []netip.Prefix
+
+	// IPv6Mode controls IPv6 traffic, which PIA doesn't tunnel. IPv6Sysctl
+	// additionally disables IPv6 on the host while the tunnel is up when
+	// IPv6Mode is IPv6ModeBlock.
+	IPv6Mode   IPv6Mode
+	IPv6Sysctl bool
+
+	// Format selects the output of Render, Template only applies to
+	// FormatWGQuick
+	Format Format
+
+	// Peers registers the key with this many servers of the region. The
+	// first is the peer of the config, the others are listed as Alternates.
+	// The client must implement PIAWgMultiClient for more than one.
+	Peers int
 }
 
-type templateConfig struct {
-	Address             string
-	AllowedIPs          string
-	DNS                 string
-	Endpoint            string
-	PrivateKey          string
-	PublicKey           string
-	PersistentKeepalive string
+// Format is the output format of a rendered config
+type Format string
+
+const (
+	// FormatWGQuick is a wg-quick config, the default
+	FormatWGQuick Format = "wg-quick"
+	// FormatJSON is the structured JSONConfig
+	FormatJSON Format = "json"
+	// FormatNetworkd is a systemd-networkd .netdev and .network pair
+	FormatNetworkd Format = "networkd"
+	// FormatNMConnection is a NetworkManager keyfile connection
+	FormatNMConnection Format = "nmconnection"
+	// FormatUCI is OpenWrt uci network config
+	FormatUCI Format = "uci"
+)
+
+// ParseFormat parses the format of generated configs, an empty string is
+// FormatWGQuick. See ParseConvertFormat for the formats configs can be
+// converted to.
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(s); format {
+	case "":
+		return FormatWGQuick, nil
+	case FormatWGQuick, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, expected wg-quick or json", s)
+	}
+}
+
+// IPv6Mode selects how IPv6 traffic is handled
+type IPv6Mode string
+
+const (
+	// IPv6ModeIgnore leaves IPv6 routed outside the tunnel, the default
+	IPv6ModeIgnore IPv6Mode = "ignore"
+	// IPv6ModeBlock routes ::/0 into the tunnel, where it is blackholed, and
+	// has the kill-switch reject IPv6
+	IPv6ModeBlock IPv6Mode = "block"
+)
+
+// ParseIPv6Mode parses an IPv6 mode, an empty string is IPv6ModeIgnore
+func ParseIPv6Mode(s string) (IPv6Mode, error) {
+	switch mode := IPv6Mode(s); mode {
+	case "":
+		return IPv6ModeIgnore, nil
+	case IPv6ModeIgnore, IPv6ModeBlock:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown IPv6 mode %q, expected block or ignore", s)
+	}
+}
+
+// ipv6SysctlUp and ipv6SysctlDown disable IPv6 on the host while the tunnel
+// is up
+const (
+	ipv6SysctlUp   = "sysctl -q -w net.ipv6.conf.all.disable_ipv6=1"
+	ipv6SysctlDown = "sysctl -q -w net.ipv6.conf.all.disable_ipv6=0"
+)
+
+// DNSMode selects which DNS servers end up in a config
+type DNSMode string
+
+const (
+	// DNSModePIA uses all DNS servers returned by PIA, the default
+	DNSModePIA DNSMode = "pia"
+	// DNSModeCustom uses the servers in PIAWgGeneratorConfig.DNS
+	DNSModeCustom DNSMode = "custom"
+	// DNSModeNone leaves DNS out of the config
+	DNSModeNone DNSMode = "none"
+)
+
+// DefaultPersistentKeepalive is the keepalive interval used unless configured
+const DefaultPersistentKeepalive = 25
+
+// ParseDNSMode parses a DNS mode, an empty string is DNSModePIA
+func ParseDNSMode(s string) (DNSMode, error) {
+	switch mode := DNSMode(s); mode {
+	case "":
+		return DNSModePIA, nil
+	case DNSModePIA, DNSModeCustom, DNSModeNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown DNS mode %q, expected one of pia, custom or none", s)
+	}
 }
 
 func NewPIAWgGenerator(pia PIAWgClient, config PIAWgGeneratorConfig) *PIAWgGenerator {
+	keepalive := DefaultPersistentKeepalive
+	if config.PersistentKeepalive != nil {
+		keepalive = *config.PersistentKeepalive
+	}
+
+	dnsMode := config.DNSMode
+	if dnsMode == "" {
+		dnsMode = DNSModePIA
+	}
+
 	return &PIAWgGenerator{
 		pia:        pia,
 		verbose:    config.Verbose,
+		token:      config.Token,
 		privatekey: config.PrivateKey,
 		publickey:  config.PublicKey,
+		template:   config.Template,
+		allowedIPs: config.AllowedIPs,
+		excludeIPs: config.ExcludeIPs,
+		iface: InterfaceConfig{
+			DNS:        config.DNS,
+			MTU:        config.MTU,
+			Table:      config.Table,
+			FwMark:     config.FwMark,
+			ListenPort: config.ListenPort,
+		},
+		keepalive:  max(keepalive, 0),
+		dnsMode:    dnsMode,
+		killSwitch: config.KillSwitch,
+		lanIPs:     config.KillSwitchAllowIPs,
+		ipv6Mode:   config.IPv6Mode,
+		ipv6Sysctl: config.IPv6Sysctl,
+		format:     config.Format,
+		peers:      config.Peers,
 	}
 }
 
-// Generate
+// Generate registers a key with PIA and renders the config
 func (p *PIAWgGenerator) Generate() (string, error) {
-	// Get PIA token
+	data, err := p.GenerateData()
+	if err != nil {
+		return "", err
+	}
+
+	// Generate Wireguard config
 	if p.verbose {
-		log.Println("Getting PIA token")
+		logf("Generating Wireguard config")
 	}
-	token, err := p.pia.GetToken()
+	config, err := p.Render(data)
 	if err != nil {
-		return "", errors.Wrap(err, "error getting PIA token")
+		return "", errors.Wrap(err, "error generating Wireguard config")
+	}
+
+	return config, nil
+}
+
+// GenerateData registers a key with PIA and returns the config data model
+// without rendering it
+func (p *PIAWgGenerator) GenerateData() (ConfigData, error) {
+	// Get PIA token
+	token := p.token
+	if token == "" {
+		if p.verbose {
+			logf("Getting PIA token")
+		}
+		var err error
+		token, err = p.pia.GetToken()
+		if err != nil {
+			return ConfigData{}, errors.Wrap(err, "error getting PIA token")
+		}
 	}
 
 	// Generate Wireguard keys
 	if p.verbose {
-		log.Println("Generating Wireguard keys")
+		logf("Generating Wireguard keys")
 	}
 	privatekey, publickey, err := p.generateKeys()
 	if err != nil {
-		return "", errors.Wrap(err, "error generating Wireguard keys")
+		return ConfigData{}, errors.Wrap(err, "error generating Wireguard keys")
 	}
 
 	// Add Wireguard publickey to PIA account
 	if p.verbose {
-		log.Println("Adding Wireguard publickey to PIA account")
+		logf("Adding Wireguard publickey to PIA account")
 	}
-	key, err := p.pia.AddKey(token, publickey)
+	keys, err := p.addKeys(token, publickey)
 	if err != nil {
-		return "", errors.Wrap(err, "error adding Wireguard publickey to PIA account")
+		return ConfigData{}, errors.Wrap(err, "error adding Wireguard publickey to PIA account")
 	}
 
-	// Generate Wireguard config
-	if p.verbose {
-		log.Println("Generating Wireguard config")
+	data, err := p.configData(keys, privatekey, publickey)
+	if err != nil {
+		return ConfigData{}, errors.Wrap(err, "error generating Wireguard config")
 	}
-	config, err := p.generateConfig(key, privatekey)
+
+	return data, nil
+}
+
+// addKeys registers the key with as many servers as configured
+func (p *PIAWgGenerator) addKeys(token, publickey string) ([]AddKeyResult, error) {
+	if p.peers <= 1 {
+		key, err := p.pia.AddKey(token, publickey)
+		if err != nil {
+			return nil, err
+		}
+		return []AddKeyResult{key}, nil
+	}
+
+	multi, ok := p.pia.(PIAWgMultiClient)
+	if !ok {
+		return nil, errors.New("client can't register keys with multiple servers")
+	}
+	keys, err := multi.AddKeys(token, publickey, p.peers)
 	if err != nil {
-		return "", errors.Wrap(err, "error generating Wireguard config")
+		return nil, err
+	}
+	if len(keys) < p.peers {
+		logf("Warning: only %d of %d servers accepted the key", len(keys), p.peers)
 	}
 
-	return config, nil
+	return keys, nil
 }
 
 // generateKeys
@@ -93,10 +310,10 @@ func (p *PIAWgGenerator) generateKeys() (string, string, error) {
 
 	privateKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
-		return "", "", errors.Wrap(err, fmt.Sprintf("failed to generate private key: %v", privateKey.String()))
+		return "", "", errors.Wrap(err, "failed to generate private key")
 	}
 	if p.verbose {
-		log.Println("Private key: ", privateKey)
+		logf("Private key: %s", secret(privateKey.String()))
 	}
 
 	// Call host 'wg pubkey' to generate public key
@@ -105,45 +322,169 @@ func (p *PIAWgGenerator) generateKeys() (string, string, error) {
 		return "", "", errors.Wrap(err, fmt.Sprintf("failed to generate public key: %v", publicKey.String()))
 	}
 	if p.verbose {
-		log.Println("Public key: ", publicKey)
+		logf("Public key: %s", publicKey)
 	}
 
 	return privateKey.String(), publicKey.String(), nil
 }
 
-// generateConfig
-func (p *PIAWgGenerator) generateConfig(key AddKeyResult, privatekey string) (string, error) {
-	template, err := template.New("config").Parse(wireguardConfigTemplate)
-	if err != nil {
-		return "", errors.Wrap(err, "error parsing wireguard config template")
+// Render renders data in the configured format, executing the config
+// template for wg-quick
+func (p *PIAWgGenerator) Render(data ConfigData) (string, error) {
+	if p.format == FormatJSON {
+		return RenderJSON(data)
 	}
 
-	// execute template
-	tc := templateConfig{
-		PrivateKey:          privatekey,
-		PublicKey:           key.ServerKey,
-		Endpoint:            key.ServerIP,
-		DNS:                 key.DNSServers[0],
-		Address:             key.PeerIP,
-		AllowedIPs:          "0.0.0.0/0",
-		PersistentKeepalive: "25",
+	tmpl := p.template
+	if tmpl == nil {
+		var err error
+		tmpl, err = template.New("config").Funcs(TemplateFuncs).Parse(wireguardConfigTemplate)
+		if err != nil {
+			return "", errors.Wrap(err, "error parsing wireguard config template")
+		}
 	}
 
 	var config bytes.Buffer
-	err = template.Execute(&config, tc)
+	err := tmpl.Execute(&config, data)
 	if err != nil {
-		return "", errors.Wrap(err, "error executing wireguard config template")
+		return "", newTemplateError(tmpl.Name(), "", err)
 	}
 
 	return config.String(), nil
 }
 
-var wireguardConfigTemplate = `[Interface]
-PrivateKey = {{.PrivateKey}}
-Address = {{.Address}}
-DNS = {{.DNS}}
-[Peer]
-PublicKey = {{.PublicKey}}
-AllowedIPs = {{.AllowedIPs}}
-Endpoint = {{.Endpoint}}:1337
-PersistentKeepalive = {{.PersistentKeepalive}}`
+// configData builds the template data model for the addKey responses of the
+// primary server and its alternates
+func (p *PIAWgGenerator) configData(keys []AddKeyResult, privatekey, publickey string) (ConfigData, error) {
+	key := keys[0]
+	peer, routed := p.serverPeer(key)
+
+	iface := p.iface
+	iface.Address = []string{key.PeerIP}
+	iface.DNS = p.dnsServers(key)
+
+	if p.ipv6Mode == IPv6ModeBlock && p.ipv6Sysctl {
+		iface.PostUp = append(iface.PostUp, ipv6SysctlUp)
+		iface.PreDown = append(iface.PreDown, ipv6SysctlDown)
+	}
+	if p.killSwitch != "" {
+		postUp, preDown, err := p.killSwitchRules(keys, routed)
+		if err != nil {
+			return ConfigData{}, err
+		}
+		iface.PostUp = append(iface.PostUp, postUp...)
+		iface.PreDown = append(preDown, iface.PreDown...)
+	}
+
+	data := ConfigData{
+		AddKeyResult: key,
+		PrivateKey:   privatekey,
+		PublicKey:    publickey,
+		GeneratedAt:  time.Now().UTC(),
+		Interface:    iface,
+		Peers:        []PeerConfig{peer},
+	}
+	for _, key := range keys[1:] {
+		data.Alternates = append(data.Alternates, p.alternate(key))
+	}
+
+	return data, nil
+}
+
+// alternate builds the failover details of another server
+func (p *PIAWgGenerator) alternate(key AddKeyResult) Alternate {
+	peer, _ := p.serverPeer(key)
+	return Alternate{
+		AddKeyResult: key,
+		Address:      []string{key.PeerIP},
+		DNS:          p.dnsServers(key),
+		Peer:         peer,
+	}
+}
+
+// serverPeer builds the peer of a server along with its routed prefixes
+func (p *PIAWgGenerator) serverPeer(key AddKeyResult) (PeerConfig, []netip.Prefix) {
+	routed := p.routedPrefixes(key.ServerIP)
+
+	return PeerConfig{
+		PublicKey:           key.ServerKey,
+		Endpoint:            key.ServerIP + ":" + strconv.Itoa(serverPort(key)),
+		AllowedIPs:          prefixStrings(routed),
+		PersistentKeepalive: p.keepalive,
+	}, routed
+}
+
+// serverPort is the wireguard port of a server, PIA's default when the
+// addKey response has none
+func serverPort(key AddKeyResult) int {
+	if key.ServerPort == 0 {
+		return 1337
+	}
+	return key.ServerPort
+}
+
+// dnsServers applies the DNS mode to the servers of an addKey response
+func (p *PIAWgGenerator) dnsServers(key AddKeyResult) []string {
+	switch p.dnsMode {
+	case DNSModePIA:
+		return key.DNSServers
+	case DNSModeNone:
+		return nil
+	default:
+		return p.iface.DNS
+	}
+}
+
+// routedPrefixes computes the AllowedIPs for a server endpoint
+func (p *PIAWgGenerator) routedPrefixes(endpoint string) []netip.Prefix {
+	include := p.allowedIPs
+	if len(include) == 0 {
+		include = DefaultRoutes[:1]
+	}
+	if p.ipv6Mode == IPv6ModeBlock {
+		include = append(include[:len(include):len(include)], DefaultRoutes[1])
+	}
+
+	allowed := ExcludePrefixes(include, p.excludeIPs)
+	if IsDefaultRouteOnly(allowed) {
+		// wg-quick keeps the endpoint off the tunnel with policy routing
+		return allowed
+	}
+
+	if addr, err := netip.ParseAddr(endpoint); err == nil {
+		allowed = ExcludePrefixes(allowed, []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())})
+	}
+
+	return allowed
+}
+
+// killSwitchRules builds the kill-switch for the endpoints of the servers
+// keys were registered with. Everything the tunnel doesn't route, i.e. split
+// tunnel excludes, may bypass it as well.
+func (p *PIAWgGenerator) killSwitchRules(keys []AddKeyResult, routed []netip.Prefix) ([]string, []string, error) {
+	var endpoints []netip.AddrPort
+	for _, key := range keys {
+		addr, err := netip.ParseAddr(key.ServerIP)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid server ip %q", key.ServerIP)
+		}
+		endpoints = append(endpoints, netip.AddrPortFrom(addr, uint16(serverPort(key))))
+	}
+
+	var allow []netip.Prefix
+	for _, prefix := range ExcludePrefixes(DefaultRoutes, routed) {
+		if !slices.ContainsFunc(endpoints, func(e netip.AddrPort) bool {
+			return prefix == netip.PrefixFrom(e.Addr(), e.Addr().BitLen())
+		}) {
+			allow = append(allow, prefix)
+		}
+	}
+	allow = normalizePrefixes(append(allow, p.lanIPs...))
+	sortPrefixes(allow)
+
+	return KillSwitchRules(p.killSwitch, KillSwitchOptions{
+		Endpoints: endpoints,
+		AllowIPs:  allow,
+		BlockIPv6: p.ipv6Mode == IPv6ModeBlock,
+	})
+}
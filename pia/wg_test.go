@@ -1,7 +1,9 @@
 package pia
 
 import (
+	"errors"
 	"testing"
+	"time"
 )
 
 type PIAClientMock struct{}
@@ -54,6 +56,74 @@ Endpoint = 1.2.3.4:1337
 PersistentKeepalive = 25`,
 			wantErr: false,
 		},
+		{
+			name: "interface options",
+			fields: fields{
+				pia: &PIAClientMock{},
+				config: PIAWgGeneratorConfig{
+					PrivateKey:          "test_privatekey",
+					PublicKey:           "test_publickey",
+					MTU:                 1420,
+					Table:               "off",
+					FwMark:              51820,
+					ListenPort:          51820,
+					PersistentKeepalive: new(int),
+					DNSMode:             DNSModeCustom,
+					DNS:                 []string{"9.9.9.9", "149.112.112.112"},
+				},
+			},
+			want: `[Interface]
+PrivateKey = test_privatekey
+Address = 4.5.6.7
+DNS = 9.9.9.9, 149.112.112.112
+MTU = 1420
+Table = off
+FwMark = 0xca6c
+ListenPort = 51820
+[Peer]
+PublicKey = test_publickey
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:1337`,
+		},
+		{
+			name: "ipv6 block",
+			fields: fields{
+				pia: &PIAClientMock{},
+				config: PIAWgGeneratorConfig{
+					PrivateKey: "test_privatekey",
+					PublicKey:  "test_publickey",
+					IPv6Mode:   IPv6ModeBlock,
+				},
+			},
+			want: `[Interface]
+PrivateKey = test_privatekey
+Address = 4.5.6.7
+DNS = 1.1.1.1
+[Peer]
+PublicKey = test_publickey
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 1.2.3.4:1337
+PersistentKeepalive = 25`,
+		},
+		{
+			name: "no dns",
+			fields: fields{
+				pia: &PIAClientMock{},
+				config: PIAWgGeneratorConfig{
+					PrivateKey: "test_privatekey",
+					PublicKey:  "test_publickey",
+					DNSMode:    DNSModeNone,
+				},
+			},
+			want: `[Interface]
+PrivateKey = test_privatekey
+Address = 4.5.6.7
+[Peer]
+PublicKey = test_publickey
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:1337
+PersistentKeepalive = 25`,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -106,3 +176,158 @@ func TestPIAWgGenerator_generateKeys(t *testing.T) {
 		})
 	}
 }
+
+// tokenCheckingClient only accepts one pre-issued token
+type tokenCheckingClient struct {
+	PIAClientMock
+}
+
+func (p *tokenCheckingClient) GetToken() (string, error) {
+	return "", errors.New("GetToken called")
+}
+
+func (p *tokenCheckingClient) AddKey(token, publickey string) (AddKeyResult, error) {
+	if token != "shared-token" {
+		return AddKeyResult{}, &StatusError{StatusCode: 401}
+	}
+	return p.PIAClientMock.AddKey(token, publickey)
+}
+
+func TestPIAWgGenerator_GenerateData_token(t *testing.T) {
+	p := NewPIAWgGenerator(&tokenCheckingClient{}, PIAWgGeneratorConfig{Token: "shared-token"})
+	data, err := p.GenerateData()
+	if err != nil {
+		t.Fatalf("PIAWgGenerator.GenerateData() error = %v", err)
+	}
+	if data.PeerIP != "4.5.6.7" {
+		t.Errorf("PIAWgGenerator.GenerateData() peer ip = %v", data.PeerIP)
+	}
+}
+
+// multiServerMock registers keys with two servers handing out different peer
+// IPs
+type multiServerMock struct {
+	PIAClientMock
+}
+
+func (p *multiServerMock) AddKeys(token, publickey string, n int) ([]AddKeyResult, error) {
+	servers := []AddKeyResult{
+		{ServerCN: "london401", ServerIP: "1.2.3.4", PeerIP: "4.5.6.7", DNSServers: []string{"1.1.1.1"}, ServerKey: "server_key_1"},
+		{ServerCN: "london402", ServerIP: "2.3.4.5", PeerIP: "5.6.7.8", DNSServers: []string{"1.1.1.1"}, ServerKey: "server_key_2"},
+	}
+	return servers[:min(n, len(servers))], nil
+}
+
+func TestPIAWgGenerator_Generate_peers(t *testing.T) {
+	tests := []struct {
+		name    string
+		pia     PIAWgClient
+		format  Format
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "wg-quick",
+			pia:  &multiServerMock{},
+			want: `[Interface]
+PrivateKey = test_privatekey
+Address = 4.5.6.7
+DNS = 1.1.1.1
+[Peer]
+PublicKey = server_key_1
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:1337
+PersistentKeepalive = 25
+
+# Alternate server london402, fail over by switching to
+# Address = 5.6.7.8
+# DNS = 1.1.1.1
+# [Peer]
+# PublicKey = server_key_2
+# AllowedIPs = 0.0.0.0/0
+# Endpoint = 2.3.4.5:1337
+# PersistentKeepalive = 25`,
+		},
+		{
+			name:   "json",
+			pia:    &multiServerMock{},
+			format: FormatJSON,
+			want: `{
+  "private_key": "test_privatekey",
+  "public_key": "test_publickey",
+  "generated_at": "0001-01-01T00:00:00Z",
+  "interface": {
+    "address": [
+      "4.5.6.7"
+    ],
+    "dns": [
+      "1.1.1.1"
+    ]
+  },
+  "peers": [
+    {
+      "server_cn": "london401",
+      "address": [
+        "4.5.6.7"
+      ],
+      "dns": [
+        "1.1.1.1"
+      ],
+      "public_key": "server_key_1",
+      "endpoint": "1.2.3.4:1337",
+      "allowed_ips": [
+        "0.0.0.0/0"
+      ],
+      "persistent_keepalive": 25
+    },
+    {
+      "server_cn": "london402",
+      "address": [
+        "5.6.7.8"
+      ],
+      "dns": [
+        "1.1.1.1"
+      ],
+      "public_key": "server_key_2",
+      "endpoint": "2.3.4.5:1337",
+      "allowed_ips": [
+        "0.0.0.0/0"
+      ],
+      "persistent_keepalive": 25
+    }
+  ]
+}`,
+		},
+		{
+			name:    "single server client",
+			pia:     &PIAClientMock{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPIAWgGenerator(tt.pia, PIAWgGeneratorConfig{
+				PrivateKey: "test_privatekey",
+				PublicKey:  "test_publickey",
+				Format:     tt.format,
+				Peers:      2,
+			})
+			data, err := p.GenerateData()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PIAWgGenerator.GenerateData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			data.GeneratedAt = time.Time{}
+			got, err := p.Render(data)
+			if err != nil {
+				t.Fatalf("PIAWgGenerator.Render() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("PIAWgGenerator.Render() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
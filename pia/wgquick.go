@@ -0,0 +1,406 @@
+package pia
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// WGQuickConfig is a parsed wg-quick config. It keeps every line as written,
+// including comments, blank lines and keys or sections it doesn't know, so
+// unchanged parts of a file survive a round trip byte for byte.
+type WGQuickConfig struct {
+	// Sections in file order. Lines before the first section header are
+	// kept in a leading section with an empty Name.
+	Sections []*WGQuickSection
+
+	noFinalNewline bool
+}
+
+// WGQuickSection is a [Section] of a wg-quick config
+type WGQuickSection struct {
+	Name  string
+	Line  int
+	Lines []*WGQuickLine
+
+	raw string
+}
+
+// WGQuickLine is a line of a section. Key is empty for comments and blank
+// lines.
+type WGQuickLine struct {
+	Line  int
+	Key   string
+	Value string
+
+	raw string
+}
+
+// WGQuickParseError is a line of a wg-quick config that couldn't be parsed
+type WGQuickParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *WGQuickParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// metaPrefix starts the header comment recording how a config was generated
+const metaPrefix = "# pia-wg-config "
+
+// ParseWGQuick parses a wg-quick config
+func ParseWGQuick(r io.Reader) (*WGQuickConfig, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &WGQuickConfig{}
+	section := &WGQuickSection{}
+	config.Sections = append(config.Sections, section)
+
+	lines := strings.Split(string(b), "\n")
+	if last := len(lines) - 1; lines[last] == "" {
+		lines = lines[:last]
+	} else {
+		config.noFinalNewline = true
+	}
+
+	for i, raw := range lines {
+		num := i + 1
+		text := strings.TrimSpace(stripComment(raw))
+
+		switch {
+		case text == "":
+			section.Lines = append(section.Lines, &WGQuickLine{Line: num, raw: raw})
+		case strings.HasPrefix(text, "["):
+			if !strings.HasSuffix(text, "]") {
+				return nil, &WGQuickParseError{Line: num, Msg: fmt.Sprintf("malformed section header %q", text)}
+			}
+			section = &WGQuickSection{Name: strings.TrimSpace(text[1 : len(text)-1]), Line: num, raw: raw}
+			config.Sections = append(config.Sections, section)
+		default:
+			key, value, ok := strings.Cut(text, "=")
+			if !ok {
+				return nil, &WGQuickParseError{Line: num, Msg: fmt.Sprintf("expected key = value, got %q", text)}
+			}
+			if section.Name == "" {
+				return nil, &WGQuickParseError{Line: num, Msg: fmt.Sprintf("%s is outside of a section", strings.TrimSpace(key))}
+			}
+			section.Lines = append(section.Lines, &WGQuickLine{
+				Line:  num,
+				Key:   strings.TrimSpace(key),
+				Value: strings.TrimSpace(value),
+				raw:   raw,
+			})
+		}
+	}
+
+	return config, nil
+}
+
+// stripComment removes a # comment, wg-quick allows them anywhere on a line
+func stripComment(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// String renders the config, unchanged lines exactly as they were parsed
+func (c *WGQuickConfig) String() string {
+	var b strings.Builder
+	for _, section := range c.Sections {
+		if section.Name != "" {
+			if section.raw == "" {
+				section.raw = "[" + section.Name + "]"
+			}
+			b.WriteString(section.raw + "\n")
+		}
+		for _, line := range section.Lines {
+			b.WriteString(line.raw + "\n")
+		}
+	}
+
+	if c.noFinalNewline {
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+	return b.String()
+}
+
+// Interface returns the [Interface] section, or nil
+func (c *WGQuickConfig) Interface() *WGQuickSection {
+	for _, section := range c.Sections {
+		if strings.EqualFold(section.Name, "Interface") {
+			return section
+		}
+	}
+	return nil
+}
+
+// Peers returns the [Peer] sections
+func (c *WGQuickConfig) Peers() []*WGQuickSection {
+	var peers []*WGQuickSection
+	for _, section := range c.Sections {
+		if strings.EqualFold(section.Name, "Peer") {
+			peers = append(peers, section)
+		}
+	}
+	return peers
+}
+
+// Meta returns the key=value pairs of the "# pia-wg-config" header comment
+func (c *WGQuickConfig) Meta() map[string]string {
+	meta := map[string]string{}
+	for _, line := range c.Sections[0].Lines {
+		fields, ok := strings.CutPrefix(line.raw, metaPrefix)
+		if !ok {
+			continue
+		}
+		for _, field := range strings.Fields(fields) {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				meta[key] = value
+			}
+		}
+	}
+	return meta
+}
+
+// SetMeta rewrites the "# pia-wg-config" header comment with the given pairs
+// in order, adding it at the top of the file if missing
+func (c *WGQuickConfig) SetMeta(pairs ...string) {
+	var fields []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		fields = append(fields, pairs[i]+"="+pairs[i+1])
+	}
+	raw := metaPrefix + strings.Join(fields, " ")
+
+	preamble := c.Sections[0]
+	for _, line := range preamble.Lines {
+		if strings.HasPrefix(line.raw, metaPrefix) {
+			line.raw = raw
+			return
+		}
+	}
+	preamble.Lines = append([]*WGQuickLine{{raw: raw}}, preamble.Lines...)
+}
+
+// Get returns the value of the first line with key, keys are case
+// insensitive like in wg-quick
+func (s *WGQuickSection) Get(key string) string {
+	for _, line := range s.Lines {
+		if strings.EqualFold(line.Key, key) {
+			return line.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of every line with key, in order
+func (s *WGQuickSection) Values(key string) []string {
+	var values []string
+	for _, line := range s.Lines {
+		if strings.EqualFold(line.Key, key) {
+			values = append(values, line.Value)
+		}
+	}
+	return values
+}
+
+// Has reports whether the section sets key
+func (s *WGQuickSection) Has(key string) bool {
+	for _, line := range s.Lines {
+		if strings.EqualFold(line.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the value of the first line with key and removes any repeats.
+// A missing key is added after the last key of the section.
+func (s *WGQuickSection) Set(key, value string) {
+	var lines []*WGQuickLine
+	found := false
+	for _, line := range s.Lines {
+		if !strings.EqualFold(line.Key, key) {
+			lines = append(lines, line)
+			continue
+		}
+		if !found {
+			found = true
+			line.SetValue(value)
+			lines = append(lines, line)
+		}
+	}
+
+	if !found {
+		last := -1
+		for i, line := range lines {
+			if line.Key != "" {
+				last = i
+			}
+		}
+		line := &WGQuickLine{Key: key}
+		line.SetValue(value)
+		lines = append(lines[:last+1], append([]*WGQuickLine{line}, lines[last+1:]...)...)
+	}
+
+	s.Lines = lines
+}
+
+// SetValue updates a line, keeping the spelling of its key and any trailing
+// comment
+func (l *WGQuickLine) SetValue(value string) {
+	if l.Value == value && l.raw != "" {
+		return
+	}
+	comment := ""
+	if i := strings.Index(l.raw, "#"); i >= 0 {
+		comment = " " + l.raw[i:]
+	}
+	l.Value = value
+	l.raw = l.Key + " = " + value + comment
+}
+
+// hookKeys are the wg-quick keys holding shell commands
+var hookKeys = []string{"PreUp", "PostUp", "PreDown", "PostDown"}
+
+// ApplyAddKey updates the fields of a config that PIA owns, the PIA address,
+// DNS and the PublicKey and Endpoint of the first peer, from a new addKey
+// response. Everything else is left as it was: other addresses in Address
+// are kept, and DNS is only updated if the config sets it and keepDNS is
+// false. Hooks like kill-switch rules that mention the old endpoint address
+// are pointed at the new one, and so is an AllowedIPs exclusion keeping the
+// endpoint off the tunnel.
+func (c *WGQuickConfig) ApplyAddKey(key AddKeyResult, keepDNS bool) error {
+	iface := c.Interface()
+	if iface == nil {
+		return fmt.Errorf("no [Interface] section")
+	}
+	peers := c.Peers()
+	if len(peers) == 0 {
+		return fmt.Errorf("no [Peer] section")
+	}
+	peer := peers[0]
+
+	port := key.ServerPort
+	if port == 0 {
+		port = 1337
+	}
+	oldHost := endpointHost(peer.Get("Endpoint"))
+
+	iface.Set("Address", replacePeerAddress(iface.Values("Address"), key.PeerIP))
+	if iface.Has("DNS") && !keepDNS && len(key.DNSServers) > 0 {
+		iface.Set("DNS", strings.Join(key.DNSServers, ", "))
+	}
+	peer.Set("PublicKey", key.ServerKey)
+	peer.Set("Endpoint", net.JoinHostPort(key.ServerIP, strconv.Itoa(port)))
+
+	if oldHost != "" && oldHost != key.ServerIP {
+		old := regexp.MustCompile(`(^|[^0-9a-fA-F.:])` + regexp.QuoteMeta(oldHost) + `($|[^0-9a-fA-F.:])`)
+		for _, line := range iface.Lines {
+			if containsFold(hookKeys, line.Key) {
+				if updated := old.ReplaceAllString(line.Value, "${1}"+key.ServerIP+"${2}"); updated != line.Value {
+					line.SetValue(updated)
+				}
+			}
+		}
+	}
+	if err := rerouteEndpoint(peer, oldHost, key.ServerIP); err != nil {
+		return err
+	}
+
+	if key.Region != "" {
+		c.SetMeta("region", key.Region, "server", key.ServerCN)
+	}
+
+	return nil
+}
+
+// replacePeerAddress replaces the PIA peer IP, the first IPv4 address, in the
+// Address values of a config, keeping its prefix length and any addresses
+// added by hand
+func replacePeerAddress(values []string, peerIP string) string {
+	var addresses []string
+	for _, value := range values {
+		addresses = append(addresses, splitList(value)...)
+	}
+
+	for i, address := range addresses {
+		host, bits, hasBits := strings.Cut(address, "/")
+		if addr, err := netip.ParseAddr(host); err != nil || !addr.Is4() {
+			continue
+		}
+		addresses[i] = peerIP
+		if hasBits {
+			addresses[i] += "/" + bits
+		}
+		return strings.Join(addresses, ", ")
+	}
+
+	return strings.Join(append([]string{peerIP}, addresses...), ", ")
+}
+
+// rerouteEndpoint moves the exclusion of the old endpoint from the
+// AllowedIPs of peer to the new one, so traffic to the new endpoint isn't
+// routed into the tunnel. Default routes are left alone, wg-quick keeps the
+// endpoint off them with policy routing.
+func rerouteEndpoint(peer *WGQuickSection, oldHost, newHost string) error {
+	var values []string
+	for _, value := range peer.Values("AllowedIPs") {
+		values = append(values, splitList(value)...)
+	}
+	allowed, err := ParsePrefixes(values)
+	if err != nil {
+		return fmt.Errorf("invalid AllowedIPs: %v", err)
+	}
+	if len(allowed) == 0 || IsDefaultRouteOnly(allowed) {
+		return nil
+	}
+
+	// the gaps of AllowedIPs are the ranges excluded from the tunnel
+	var roots []netip.Prefix
+	for _, root := range DefaultRoutes {
+		if slices.ContainsFunc(allowed, func(p netip.Prefix) bool { return p.Addr().Is4() == root.Addr().Is4() }) {
+			roots = append(roots, root)
+		}
+	}
+	gaps := ExcludePrefixes(roots, allowed)
+
+	changed := false
+	if old, err := netip.ParseAddr(oldHost); err == nil && oldHost != newHost {
+		// the old endpoint's exclusion may have merged with adjacent ones
+		// into a larger gap, so it is cut out rather than looked up
+		if slices.ContainsFunc(gaps, func(p netip.Prefix) bool { return p.Contains(old) }) {
+			gaps = ExcludePrefixes(gaps, []netip.Prefix{netip.PrefixFrom(old, old.BitLen())})
+			changed = true
+		}
+	}
+	if addr, err := netip.ParseAddr(newHost); err == nil {
+		host := netip.PrefixFrom(addr, addr.BitLen())
+		if slices.ContainsFunc(allowed, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			gaps = append(gaps, host)
+			changed = true
+		}
+	}
+	if changed {
+		peer.Set("AllowedIPs", strings.Join(prefixStrings(ExcludePrefixes(roots, gaps)), ", "))
+	}
+
+	return nil
+}
+
+func endpointHost(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,264 @@
+package pia
+
+import (
+	"strings"
+	"testing"
+)
+
+const testWGQuickConfig = `# pia-wg-config region=uk_london server=london401
+# my laptop tunnel
+
+[Interface]
+PrivateKey = test_privatekey
+Address = 4.5.6.7
+DNS = 1.1.1.1
+PostUp = iptables -A pia-killswitch -d 1.2.3.4/32 -p udp --dport 1337 -j RETURN
+PostUp = notify-send "vpn up" # custom hook
+SaveConfig = false
+
+[Peer]
+publickey = old_server_key
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:1337
+PersistentKeepalive = 25
+
+[Custom]
+Anything = goes`
+
+func TestParseWGQuick_roundTrip(t *testing.T) {
+	for _, text := range []string{testWGQuickConfig, testWGQuickConfig + "\n", "[Interface]\r\nPrivateKey = k\r\n"} {
+		config, err := ParseWGQuick(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("ParseWGQuick() error = %v", err)
+		}
+		if got := config.String(); got != text {
+			t.Errorf("ParseWGQuick().String() = %q, want %q", got, text)
+		}
+	}
+}
+
+func TestParseWGQuick(t *testing.T) {
+	config, err := ParseWGQuick(strings.NewReader(testWGQuickConfig))
+	if err != nil {
+		t.Fatalf("ParseWGQuick() error = %v", err)
+	}
+
+	if got := config.Meta()["region"]; got != "uk_london" {
+		t.Errorf("Meta() region = %q", got)
+	}
+	iface := config.Interface()
+	if iface == nil || iface.Get("privatekey") != "test_privatekey" || len(iface.Values("PostUp")) != 2 {
+		t.Errorf("Interface() = %+v", iface)
+	}
+	if got := iface.Values("PostUp")[1]; got != `notify-send "vpn up"` {
+		t.Errorf("PostUp with comment = %q", got)
+	}
+	peers := config.Peers()
+	if len(peers) != 1 || peers[0].Get("PublicKey") != "old_server_key" || peers[0].Line != 12 {
+		t.Errorf("Peers() = %+v", peers)
+	}
+}
+
+func TestParseWGQuick_errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		wantLine int
+	}{
+		{
+			name:     "key outside section",
+			text:     "# header\nPrivateKey = k\n",
+			wantLine: 2,
+		},
+		{
+			name:     "missing equals",
+			text:     "[Interface]\nPrivateKey k\n",
+			wantLine: 2,
+		},
+		{
+			name:     "unclosed section",
+			text:     "[Interface]\nPrivateKey = k\n[Peer\n",
+			wantLine: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseWGQuick(strings.NewReader(tt.text))
+			parseErr, ok := err.(*WGQuickParseError)
+			if !ok || parseErr.Line != tt.wantLine {
+				t.Errorf("ParseWGQuick() error = %v, want error on line %d", err, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestWGQuickConfig_ApplyAddKey(t *testing.T) {
+	config, err := ParseWGQuick(strings.NewReader(testWGQuickConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = config.ApplyAddKey(AddKeyResult{
+		ServerKey:  "new_server_key",
+		ServerIP:   "11.2.3.4",
+		ServerPort: 1337,
+		PeerIP:     "10.9.8.7",
+		DNSServers: []string{"10.0.0.243", "10.0.0.242"},
+		Region:     "uk_london",
+		ServerCN:   "london402",
+	}, false)
+	if err != nil {
+		t.Fatalf("ApplyAddKey() error = %v", err)
+	}
+
+	want := `# pia-wg-config region=uk_london server=london402
+# my laptop tunnel
+
+[Interface]
+PrivateKey = test_privatekey
+Address = 10.9.8.7
+DNS = 10.0.0.243, 10.0.0.242
+PostUp = iptables -A pia-killswitch -d 11.2.3.4/32 -p udp --dport 1337 -j RETURN
+PostUp = notify-send "vpn up" # custom hook
+SaveConfig = false
+
+[Peer]
+publickey = new_server_key
+AllowedIPs = 0.0.0.0/0
+Endpoint = 11.2.3.4:1337
+PersistentKeepalive = 25
+
+[Custom]
+Anything = goes`
+	if got := config.String(); got != want {
+		t.Errorf("ApplyAddKey() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWGQuickConfig_ApplyAddKey_addressAndRoutes(t *testing.T) {
+	exclude := func(cidrs ...string) string {
+		return strings.Join(prefixStrings(ExcludePrefixes(DefaultRoutes[:1], mustParsePrefixes(t, cidrs...))), ", ")
+	}
+
+	tests := []struct {
+		name           string
+		address        string
+		allowedIPs     string
+		wantAddress    string
+		wantAllowedIPs string
+	}{
+		{
+			name:           "default route",
+			address:        "4.5.6.7",
+			allowedIPs:     "0.0.0.0/0",
+			wantAddress:    "10.9.8.7",
+			wantAllowedIPs: "0.0.0.0/0",
+		},
+		{
+			name:           "extra addresses are kept",
+			address:        "fd00::2/64, 4.5.6.7/32, 192.168.7.1/24",
+			allowedIPs:     "0.0.0.0/0, ::/0",
+			wantAddress:    "fd00::2/64, 10.9.8.7/32, 192.168.7.1/24",
+			wantAllowedIPs: "0.0.0.0/0, ::/0",
+		},
+		{
+			name:           "no IPv4 address",
+			address:        "fd00::2/64",
+			allowedIPs:     "0.0.0.0/0",
+			wantAddress:    "10.9.8.7, fd00::2/64",
+			wantAllowedIPs: "0.0.0.0/0",
+		},
+		{
+			name:           "endpoint exclusion moves",
+			address:        "4.5.6.7",
+			allowedIPs:     exclude("1.2.3.4/32", "192.168.0.0/16"),
+			wantAddress:    "10.9.8.7",
+			wantAllowedIPs: exclude("11.2.3.4/32", "192.168.0.0/16"),
+		},
+		{
+			name:           "new endpoint already excluded",
+			address:        "4.5.6.7",
+			allowedIPs:     exclude("1.2.3.4/32", "11.0.0.0/8"),
+			wantAddress:    "10.9.8.7",
+			wantAllowedIPs: exclude("11.0.0.0/8"),
+		},
+		{
+			name:           "endpoint exclusion merged with an adjacent one",
+			address:        "4.5.6.7",
+			allowedIPs:     exclude("1.2.3.4/32", "1.2.3.5/32", "192.168.0.0/16"),
+			wantAddress:    "10.9.8.7",
+			wantAllowedIPs: exclude("1.2.3.5/32", "11.2.3.4/32", "192.168.0.0/16"),
+		},
+		{
+			// the endpoint exclusion can't be told apart from the range,
+			// the old endpoint is routed through the tunnel again
+			name:           "old endpoint in an excluded range",
+			address:        "4.5.6.7",
+			allowedIPs:     exclude("1.0.0.0/8"),
+			wantAddress:    "10.9.8.7",
+			wantAllowedIPs: exclude(append(prefixStrings(ExcludePrefixes(mustParsePrefixes(t, "1.0.0.0/8"), mustParsePrefixes(t, "1.2.3.4/32"))), "11.2.3.4/32")...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := strings.Replace(testWGQuickConfig, "Address = 4.5.6.7", "Address = "+tt.address, 1)
+			text = strings.Replace(text, "AllowedIPs = 0.0.0.0/0", "AllowedIPs = "+tt.allowedIPs, 1)
+			config, err := ParseWGQuick(strings.NewReader(text))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = config.ApplyAddKey(AddKeyResult{ServerKey: "new_server_key", ServerIP: "11.2.3.4", PeerIP: "10.9.8.7"}, false)
+			if err != nil {
+				t.Fatalf("ApplyAddKey() error = %v", err)
+			}
+			if got := config.Interface().Get("Address"); got != tt.wantAddress {
+				t.Errorf("ApplyAddKey() Address = %s, want %s", got, tt.wantAddress)
+			}
+			if got := config.Peers()[0].Get("AllowedIPs"); got != tt.wantAllowedIPs {
+				t.Errorf("ApplyAddKey() AllowedIPs = %s, want %s", got, tt.wantAllowedIPs)
+			}
+		})
+	}
+}
+
+func TestWGQuickSection_Set(t *testing.T) {
+	config, err := ParseWGQuick(strings.NewReader("[Interface]\nPrivateKey = k\nDNS = 1.1.1.1\nDNS = 8.8.8.8\n\n[Peer]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface := config.Interface()
+	iface.Set("DNS", "9.9.9.9")
+	iface.Set("MTU", "1420")
+
+	want := "[Interface]\nPrivateKey = k\nDNS = 9.9.9.9\nMTU = 1420\n\n[Peer]\n"
+	if got := config.String(); got != want {
+		t.Errorf("Set() = %q, want %q", got, want)
+	}
+}
+
+func TestPIAWgGenerator_Render_header(t *testing.T) {
+	p := NewPIAWgGenerator(&PIAClientMock{}, PIAWgGeneratorConfig{PrivateKey: "test_privatekey", PublicKey: "test_publickey"})
+	data, err := p.GenerateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Region = "uk_london"
+	data.ServerCN = "london401"
+
+	text, err := p.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(text, "# pia-wg-config region=uk_london server=london401\n[Interface]\n") {
+		t.Errorf("Render() = %q, want a header comment", text)
+	}
+
+	config, err := ParseWGQuick(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta := config.Meta(); meta["region"] != "uk_london" || meta["server"] != "london401" {
+		t.Errorf("Meta() = %v", meta)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	cli "github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// toolConfig is the config file of the tool, holding named profiles of
+// option values:
+//
+//	default_profile: home
+//	profiles:
+//	  work:
+//	    username: p1234567
+//	    password-env: PIA_WORK_PASSWORD
+//	    region: uk_london
+//	    outfile: /etc/wireguard/work.conf
+//	    allowed-ips: [10.0.0.0/8]
+//	    killswitch: nftables
+//
+// Profile keys are the long names of command line options, plus username,
+// password, password-env and password-file for the account.
+type toolConfig struct {
+	DefaultProfile string                    `yaml:"default_profile"`
+	Profiles       map[string]map[string]any `yaml:"profiles"`
+}
+
+// profileCredentialKeys are the profile keys that aren't options
+var profileCredentialKeys = []string{"username", "password", "password-env", "password-file"}
+
+// profile is a selected profile, nil if none is
+type profile map[string]any
+
+// configFlags select the config file and profile
+func configFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "Config file with named profiles (default: $XDG_CONFIG_HOME/pia-wg-config/config.yaml)",
+		},
+		&cli.StringFlag{
+			Name:    "profile",
+			Aliases: []string{"p"},
+			EnvVars: []string{"PIA_WG_CONFIG_PROFILE"},
+			Usage:   "Profile of the config file to take options from, flags given on the command line take precedence",
+		},
+	}
+}
+
+// defaultConfigPath is the config file used without --config
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "pia-wg-config", "config.yaml")
+}
+
+// loadToolConfig reads a config file. A missing file at the default path is
+// an empty config, a missing --config is an error.
+func loadToolConfig(path string, explicit bool) (toolConfig, error) {
+	var config toolConfig
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// applyProfile loads the selected profile and sets every option of it the
+// command has and the command line didn't set, so the precedence is flags,
+// then the profile, then the flag defaults. Options of other commands, like
+// outfile for batch, are skipped; keys that aren't options of any command
+// are an error.
+func applyProfile(c *cli.Context) (profile, error) {
+	// the config flag of the app, refresh has its own
+	root := appContext(c)
+	path, explicit := root.String("config"), root.IsSet("config")
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	config, err := loadToolConfig(path, explicit)
+	if err != nil {
+		return nil, err
+	}
+
+	name := root.String("profile")
+	if name == "" {
+		name = config.DefaultProfile
+	}
+	if name == "" {
+		return nil, nil
+	}
+	values, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %q in %s", name, path)
+	}
+
+	known := appFlagNames(c.App)
+	local := commandFlagNames(c)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if slices.Contains(profileCredentialKeys, key) {
+			continue
+		}
+		if !known[key] || key == "config" || key == "profile" {
+			return nil, fmt.Errorf("profile %q: unknown option %q", name, key)
+		}
+		if !local[key] || c.IsSet(key) {
+			continue
+		}
+		if err := setProfileValue(c, key, values[key]); err != nil {
+			return nil, fmt.Errorf("profile %q: %v", name, err)
+		}
+	}
+
+	return profile(values), nil
+}
+
+// appContext returns the context of the app's own flags
+func appContext(c *cli.Context) *cli.Context {
+	for _, ctx := range c.Lineage() {
+		if ctx.Command != nil && ctx.Command.Name == c.App.Name {
+			return ctx
+		}
+	}
+	return c
+}
+
+// setProfileValue sets a flag from a yaml value, lists set slice flags item
+// by item
+func setProfileValue(c *cli.Context, key string, value any) error {
+	items, isList := value.([]any)
+	if !isList {
+		items = []any{value}
+	}
+	for _, item := range items {
+		switch item.(type) {
+		case []any, map[string]any, nil:
+			return fmt.Errorf("invalid value for %s", key)
+		}
+		if err := c.Set(key, fmt.Sprint(item)); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// commandFlagNames are the flags of the running command
+func commandFlagNames(c *cli.Context) map[string]bool {
+	names := map[string]bool{}
+	flags := c.App.Flags
+	if c.Command != nil && c.Command.Name != c.App.Name {
+		flags = c.Command.Flags
+	}
+	for _, flag := range flags {
+		names[flag.Names()[0]] = true
+	}
+	return names
+}
+
+// appFlagNames are the flags of every command
+func appFlagNames(app *cli.App) map[string]bool {
+	names := map[string]bool{}
+	for _, flag := range app.Flags {
+		names[flag.Names()[0]] = true
+	}
+	for _, cmd := range app.Commands {
+		for _, flag := range cmd.Flags {
+			names[flag.Names()[0]] = true
+		}
+	}
+	return names
+}
+
+// errNoCredentials is returned when neither the arguments nor a profile hold
+// credentials
+var errNoCredentials = errors.New("username and password are required")
+
+// credentials returns the PIA account from the USERNAME PASSWORD arguments,
+// or else the credentials file, Vault, the credential helper or the profile.
+// An account from the credential helper is marked on c, so only it is erased
+// when PIA rejects it.
+func credentials(c *cli.Context, p profile) (string, string, error) {
+	if c.NArg() >= 2 {
+		username, password := c.Args().Get(0), c.Args().Get(1)
+		if username == "" || password == "" {
+			return "", "", errors.New("username and password cannot be empty")
+		}
+		return username, password, nil
+	}
+	if file := c.String("credentials-file"); file != "" {
+		return readCredentialsFile(file, c.StringSlice("identity"))
+	}
+	if path := c.String("vault-path"); path != "" {
+		vault, err := newVaultClient(c)
+		if err != nil {
+			return "", "", err
+		}
+		if vault == nil {
+			return "", "", errors.New("--vault-addr is required with --vault-path")
+		}
+		return vault.credentials(c.Context, path)
+	}
+	if helper := newCredentialHelper(c); helper != nil {
+		username, password, err := helper.get(c.Context)
+		if err == nil {
+			markHelperCredentials(c)
+		}
+		return username, password, err
+	}
+
+	username, _ := p["username"].(string)
+	if username == "" {
+		return "", "", errNoCredentials
+	}
+
+	var password string
+	switch {
+	case p["password-env"] != nil:
+		env := fmt.Sprint(p["password-env"])
+		password = os.Getenv(env)
+		if password == "" {
+			return "", "", fmt.Errorf("$%s is empty", env)
+		}
+	case p["password-file"] != nil:
+		file := expandHome(fmt.Sprint(p["password-file"]))
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", "", err
+		}
+		password = strings.TrimSpace(string(b))
+	case p["password"] != nil:
+		password = fmt.Sprint(p["password"])
+	}
+	if password == "" {
+		return "", "", errNoCredentials
+	}
+
+	return username, password, nil
+}
+
+// account applies the selected profile and returns the PIA account of a
+// command taking USERNAME PASSWORD, failing with usage if there is none
+func account(c *cli.Context, usage string) (string, string, error) {
+	p, err := applyProfile(c)
+	if err != nil {
+		return "", "", cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	username, password, err := credentials(c, p)
+	if errors.Is(err, errNoCredentials) {
+		return "", "", cli.Exit("Error: Username and password are required\n\nUsage:\n  "+usage, 1)
+	}
+	if err != nil {
+		return "", "", cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	return username, password, nil
+}
+
+// expandHome expands a leading ~/ to the home directory
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
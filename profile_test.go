@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+const testToolConfig = `default_profile: home
+profiles:
+  home:
+    username: p1111111
+    password: home-password
+    region: us_seattle
+  work:
+    username: p2222222
+    password-env: TEST_PIA_WORK_PASSWORD
+    region: uk_london
+    allowed-ips: [10.0.0.0/8, 192.168.0.0/16]
+    mtu: 1400
+    exclude-rfc1918: true
+    outdir: /tmp/configs
+  file:
+    username: p3333333
+    password-file: %s
+  typo:
+    regoin: uk_london
+`
+
+// profileResult is what a command saw after applying a profile
+type profileResult struct {
+	Username   string
+	Password   string
+	Region     string
+	AllowedIPs []string
+	MTU        int
+	RFC1918    bool
+	Err        string
+}
+
+// runProfileApp runs a small app with the flags the profile keys map to
+func runProfileApp(t *testing.T, args ...string) profileResult {
+	t.Helper()
+	var result profileResult
+	action := func(c *cli.Context) error {
+		p, err := applyProfile(c)
+		if err == nil {
+			result.Username, result.Password, err = credentials(c, p)
+		}
+		if err != nil {
+			result.Err = err.Error()
+			return nil
+		}
+		result.Region = c.String("region")
+		if regions := c.StringSlice("region"); len(regions) > 0 {
+			result.Region = strings.Join(regions, ",")
+		}
+		result.AllowedIPs = c.StringSlice("allowed-ips")
+		result.MTU = c.Int("mtu")
+		result.RFC1918 = c.Bool("exclude-rfc1918")
+		return nil
+	}
+
+	app := &cli.App{
+		Name:   "pia-wg-config",
+		Action: action,
+		Flags: flags(configFlags(), []cli.Flag{regionFlag(), &cli.StringFlag{Name: "outfile", Aliases: []string{"o"}}},
+			generatorFlags()),
+		Commands: []*cli.Command{{
+			Name:   "batch",
+			Action: action,
+			Flags: append([]cli.Flag{
+				&cli.StringSliceFlag{Name: "region", Aliases: []string{"r"}},
+				&cli.StringFlag{Name: "outdir"},
+			}, generatorFlags()...),
+		}},
+	}
+	if err := app.Run(append([]string{"pia-wg-config"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestApplyProfile(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("file-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(config, []byte(strings.Replace(testToolConfig, "%s", passwordFile, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_PIA_WORK_PASSWORD", "work-password")
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+	t.Setenv("PIA_WG_CONFIG_PROFILE", "")
+
+	tests := []struct {
+		name string
+		args []string
+		want profileResult
+	}{
+		{
+			name: "no config file",
+			args: []string{"user", "pass"},
+			want: profileResult{Username: "user", Password: "pass", Region: "us_california"},
+		},
+		{
+			name: "default profile",
+			args: []string{"--config", config},
+			want: profileResult{Username: "p1111111", Password: "home-password", Region: "us_seattle"},
+		},
+		{
+			name: "selected profile",
+			args: []string{"--config", config, "--profile", "work"},
+			want: profileResult{
+				Username:   "p2222222",
+				Password:   "work-password",
+				Region:     "uk_london",
+				AllowedIPs: []string{"10.0.0.0/8", "192.168.0.0/16"},
+				MTU:        1400,
+				RFC1918:    true,
+			},
+		},
+		{
+			name: "flags take precedence over the profile",
+			args: []string{"--config", config, "-p", "work", "-r", "de_berlin", "--allowed-ips", "172.16.0.0/12", "--mtu", "1300", "user", "pass"},
+			want: profileResult{
+				Username:   "user",
+				Password:   "pass",
+				Region:     "de_berlin",
+				AllowedIPs: []string{"172.16.0.0/12"},
+				MTU:        1300,
+				RFC1918:    true,
+			},
+		},
+		{
+			name: "subcommand",
+			args: []string{"--config", config, "-p", "work", "batch"},
+			want: profileResult{
+				Username:   "p2222222",
+				Password:   "work-password",
+				Region:     "uk_london",
+				AllowedIPs: []string{"10.0.0.0/8", "192.168.0.0/16"},
+				MTU:        1400,
+				RFC1918:    true,
+			},
+		},
+		{
+			name: "password file",
+			args: []string{"--config", config, "-p", "file"},
+			want: profileResult{Username: "p3333333", Password: "file-password", Region: "us_california"},
+		},
+		{
+			name: "unknown option",
+			args: []string{"--config", config, "-p", "typo"},
+			want: profileResult{Err: `profile "typo": unknown option "regoin"`},
+		},
+		{
+			name: "unknown profile",
+			args: []string{"--config", config, "-p", "nope"},
+			want: profileResult{Err: `no profile "nope" in ` + config},
+		},
+		{
+			name: "missing config file",
+			args: []string{"--config", filepath.Join(dir, "missing.yaml"), "user", "pass"},
+			want: profileResult{Err: "open " + filepath.Join(dir, "missing.yaml") + ": no such file or directory"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runProfileApp(t, tt.args...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultConfigPath(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "/xdg")
+	if got := defaultConfigPath(); got != "/xdg/pia-wg-config/config.yaml" {
+		t.Errorf("defaultConfigPath() = %q", got)
+	}
+}
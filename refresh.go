@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// refreshFlags select the config refreshed in place
+func refreshFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "config",
+			Aliases:  []string{"c"},
+			Required: true,
+			Usage:    "The wg-quick config file to refresh",
+		},
+		&cli.StringFlag{
+			Name:    "region",
+			Aliases: []string{"r"},
+			Usage:   "Region to register the key in (default: the region recorded in the config header)",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-dns",
+			Usage: "Leave the DNS servers of the config alone",
+		},
+		&cli.BoolFlag{
+			Name:  "no-backup",
+			Usage: "Don't keep the previous config in <config>.bak",
+		},
+		verboseFlag(),
+	}
+}
+
+// refreshAction re-registers the key of an existing config and updates the
+// fields PIA owns, keeping everything else in the file as it was
+func refreshAction(c *cli.Context) error {
+	username, password, err := account(c, "pia-wg-config refresh --config FILE [OPTIONS] USERNAME PASSWORD")
+	if err != nil {
+		return err
+	}
+	verbose := c.Bool("verbose")
+	file := c.String("config")
+
+	writeOpts, err := newWriteOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	writeOpts.Backup = !c.Bool("no-backup")
+
+	// the file stays locked from reading it to writing it back, so a
+	// concurrent refresh can't overwrite the key registered by this one
+	var region string
+	var key pia.AddKeyResult
+	err = updateFileAtomic(file, writeOpts, func(data []byte) ([]byte, error) {
+		config, err := pia.ParseWGQuick(bytes.NewReader(data))
+		if err != nil {
+			return nil, cli.Exit(fmt.Sprintf("Error: Failed to parse '%s': %v", file, err), 1)
+		}
+
+		region = c.String("region")
+		if region == "" {
+			region = config.Meta()["region"]
+		}
+		if region == "" {
+			return nil, cli.Exit(fmt.Sprintf("Error: '%s' doesn't record its region, pass --region", file), 1)
+		}
+
+		iface := config.Interface()
+		if iface == nil {
+			return nil, cli.Exit(fmt.Sprintf("Error: '%s' has no [Interface] section", file), 1)
+		}
+		privateKey, err := wgtypes.ParseKey(iface.Get("PrivateKey"))
+		if err != nil {
+			return nil, cli.Exit(fmt.Sprintf("Error: Invalid PrivateKey in '%s': %v", file, err), 1)
+		}
+
+		// register the existing key again
+		opts, err := clientOptions(c)
+		if err != nil {
+			return nil, cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+		piaClient, err := pia.NewPIAClient(username, password, region, verbose, opts...)
+		if err != nil {
+			return nil, cli.Exit(fmt.Sprintf("Error: Failed to connect to PIA servers: %v", err), 1)
+		}
+		token, err := piaClient.GetToken()
+		if err != nil {
+			forgetRejectedCredentials(c, username, err)
+			return nil, cli.Exit(fmt.Sprintf("Error: Failed to get PIA token: %v", err), 1)
+		}
+		key, err = piaClient.AddKey(token, privateKey.PublicKey().String())
+		if err != nil {
+			return nil, cli.Exit(fmt.Sprintf("Error: Failed to add key to PIA: %v", err), 1)
+		}
+
+		if err := config.ApplyAddKey(key, c.Bool("keep-dns")); err != nil {
+			return nil, cli.Exit(fmt.Sprintf("Error: Failed to update '%s': %v", file, err), 1)
+		}
+		return []byte(config.String()), nil
+	})
+	var exitErr cli.ExitCoder
+	if errors.As(err, &exitErr) {
+		return err
+	}
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to refresh '%s': %v", file, err), 1)
+	}
+
+	fmt.Printf("✓ Refreshed %s (region %s, server %s)\n", file, region, key.ServerCN)
+	return nil
+}
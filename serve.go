@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// serveFlags configure the serve command
+func serveFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: "127.0.0.1:8080",
+			Usage: "Address to serve the HTTP API on",
+		},
+		&cli.StringSliceFlag{
+			Name:    "auth-token",
+			EnvVars: []string{"PIA_WG_CONFIG_AUTH_TOKEN"},
+			Usage:   "Bearer token clients must present, can be repeated",
+		},
+		&cli.Float64Flag{
+			Name:  "rate",
+			Value: 6,
+			Usage: "Configs each auth token may request per minute",
+		},
+		&cli.IntFlag{
+			Name:  "burst",
+			Value: 3,
+			Usage: "Configs each auth token may request at once before being rate limited",
+		},
+		&cli.IntFlag{
+			Name:  "max-concurrent",
+			Value: 4,
+			Usage: "Maximum number of configs generated at the same time",
+		},
+		&cli.IntFlag{
+			Name:  "max-peers",
+			Value: 4,
+			Usage: "Maximum number of servers one config may register its key with",
+		},
+		verboseFlag(),
+	}
+}
+
+func serveAction(c *cli.Context) error {
+	username, password, err := account(c, "pia-wg-config serve [OPTIONS] USERNAME PASSWORD")
+	if err != nil {
+		return err
+	}
+	verbose := c.Bool("verbose")
+
+	tokens := c.StringSlice("auth-token")
+	if len(tokens) == 0 {
+		return cli.Exit("Error: At least one --auth-token is required", 1)
+	}
+	if c.Int("max-concurrent") < 1 {
+		return cli.Exit("Error: --max-concurrent must be at least 1", 1)
+	}
+	if c.Int("max-peers") < 1 {
+		return cli.Exit("Error: --max-peers must be at least 1", 1)
+	}
+
+	opts, err := clientOptions(c)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	piaClient, err := pia.NewPIAClient(username, password, "", verbose, opts...)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: Failed to connect to PIA servers: %v", err), 1)
+	}
+	account := newPIAAccount(piaClient)
+	api := &configServer{
+		tokens:      tokens,
+		newClient:   account.forRegion,
+		listRegions: account.regions,
+		limiter:     newRateLimiter(c.Float64("rate")/60, c.Int("burst")),
+		slots:       make(chan struct{}, c.Int("max-concurrent")),
+		maxPeers:    c.Int("max-peers"),
+		verbose:     verbose,
+	}
+
+	server := &http.Server{
+		Addr:              c.String("listen"),
+		Handler:           api.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(c.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	log.Printf("Serving the config API on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	return nil
+}
+
+const (
+	// serverListTTL is how long serve uses a server list before downloading
+	// it again
+	serverListTTL = time.Hour
+
+	// tokenTTL is how long serve reuses a PIA token, well within the 24 hours
+	// PIA tokens are valid for
+	tokenTTL = 12 * time.Hour
+)
+
+// piaAccount is the PIA client of the serve command. The server list is
+// downloaded once an hour and a token is requested only when the cached one
+// expired or PIA rejected it, so requests only cost an addKey call.
+type piaAccount struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	client   *pia.PIAClient
+	listedAt time.Time
+	token    string
+	tokenAt  time.Time
+}
+
+func newPIAAccount(client *pia.PIAClient) *piaAccount {
+	return &piaAccount{now: time.Now, client: client, listedAt: time.Now()}
+}
+
+// forRegion returns a client for region sharing the server list and token
+func (a *piaAccount) forRegion(region string) (pia.PIAWgClient, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.refreshServers()
+
+	client, err := a.client.ForRegion(region)
+	if err != nil {
+		return nil, err
+	}
+	return &accountClient{PIAClient: client, account: a}, nil
+}
+
+// regions returns the names of all regions by ID
+func (a *piaAccount) regions() (map[pia.Region]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.refreshServers()
+
+	return a.client.RegionNames(), nil
+}
+
+// refreshServers downloads the server list again once it is older than
+// serverListTTL, keeping the old one if that fails. a.mu must be held.
+func (a *piaAccount) refreshServers() {
+	if a.now().Sub(a.listedAt) < serverListTTL {
+		return
+	}
+	if err := a.client.RefreshServers(); err != nil {
+		log.Printf("Warning: failed to refresh the server list: %v", err)
+		return
+	}
+	a.listedAt = a.now()
+}
+
+// getToken returns the cached token, requesting one through client when
+// there is none, it expired, or it is the rejected token
+func (a *piaAccount) getToken(client pia.PIAWgClient, rejected string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && a.token != rejected && a.now().Sub(a.tokenAt) < tokenTTL {
+		return a.token, nil
+	}
+	token, err := client.GetToken()
+	if err != nil {
+		return "", err
+	}
+	a.token, a.tokenAt = token, a.now()
+
+	return token, nil
+}
+
+// accountClient is a region client of a piaAccount. It hands out the cached
+// token and requests a new one once when PIA rejects it.
+type accountClient struct {
+	*pia.PIAClient
+	account *piaAccount
+}
+
+func (c *accountClient) GetToken() (string, error) {
+	return c.account.getToken(c.PIAClient, "")
+}
+
+func (c *accountClient) AddKey(token, publickey string) (pia.AddKeyResult, error) {
+	result, err := c.PIAClient.AddKey(token, publickey)
+	if token, ok := c.renewToken(token, err); ok {
+		return c.PIAClient.AddKey(token, publickey)
+	}
+	return result, err
+}
+
+func (c *accountClient) AddKeys(token, publickey string, n int) ([]pia.AddKeyResult, error) {
+	results, err := c.PIAClient.AddKeys(token, publickey, n)
+	if token, ok := c.renewToken(token, err); ok {
+		return c.PIAClient.AddKeys(token, publickey, n)
+	}
+	return results, err
+}
+
+// renewToken requests a new token if err is PIA rejecting token
+func (c *accountClient) renewToken(token string, err error) (string, bool) {
+	var statusErr *pia.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		return "", false
+	}
+	token, err = c.account.getToken(c.PIAClient, token)
+	if err != nil {
+		log.Printf("Failed to renew the PIA token: %v", err)
+		return "", false
+	}
+	return token, true
+}
+
+// configServer is the HTTP API of the serve command. It holds the PIA
+// credentials so clients can request configs without them.
+type configServer struct {
+	tokens      []string
+	newClient   func(region string) (pia.PIAWgClient, error)
+	listRegions func() (map[pia.Region]string, error)
+	limiter     *rateLimiter
+	slots       chan struct{}
+	maxPeers    int
+	verbose     bool
+}
+
+// configRequest is the body of POST /configs
+type configRequest struct {
+	Region  string        `json:"region"`
+	Format  string        `json:"format"`
+	Options configOptions `json:"options"`
+}
+
+// configOptions mirror the config flags of the CLI
+type configOptions struct {
+	AllowedIPs          []string `json:"allowed_ips"`
+	ExcludeIPs          []string `json:"exclude_ips"`
+	MTU                 int      `json:"mtu"`
+	PersistentKeepalive *int     `json:"keepalive"`
+	DNSMode             string   `json:"dns_mode"`
+	DNS                 []string `json:"dns"`
+	KillSwitch          string   `json:"killswitch"`
+	KillSwitchAllowIPs  []string `json:"killswitch_allow"`
+	IPv6                string   `json:"ipv6"`
+	Peers               int      `json:"peers"`
+}
+
+// generatorConfig validates the options and converts them to a generator
+// config
+func (o configOptions) generatorConfig() (pia.PIAWgGeneratorConfig, error) {
+	config := pia.PIAWgGeneratorConfig{
+		MTU:                 o.MTU,
+		PersistentKeepalive: o.PersistentKeepalive,
+		DNS:                 o.DNS,
+		Peers:               o.Peers,
+	}
+
+	if k := o.PersistentKeepalive; k != nil && (*k < 0 || *k > 65535) {
+		return config, fmt.Errorf("invalid keepalive %d, expected 0 to 65535 seconds", *k)
+	}
+
+	var err error
+	if config.AllowedIPs, err = pia.ParsePrefixes(o.AllowedIPs); err != nil {
+		return config, fmt.Errorf("invalid allowed_ips: %v", err)
+	}
+	if config.ExcludeIPs, err = pia.ParsePrefixes(o.ExcludeIPs); err != nil {
+		return config, fmt.Errorf("invalid exclude_ips: %v", err)
+	}
+	if config.DNSMode, err = pia.ParseDNSMode(o.DNSMode); err != nil {
+		return config, err
+	}
+	if len(o.DNS) > 0 && o.DNSMode == "" {
+		config.DNSMode = pia.DNSModeCustom
+	}
+	if config.KillSwitch, err = pia.ParseKillSwitch(o.KillSwitch); err != nil {
+		return config, err
+	}
+	if config.KillSwitchAllowIPs, err = pia.ParsePrefixes(o.KillSwitchAllowIPs); err != nil {
+		return config, fmt.Errorf("invalid killswitch_allow: %v", err)
+	}
+	if config.IPv6Mode, err = pia.ParseIPv6Mode(o.IPv6); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+func (s *configServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /regions", s.handleRegions)
+	mux.HandleFunc("POST /configs", s.handleConfigs)
+	return s.authenticate(mux)
+}
+
+// clientKey is the context key of the client a request authenticated as
+type clientKey struct{}
+
+// authenticate rejects requests without a valid bearer token and records
+// which token a request presented, so clients behind one address, like a
+// proxy, are rate limited apart and a client can't dodge its limit by
+// changing addresses
+func (s *configServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		client, valid := s.tokenClient(token)
+		if !ok || !valid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pia-wg-config"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, client)))
+	})
+}
+
+// tokenClient names the client of a valid token by the position of its
+// --auth-token, so logs and the rate limiter don't hold the token itself
+func (s *configServer) tokenClient(token string) (string, bool) {
+	client, valid := "", false
+	for i, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			client, valid = fmt.Sprintf("token %d", i+1), true
+		}
+	}
+	return client, valid
+}
+
+func (s *configServer) handleRegions(w http.ResponseWriter, r *http.Request) {
+	regions, err := s.listRegions()
+	if err != nil {
+		log.Printf("Failed to list regions: %v", err)
+		writeError(w, http.StatusBadGateway, "failed to fetch regions from PIA")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, regions)
+}
+
+func (s *configServer) handleConfigs(w http.ResponseWriter, r *http.Request) {
+	client, _ := r.Context().Value(clientKey{}).(string)
+	if wait, ok := s.limiter.allow(client, time.Now()); !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+
+	var req configRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if req.Region == "" {
+		writeError(w, http.StatusBadRequest, "region is required")
+		return
+	}
+	format, err := pia.ParseFormat(req.Format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	generatorConfig, err := req.Options.generatorConfig()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// every peer costs an addKey request against the PIA account
+	if req.Options.Peers < 0 || req.Options.Peers > s.maxPeers {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid peers %d, expected 0 to %d", req.Options.Peers, s.maxPeers))
+		return
+	}
+	generatorConfig.Format = format
+	generatorConfig.Verbose = s.verbose
+
+	// wait for a free slot so bursts don't hammer the PIA account
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-r.Context().Done():
+		writeError(w, http.StatusServiceUnavailable, "request cancelled")
+		return
+	}
+
+	piaClient, err := s.newClient(req.Region)
+	if err != nil {
+		log.Printf("Failed to create PIA client for %s: %v", req.Region, err)
+		writeError(w, http.StatusBadGateway, "failed to connect to PIA servers")
+		return
+	}
+	config, err := pia.NewPIAWgGenerator(piaClient, generatorConfig).Generate()
+	if err != nil {
+		log.Printf("Failed to generate config for %s: %v", req.Region, err)
+		writeError(w, http.StatusBadGateway, "failed to generate wireguard configuration")
+		return
+	}
+	if s.verbose {
+		log.Printf("Generated a config for %s in %s", client, req.Region)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if format == pia.FormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, config)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// rateLimiter is a token bucket per client
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(max(burst, 1)), buckets: map[string]*bucket{}}
+}
+
+// allow takes a token for client, or returns how long until one is available
+func (l *rateLimiter) allow(client string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		l.prune(now)
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		if l.rate <= 0 {
+			return time.Hour, false
+		}
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+
+	return 0, true
+}
+
+// prune forgets clients whose buckets have refilled, keeping the map bounded
+// by the number of recently active clients
+func (l *rateLimiter) prune(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	"github.com/kylegrantlucas/pia-wg-config/pia/piatest"
+)
+
+type fakePIAClient struct {
+	region string
+}
+
+func (f *fakePIAClient) GetToken() (string, error) {
+	return "token", nil
+}
+
+func (f *fakePIAClient) AddKey(token, publickey string) (pia.AddKeyResult, error) {
+	return pia.AddKeyResult{
+		Status:     "OK",
+		ServerKey:  publickey,
+		ServerPort: 1337,
+		ServerIP:   "1.2.3.4",
+		PeerIP:     "10.1.2.3",
+		DNSServers: []string{"10.0.0.243"},
+		Region:     f.region,
+	}, nil
+}
+
+func testConfigServer(rate float64, burst int) *configServer {
+	return &configServer{
+		tokens: []string{"secret", "other"},
+		newClient: func(region string) (pia.PIAWgClient, error) {
+			if region == "nowhere" {
+				return nil, errors.New("region 'nowhere' not found")
+			}
+			return &fakePIAClient{region: region}, nil
+		},
+		listRegions: func() (map[pia.Region]string, error) {
+			return map[pia.Region]string{"uk_london": "UK London"}, nil
+		},
+		limiter:  newRateLimiter(rate, burst),
+		slots:    make(chan struct{}, 1),
+		maxPeers: 4,
+	}
+}
+
+func TestConfigServer(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		wantBody   string
+		// dontWant must not appear in the body
+		dontWant string
+	}{
+		{
+			name:       "regions",
+			method:     http.MethodGet,
+			path:       "/regions",
+			token:      "secret",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"uk_london":"UK London"}`,
+		},
+		{
+			name:       "missing token",
+			method:     http.MethodGet,
+			path:       "/regions",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong token",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "guess",
+			body:       `{"region":"uk_london"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "config",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london","format":"wg-quick","options":{"dns":["9.9.9.9"],"exclude_ips":["10.0.0.0/8"]}}`,
+			wantStatus: http.StatusOK,
+			wantBody:   "DNS = 9.9.9.9",
+		},
+		{
+			name:       "json config",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london","format":"json"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"endpoint": "1.2.3.4:1337"`,
+		},
+		{
+			name:       "default keepalive",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   "PersistentKeepalive = 25",
+		},
+		{
+			name:       "keepalive disabled",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london","options":{"keepalive":0}}`,
+			wantStatus: http.StatusOK,
+			wantBody:   "Endpoint = 1.2.3.4:1337",
+			dontWant:   "PersistentKeepalive",
+		},
+		{
+			name:       "negative keepalive",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london","options":{"keepalive":-1}}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing region",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown format",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london","format":"ini"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid option",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london","options":{"allowed_ips":["not-a-cidr"]}}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "too many peers",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london","options":{"peers":5}}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "expected 0 to 4",
+		},
+		{
+			name:       "negative peers",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"uk_london","options":{"peers":-1}}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown region",
+			method:     http.MethodPost,
+			path:       "/configs",
+			token:      "secret",
+			body:       `{"region":"nowhere"}`,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "wrong method",
+			method:     http.MethodGet,
+			path:       "/configs",
+			token:      "secret",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	server := httptest.NewServer(testConfigServer(1, 100).handler())
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %v, want %v (%s)", resp.StatusCode, tt.wantStatus, body)
+			}
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", body, tt.wantBody)
+			}
+			if tt.dontWant != "" && strings.Contains(string(body), tt.dontWant) {
+				t.Errorf("body = %s, want it not to contain %s", body, tt.dontWant)
+			}
+		})
+	}
+}
+
+func TestConfigServer_rateLimit(t *testing.T) {
+	server := httptest.NewServer(testConfigServer(0.001, 2).handler())
+	defer server.Close()
+
+	// the limit is per token, every request comes from the same address
+	var statuses []int
+	for _, token := range []string{"secret", "secret", "secret", "other"} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/configs", strings.NewReader(`{"region":"uk_london"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("rate limited response without Retry-After")
+		}
+	}
+
+	want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+}
+
+func TestConfigServer_concurrency(t *testing.T) {
+	s := testConfigServer(1, 100)
+	var mu sync.Mutex
+	active, peak := 0, 0
+	s.newClient = func(region string) (pia.PIAWgClient, error) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return &fakePIAClient{region: region}, nil
+	}
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/configs", strings.NewReader(`{"region":"uk_london"}`))
+			req.Header.Set("Authorization", "Bearer secret")
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if peak != 1 {
+		t.Errorf("peak concurrent generations = %d, want 1", peak)
+	}
+}
+
+func TestPIAAccount(t *testing.T) {
+	s := piatest.NewServer()
+	defer s.Close()
+	client, err := pia.NewPIAClient(piatest.DefaultUsername, piatest.DefaultPassword, "", false, s.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := newPIAAccount(client)
+	now := time.Now()
+	account.now = func() time.Time { return now }
+
+	generate := func(region string) pia.ConfigData {
+		t.Helper()
+		client, err := account.forRegion(region)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := pia.NewPIAWgGenerator(client, pia.PIAWgGeneratorConfig{}).GenerateData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// one server list and token serve every region
+	if data := generate("uk_london"); data.ServerCN != "london402" {
+		t.Errorf("uk_london config from %s", data.ServerCN)
+	}
+	if data := generate("de_berlin"); data.ServerCN != "berlin402" {
+		t.Errorf("de_berlin config from %s", data.ServerCN)
+	}
+	regions, err := account.regions()
+	if err != nil || regions["us_california"] != "US California" || len(regions) != 3 {
+		t.Errorf("regions() = %v, %v", regions, err)
+	}
+	if _, err := account.forRegion("nowhere"); err == nil {
+		t.Error("forRegion() of an unknown region succeeded")
+	}
+	for endpoint, want := range map[piatest.Endpoint]int{piatest.ServerList: 1, piatest.GenerateToken: 1, piatest.AddKey: 2} {
+		if got := s.Requests(endpoint); got != want {
+			t.Errorf("Requests(%s) = %d, want %d", endpoint, got, want)
+		}
+	}
+
+	// a rejected token is replaced once
+	s.Fail(piatest.AddKey, piatest.Failure{Status: http.StatusUnauthorized, Count: 1})
+	generate("uk_london")
+	if got := s.Requests(piatest.GenerateToken); got != 2 {
+		t.Errorf("Requests(generateToken) after a rejected token = %d, want 2", got)
+	}
+
+	// the token and server list expire
+	now = now.Add(tokenTTL)
+	generate("uk_london")
+	if got := s.Requests(piatest.GenerateToken); got != 3 {
+		t.Errorf("Requests(generateToken) after %v = %d, want 3", tokenTTL, got)
+	}
+	if got := s.Requests(piatest.ServerList); got != 2 {
+		t.Errorf("Requests(serverlist) after %v = %d, want 2", tokenTTL, got)
+	}
+}
+
+func TestRateLimiter_refill(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := time.Now()
+
+	if _, ok := l.allow("a", now); !ok {
+		t.Fatal("first request limited")
+	}
+	if wait, ok := l.allow("a", now); ok || wait != time.Second {
+		t.Errorf("allow() = %v, %v, want 1s, false", wait, ok)
+	}
+	if _, ok := l.allow("b", now); !ok {
+		t.Error("other client limited")
+	}
+	if _, ok := l.allow("a", now.Add(time.Second)); !ok {
+		t.Error("request limited after refill")
+	}
+}
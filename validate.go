@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// validateAction checks wg-quick config files, printing line numbered
+// diagnostics and exiting non-zero if any has errors
+func validateAction(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.Exit("Error: A config file is required\n\nUsage:\n  pia-wg-config validate [--strict] FILE...", 1)
+	}
+
+	failed := false
+	for _, file := range c.Args().Slice() {
+		diagnostics, err := validateFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			failed = true
+			continue
+		}
+
+		for _, d := range diagnostics {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s: %s\n", file, d.Line, d.Severity, d.Msg)
+			if d.Severity == pia.SeverityError || c.Bool("strict") {
+				failed = true
+			}
+		}
+		if len(diagnostics) == 0 {
+			fmt.Printf("✓ %s is valid\n", file)
+		}
+	}
+
+	if failed {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+// validateFile parses and validates a config, parse errors are returned as
+// a diagnostic
+func validateFile(file string) ([]pia.Diagnostic, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config, err := pia.ParseWGQuick(f)
+	var parseErr *pia.WGQuickParseError
+	if errors.As(err, &parseErr) {
+		return []pia.Diagnostic{{Line: parseErr.Line, Severity: pia.SeverityError, Msg: parseErr.Msg}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Validate(), nil
+}
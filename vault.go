@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kylegrantlucas/pia-wg-config/pia"
+	cli "github.com/urfave/cli/v2"
+)
+
+// vaultFlags select a HashiCorp Vault KV v2 secret holding the PIA account
+// and how to log in to Vault
+func vaultFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "vault-addr",
+			EnvVars: []string{"VAULT_ADDR"},
+			Usage:   "Address of the Vault server, e.g. https://vault.example.com:8200",
+		},
+		&cli.StringFlag{
+			Name:    "vault-token",
+			EnvVars: []string{"VAULT_TOKEN"},
+			Usage:   "Vault token, instead of logging in with AppRole",
+		},
+		&cli.StringFlag{
+			Name:    "vault-role-id",
+			EnvVars: []string{"VAULT_ROLE_ID"},
+			Usage:   "AppRole role ID to log in to Vault with",
+		},
+		&cli.StringFlag{
+			Name:    "vault-secret-id",
+			EnvVars: []string{"VAULT_SECRET_ID"},
+			Usage:   "AppRole secret ID to log in to Vault with",
+		},
+		&cli.StringFlag{
+			Name:  "vault-approle-mount",
+			Value: "approle",
+			Usage: "Mount path of the AppRole auth method",
+		},
+		&cli.StringFlag{
+			Name:    "vault-namespace",
+			EnvVars: []string{"VAULT_NAMESPACE"},
+			Usage:   "Vault Enterprise namespace",
+		},
+		&cli.StringFlag{
+			Name:  "vault-path",
+			Usage: "KV v2 secret with username and password fields to take the account from, as <mount>/<path>, e.g. secret/pia",
+		},
+	}
+}
+
+// vaultWriteFlag stores the generated key and config in Vault
+func vaultWriteFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "vault-write-path",
+		Usage: "KV v2 secret to write the generated private_key, public_key and config to, as <mount>/<path>",
+	}
+}
+
+// vaultClient talks to the Vault HTTP API, logging in with AppRole on first
+// use when no token is given
+type vaultClient struct {
+	addr      string
+	token     string
+	roleID    string
+	secretID  string
+	mount     string
+	namespace string
+	client    *http.Client
+}
+
+// newVaultClient returns a client for the Vault flags, or nil without
+// --vault-addr. The client is shared by the whole run so AppRole logs in once.
+func newVaultClient(c *cli.Context) (*vaultClient, error) {
+	addr := c.String("vault-addr")
+	if addr == "" {
+		return nil, nil
+	}
+	if vault, ok := c.App.Metadata["vault"].(*vaultClient); ok {
+		return vault, nil
+	}
+
+	vault := &vaultClient{
+		addr:      strings.TrimSuffix(addr, "/"),
+		token:     c.String("vault-token"),
+		roleID:    c.String("vault-role-id"),
+		secretID:  c.String("vault-secret-id"),
+		mount:     c.String("vault-approle-mount"),
+		namespace: c.String("vault-namespace"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if vault.token == "" && vault.roleID == "" {
+		return nil, errors.New("--vault-token or --vault-role-id is required with --vault-addr")
+	}
+	if c.App.Metadata == nil {
+		c.App.Metadata = map[string]any{}
+	}
+	c.App.Metadata["vault"] = vault
+	return vault, nil
+}
+
+// login exchanges the AppRole role and secret ID for a token
+func (v *vaultClient) login(ctx context.Context) error {
+	if v.token != "" {
+		return nil
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": v.roleID, "secret_id": v.secretID}
+	if err := v.do(ctx, http.MethodPost, "auth/"+strings.Trim(v.mount, "/")+"/login", body, &resp); err != nil {
+		return fmt.Errorf("vault approle login: %v", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return errors.New("vault approle login: no token returned")
+	}
+	v.token = resp.Auth.ClientToken
+	return nil
+}
+
+// read returns the fields of the latest version of a KV v2 secret
+func (v *vaultClient) read(ctx context.Context, path string) (map[string]any, error) {
+	apiPath, err := kvDataPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.login(ctx); err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, apiPath, nil, &resp); err != nil {
+		return nil, fmt.Errorf("vault read %s: %v", path, err)
+	}
+	if resp.Data.Data == nil {
+		return nil, fmt.Errorf("vault read %s: secret has no data", path)
+	}
+	return resp.Data.Data, nil
+}
+
+// write stores fields as a new version of a KV v2 secret
+func (v *vaultClient) write(ctx context.Context, path string, data map[string]any) error {
+	apiPath, err := kvDataPath(path)
+	if err != nil {
+		return err
+	}
+	if err := v.login(ctx); err != nil {
+		return err
+	}
+
+	if err := v.do(ctx, http.MethodPost, apiPath, map[string]any{"data": data}, nil); err != nil {
+		return fmt.Errorf("vault write %s: %v", path, err)
+	}
+	return nil
+}
+
+// credentials reads the username and password fields of a secret
+func (v *vaultClient) credentials(ctx context.Context, path string) (string, string, error) {
+	data, err := v.read(ctx, path)
+	if err != nil {
+		return "", "", err
+	}
+	username, _ := data["username"].(string)
+	password, _ := data["password"].(string)
+	if username == "" || password == "" {
+		return "", "", fmt.Errorf("vault secret %s has no username and password", path)
+	}
+	return username, password, nil
+}
+
+// do sends a request to the Vault API, reporting Vault's error messages for
+// failed requests
+func (v *vaultClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(b, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(vaultErr.Errors, "; "))
+		}
+		return errors.New(resp.Status)
+	}
+
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// kvDataPath turns <mount>/<path> into the KV v2 API path <mount>/data/<path>
+func kvDataPath(path string) (string, error) {
+	mount, secret, ok := strings.Cut(strings.Trim(path, "/"), "/")
+	if !ok || mount == "" || secret == "" {
+		return "", fmt.Errorf("invalid vault path %q, expected <mount>/<path>", path)
+	}
+	return mount + "/data/" + secret, nil
+}
+
+// vaultConfigData is what --vault-write-path stores for a generated config
+func vaultConfigData(data pia.ConfigData, config string) map[string]any {
+	return map[string]any{
+		"private_key":  data.PrivateKey,
+		"public_key":   data.PublicKey,
+		"config":       config,
+		"region":       data.Region,
+		"server":       data.ServerCN,
+		"generated_at": data.GeneratedAt.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// fakeVault is a stand-in for the Vault API with AppRole auth and a KV v2
+// mount at secret/
+type fakeVault struct {
+	mu      sync.Mutex
+	token   string
+	secrets map[string]map[string]any
+	logins  int
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	t.Helper()
+	fake := &fakeVault{token: "s.root", secrets: map[string]map[string]any{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+	}
+
+	if r.URL.Path == "/v1/auth/approle/login" && r.Method == http.MethodPost {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			fail(http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		f.logins++
+		json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": f.token}})
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != f.token {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+	path, ok := strings.CutPrefix(r.URL.Path, "/v1/secret/data/")
+	if !ok {
+		fail(http.StatusNotFound, "no handler for route")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := f.secrets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": data, "metadata": map[string]any{"version": 1}}})
+	case http.MethodPost:
+		var body struct {
+			Data map[string]any `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.secrets[path] = body.Data
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"version": 1}})
+	default:
+		fail(http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+func TestVaultCredentials(t *testing.T) {
+	fake, server := newFakeVault(t)
+	fake.secrets["pia"] = map[string]any{"username": "p1234567", "password": "secret"}
+	fake.secrets["empty"] = map[string]any{"username": "p1234567"}
+
+	tests := []struct {
+		name     string
+		client   vaultClient
+		path     string
+		username string
+		password string
+		err      string
+	}{
+		{name: "token", client: vaultClient{token: "s.root"}, path: "secret/pia", username: "p1234567", password: "secret"},
+		{name: "approle", client: vaultClient{roleID: "role", secretID: "secret", mount: "approle"}, path: "secret/pia", username: "p1234567", password: "secret"},
+		{name: "bad approle", client: vaultClient{roleID: "role", secretID: "wrong", mount: "approle"}, path: "secret/pia", err: "vault approle login: 400 Bad Request: invalid role or secret ID"},
+		{name: "bad token", client: vaultClient{token: "s.wrong"}, path: "secret/pia", err: "vault read secret/pia: 403 Forbidden: permission denied"},
+		{name: "missing secret", client: vaultClient{token: "s.root"}, path: "secret/nope", err: "vault read secret/nope: 404 Not Found"},
+		{name: "no password", client: vaultClient{token: "s.root"}, path: "secret/empty", err: "vault secret secret/empty has no username and password"},
+		{name: "invalid path", client: vaultClient{token: "s.root"}, path: "pia", err: `invalid vault path "pia", expected <mount>/<path>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := tt.client
+			client.addr = server.URL
+			client.client = &http.Client{Timeout: 5 * time.Second}
+			username, password, err := client.credentials(context.Background(), tt.path)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != tt.username || password != tt.password {
+				t.Errorf("got %q %q, want %q %q", username, password, tt.username, tt.password)
+			}
+		})
+	}
+}
+
+func TestVaultWrite(t *testing.T) {
+	fake, server := newFakeVault(t)
+	client := &vaultClient{addr: server.URL, roleID: "role", secretID: "secret", mount: "approle", client: &http.Client{}}
+
+	want := map[string]any{"private_key": "cHJpdmF0ZQ==", "config": "[Interface]\n"}
+	if err := client.write(context.Background(), "secret/wg/home", want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.read(context.Background(), "secret/wg/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read back %v, want %v", got, want)
+	}
+	if fake.logins != 1 {
+		t.Errorf("logged in %d times, want 1", fake.logins)
+	}
+}
+
+func TestKVDataPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{path: "secret/pia", want: "secret/data/pia"},
+		{path: "/kv/team/pia/", want: "kv/data/team/pia"},
+		{path: "secret", err: true},
+		{path: "secret/", err: true},
+		{path: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := kvDataPath(tt.path)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("kvDataPath(%q) = %q, %v", tt.path, got, err)
+		}
+	}
+}
+
+func TestVaultCredentialSource(t *testing.T) {
+	fake, server := newFakeVault(t)
+	fake.secrets["pia"] = map[string]any{"username": "p1234567", "password": "secret"}
+	t.Setenv("VAULT_TOKEN", "s.root")
+	t.Setenv("VAULT_ADDR", "")
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "vault", args: []string{"--vault-addr", server.URL, "--vault-path", "secret/pia"}, want: "p1234567:secret"},
+		{name: "arguments take precedence", args: []string{"--vault-addr", server.URL, "--vault-path", "secret/pia", "user", "pass"}, want: "user:pass"},
+		{name: "subcommand", args: []string{"--vault-addr", server.URL, "--vault-path", "secret/pia", "batch"}, want: "p1234567:secret"},
+		{name: "no address", args: []string{"--vault-path", "secret/pia"}, want: "--vault-addr is required with --vault-path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			action := func(c *cli.Context) error {
+				username, password, err := credentials(c, nil)
+				if err != nil {
+					got = err.Error()
+				} else {
+					got = username + ":" + password
+				}
+				return nil
+			}
+			app := &cli.App{
+				Name:     "pia-wg-config",
+				Action:   action,
+				Flags:    vaultFlags(),
+				Commands: []*cli.Command{{Name: "batch", Action: action}},
+			}
+			if err := app.Run(append([]string{"pia-wg-config"}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
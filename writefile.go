@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// writeOptions control how writeFileAtomic writes a file
+type writeOptions struct {
+	// Perm is the mode of a new file. Mode, when set, overrides it and the
+	// mode of an existing file.
+	Perm os.FileMode
+	Mode *os.FileMode
+
+	// UID and GID change the owner and group, -1 keeps the owner of an
+	// existing file or the current user for a new one
+	UID int
+	GID int
+
+	// Backup keeps the previous contents of an existing file in path.bak
+	Backup bool
+}
+
+// defaultWriteOptions writes a private file owned by the current user
+func defaultWriteOptions() writeOptions {
+	return writeOptions{Perm: 0600, UID: -1, GID: -1}
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, so nothing ever reads a half written config. An existing
+// file keeps its permissions and owner unless opts override them. Symlinks
+// are refused rather than followed, and writers of the directory are
+// serialized with an advisory lock so concurrent runs can't interleave
+// their backups and renames.
+func writeFileAtomic(path string, data []byte, opts writeOptions) error {
+	dir := filepath.Dir(path)
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", dir, err)
+	}
+	defer unlock()
+
+	return writeFileLocked(path, data, opts)
+}
+
+// updateFileAtomic replaces the contents of an existing file with what
+// update returns for them, like writeFileAtomic. The directory lock is held
+// from reading the file to replacing it, so concurrent updates can't
+// overwrite each other.
+func updateFileAtomic(path string, opts writeOptions, update func(data []byte) ([]byte, error)) error {
+	dir := filepath.Dir(path)
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", dir, err)
+	}
+	defer unlock()
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if err := checkRegularFile(path, info); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if data, err = update(data); err != nil {
+		return err
+	}
+
+	return writeFileLocked(path, data, opts)
+}
+
+// checkRegularFile refuses to write through symlinks and to anything but
+// regular files
+func checkRegularFile(path string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to write to %s, it is a symlink", path)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("refusing to write to %s, it isn't a regular file", path)
+	}
+	return nil
+}
+
+// writeFileLocked is writeFileAtomic for callers holding the directory lock
+func writeFileLocked(path string, data []byte, opts writeOptions) error {
+	perm, uid, gid := opts.Perm, opts.UID, opts.GID
+	preserveOwner := false
+	if info, err := os.Lstat(path); err == nil {
+		if err := checkRegularFile(path, info); err != nil {
+			return err
+		}
+		perm = info.Mode().Perm()
+		owner, group, ok := fileOwner(info)
+		if !ok {
+			owner, group = -1, -1
+		}
+		if uid == -1 {
+			uid = owner
+		}
+		if gid == -1 {
+			gid = group
+		}
+		preserveOwner = opts.UID == -1 && opts.GID == -1
+
+		if opts.Backup {
+			old, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := replaceFile(path+".bak", old, perm, owner, group, true); err != nil {
+				return fmt.Errorf("failed to write backup: %v", err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if opts.Mode != nil {
+		perm = *opts.Mode
+	}
+
+	return replaceFile(path, data, perm, uid, gid, preserveOwner)
+}
+
+// replaceFile writes data to a temporary file, syncs it and renames it over
+// path, then syncs the directory. Renaming replaces a symlink at path instead of writing through it.
+// Errors changing the owner are ignored when it is only being preserved,
+// e.g. a user rewriting a file of their group.
+func replaceFile(path string, data []byte, perm os.FileMode, uid, gid int, preserveOwner bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err := tmp.Chown(uid, gid); err != nil && !preserveOwner {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// the rename is only durable once the directory entry is
+	return syncDir(filepath.Dir(path))
+}
+
+// fileFlags control the ownership and backups of written config files
+func fileFlags() []cli.Flag {
+	return append(ownerFlags(), &cli.BoolFlag{
+		Name:  "backup",
+		Usage: "Keep the previous contents of a replaced config file in <file>.bak",
+	})
+}
+
+// ownerFlags control the ownership and permissions of written config files
+func ownerFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "owner",
+			Usage: "User name or uid to own written config files (requires root)",
+		},
+		&cli.StringFlag{
+			Name:  "group",
+			Usage: "Group name or gid of written config files",
+		},
+		&cli.StringFlag{
+			Name:  "mode",
+			Usage: "Octal permissions of written config files, e.g. 0640 (default: 0600, or the mode of the file replaced)",
+		},
+	}
+}
+
+// newWriteOptions builds write options from the fileFlags or ownerFlags
+func newWriteOptions(c *cli.Context) (writeOptions, error) {
+	opts := defaultWriteOptions()
+	opts.Backup = c.Bool("backup")
+
+	if owner := c.String("owner"); owner != "" {
+		uid, err := lookupID(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return opts, fmt.Errorf("invalid --owner %q: %v", owner, err)
+		}
+		opts.UID = uid
+	}
+	if group := c.String("group"); group != "" {
+		gid, err := lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return opts, fmt.Errorf("invalid --group %q: %v", group, err)
+		}
+		opts.GID = gid
+	}
+	if mode := c.String("mode"); mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm > 0777 {
+			return opts, fmt.Errorf("invalid --mode %q, expected octal permissions like 0640", mode)
+		}
+		fileMode := os.FileMode(perm)
+		opts.Mode = &fileMode
+	}
+
+	return opts, nil
+}
+
+// lookupID resolves a numeric id or a name
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockDir is a no-op, advisory locks are only supported on unix
+func lockDir(dir string) (func(), error) {
+	return func() {}, nil
+}
+
+// syncDir is a no-op, directories can't be synced on every platform
+func syncDir(dir string) error {
+	return nil
+}
+
+// fileOwner is not supported outside of unix
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wg0.conf")
+
+	opts := defaultWriteOptions()
+	opts.Backup = true
+	if err := writeFileAtomic(path, []byte("first"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("backup of a new file exists, err = %v", err)
+	}
+
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("second"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{path: "second", path + ".bak": "first"} {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("mode = %v, %v, want 0640 kept", info.Mode().Perm(), err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory has %d entries, want no leftover temporary files", len(entries))
+	}
+}
+
+func TestWriteFileAtomic_options(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wg0.conf")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mode := os.FileMode(0640)
+	opts := defaultWriteOptions()
+	opts.Mode = &mode
+	opts.UID, opts.GID = os.Getuid(), os.Getgid()
+	if err := writeFileAtomic(path, []byte("new"), opts); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode = %v, want 0640", info.Mode().Perm())
+	}
+	if uid, gid, ok := fileOwner(info); ok && (uid != os.Getuid() || gid != os.Getgid()) {
+		t.Errorf("owner = %d:%d, want %d:%d", uid, gid, os.Getuid(), os.Getgid())
+	}
+}
+
+func TestWriteFileAtomic_symlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "wg0.conf")
+	if err := os.Symlink(target, path); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	err := writeFileAtomic(path, []byte("new"), defaultWriteOptions())
+	if err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("writeFileAtomic() error = %v, want a symlink error", err)
+	}
+	if got, _ := os.ReadFile(target); string(got) != "keep" {
+		t.Errorf("symlink target = %q, want it untouched", got)
+	}
+
+	// a symlinked backup is replaced, not written through
+	plain := filepath.Join(dir, "plain.conf")
+	if err := os.WriteFile(plain, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, plain+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultWriteOptions()
+	opts.Backup = true
+	if err := writeFileAtomic(plain, []byte("new"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(target); string(got) != "keep" {
+		t.Errorf("backup was written through a symlink, target = %q", got)
+	}
+}
+
+func TestWriteFileAtomic_concurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wg0.conf")
+	opts := defaultWriteOptions()
+	opts.Backup = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := writeFileAtomic(path, []byte(fmt.Sprintf("config %d", i)), opts); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, file := range []string{path, path + ".bak"} {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(got), "config ") {
+			t.Errorf("%s = %q, want one complete write", filepath.Base(file), got)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory has %d entries, want no leftover temporary files", len(entries))
+	}
+}
+
+func TestUpdateFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counter")
+	if err := os.WriteFile(path, []byte("0"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent updates each see the result of the previous one
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := updateFileAtomic(path, defaultWriteOptions(), func(data []byte) ([]byte, error) {
+				n, err := strconv.Atoi(string(data))
+				return []byte(strconv.Itoa(n + 1)), err
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := os.ReadFile(path); string(got) != "20" {
+		t.Errorf("counter = %s after 20 updates, want 20", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("mode after update = %v, %v, want 0640 kept", info.Mode().Perm(), err)
+	}
+
+	// a failed update leaves the file alone
+	err := updateFileAtomic(path, defaultWriteOptions(), func([]byte) ([]byte, error) {
+		return []byte("lost"), errors.New("failed")
+	})
+	if err == nil {
+		t.Error("updateFileAtomic() with a failing update succeeded")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "20" {
+		t.Errorf("counter = %s after a failed update, want 20", got)
+	}
+
+	if err := updateFileAtomic(filepath.Join(dir, "missing"), defaultWriteOptions(), func(data []byte) ([]byte, error) {
+		return data, nil
+	}); err == nil {
+		t.Error("updateFileAtomic() of a missing file succeeded")
+	}
+}
+
+func TestLookupID(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "1000", want: 1000},
+		{in: "wireguard", want: 42},
+		{in: "nobody-here", wantErr: true},
+	}
+	lookup := func(name string) (string, error) {
+		if name == "wireguard" {
+			return "42", nil
+		}
+		return "", fmt.Errorf("unknown %s", name)
+	}
+	for _, tt := range tests {
+		got, err := lookupID(tt.in, lookup)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("lookupID(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}